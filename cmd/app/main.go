@@ -13,6 +13,7 @@ import (
 	"github.com/aalperen0/portfolio-tracker/internal/data"
 	"github.com/aalperen0/portfolio-tracker/internal/mail"
 	"github.com/aalperen0/portfolio-tracker/internal/model"
+	"github.com/aalperen0/portfolio-tracker/internal/reporting"
 	"github.com/aalperen0/portfolio-tracker/internal/worker"
 )
 
@@ -39,7 +40,20 @@ func main() {
 	}
 
 	cache := cache.NewCache(rdb, 15*time.Minute)
-	marketData := data.NewCoinClient(cfg.Coins.ApiKey, cache)
+	marketData, err := data.NewMarketDataProvider(
+		cfg.Coins.Provider,
+		cfg.Coins.ApiKey,
+		cfg.Coins.FixtureDir,
+		cache,
+	)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to initalize market data provider")
+	}
+	logger.Info().Msgf("using %s market data provider", cfg.Coins.Provider)
+
+	if _, _, err := reporting.ParseYearStart(cfg.Tax.YearStart); err != nil {
+		logger.Fatal().Err(err).Msg("invalid tax-year-start")
+	}
 
 	///////////////////////////////////////////////////////////////
 	// Data models and worker initialization
@@ -48,14 +62,40 @@ func main() {
 		logger.Fatal().Err(err).Msg("failed to initalize models")
 	}
 
-	cm := &data.CoinModel{
-		DB:  db,
-		RDB: rdb,
+	if cfg.AdminEmail != "" {
+		err := models.User.SetRoleByEmail(cfg.AdminEmail, data.RoleAdmin)
+		if err != nil {
+			logger.Error().Err(err).Msgf("failed to give %s the admin role", cfg.AdminEmail)
+		}
 	}
 
-	pnlUpdater := worker.NewPNLUpdater(cm, marketData, 10*time.Minute, logger)
+	pnlUpdater := worker.NewPNLUpdater(&models.Coin, marketData, 10*time.Minute, logger)
 	pnlUpdater.Start()
 
+	priceHistoryWriter := worker.NewPriceHistoryWriter(
+		&models.Coin,
+		&models.Price,
+		marketData,
+		cfg.Prices.Interval,
+		cfg.Prices.BackfillDays,
+		logger,
+	)
+	priceHistoryWriter.Start()
+
+	snapshotWriter := worker.NewSnapshotWriter(
+		&models.Coin,
+		&models.Snapshot,
+		&models.Price,
+		marketData,
+		cfg.Snapshots.Interval,
+		cfg.Snapshots.HourlyRetention,
+		logger,
+	)
+	snapshotWriter.Start()
+
+	tokenPurger := worker.NewTokenPurger(&models.Token, time.Hour, logger)
+	tokenPurger.Start()
+
 	///////////////////////////////////////////////////////////////
 	/// Mailer initialization
 	mailer := mail.New(
@@ -66,6 +106,18 @@ func main() {
 		cfg.Smtp.Sender,
 	)
 
+	alertEvaluator := worker.NewAlertEvaluator(
+		&models.Alert,
+		marketData,
+		mailer,
+		cfg.Alerts.Interval,
+		logger,
+	)
+	alertEvaluator.Start()
+
+	exportWriter := worker.NewExportWriter(&models, mailer, cfg.BaseURL, logger)
+	exportWriter.Start()
+
 	///////////////////////////////////////////////////////////////
 	// Server initialization
 	handler := api.NewHandler(*cfg, logger, models, mailer, marketData)
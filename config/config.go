@@ -3,13 +3,17 @@ package config
 import (
 	"flag"
 	"fmt"
+	"net/netip"
 	"os"
+	"strings"
+	"time"
 )
 
 type Config struct {
 	Port    int
 	Env     string
 	Version string
+	BaseURL string
 	DB      struct {
 		dsn          string
 		maxOpenConns int
@@ -25,11 +29,32 @@ type Config struct {
 		Sender   string
 	}
 	Coins struct {
-		ApiKey string
+		Provider   string
+		ApiKey     string
+		FixtureDir string
 	}
 	Redis struct {
 		Host string
 	}
+	Snapshots struct {
+		Interval        time.Duration
+		HourlyRetention time.Duration
+	}
+	Prices struct {
+		Interval     time.Duration
+		BackfillDays int
+	}
+	Alerts struct {
+		Interval time.Duration
+	}
+	Tax struct {
+		YearStart    string
+		LongTermDays int
+	}
+	AdminEmail string
+
+	// Proxies whose X-Forwarded-For entries are trusted to name the client.
+	TrustedProxies []netip.Prefix
 }
 
 func LoadConfig() *Config {
@@ -38,6 +63,12 @@ func LoadConfig() *Config {
 	flag.StringVar(&cfg.Env, "env", "development", "development|staging|production")
 	flag.StringVar(&cfg.Version, "version", "1.0.0", "versioning")
 
+	baseURL := os.Getenv("BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
+	flag.StringVar(&cfg.BaseURL, "base-url", baseURL, "Public URL of the API used in mailed links")
+
 	// DB
 	dbUser := os.Getenv("DB_USER")
 	dbPassword := os.Getenv("DB_PASSWORD")
@@ -70,11 +101,131 @@ func LoadConfig() *Config {
 
 	flag.StringVar(&cfg.Redis.Host, "redis-host", redisHost, "Redis HOST")
 
-	// COIN API apiKey
+	// COIN API provider and apiKey
+	coinProvider := os.Getenv("COINS_PROVIDER")
+	if coinProvider == "" {
+		coinProvider = "coingecko"
+	}
+	flag.StringVar(
+		&cfg.Coins.Provider,
+		"coin-provider",
+		coinProvider,
+		"Market data provider coingecko|coincap|fixture",
+	)
+	flag.StringVar(
+		&cfg.Coins.FixtureDir,
+		"coin-fixtures",
+		"./fixtures",
+		"Directory of the fixture market data provider",
+	)
+
 	coinApiKey := os.Getenv("COINS_API_KEY")
 	flag.StringVar(&cfg.Coins.ApiKey, "coin-key", coinApiKey, "Market data")
 
+	// Portfolio value snapshots
+	flag.DurationVar(
+		&cfg.Snapshots.Interval,
+		"snapshot-interval",
+		15*time.Minute,
+		"Interval between portfolio value snapshots",
+	)
+	flag.DurationVar(
+		&cfg.Snapshots.HourlyRetention,
+		"snapshot-hourly-retention",
+		90*24*time.Hour,
+		"Age after which portfolio value snapshots are downsampled to one per day",
+	)
+
+	// Price history
+	flag.DurationVar(
+		&cfg.Prices.Interval,
+		"price-history-interval",
+		15*time.Minute,
+		"Interval between live price history updates",
+	)
+	flag.IntVar(
+		&cfg.Prices.BackfillDays,
+		"price-backfill-days",
+		365,
+		"Days of price history backfilled for held coins at startup",
+	)
+
+	// Price alerts
+	flag.DurationVar(
+		&cfg.Alerts.Interval,
+		"alert-interval",
+		5*time.Minute,
+		"Interval between price alert evaluations",
+	)
+
+	// Capital gains reports
+	flag.StringVar(
+		&cfg.Tax.YearStart,
+		"tax-year-start",
+		"01-01",
+		"First day of the fiscal year of tax reports as MM-DD",
+	)
+	flag.IntVar(
+		&cfg.Tax.LongTermDays,
+		"tax-long-term-days",
+		365,
+		"Days a disposal must be held longer than to be a long-term gain",
+	)
+
+	// Admin account promoted at startup
+	flag.StringVar(
+		&cfg.AdminEmail,
+		"admin-email",
+		os.Getenv("ADMIN_EMAIL"),
+		"Email of the registered user given the admin role at startup",
+	)
+
+	// Reverse proxies in front of the API
+	var trustedProxies string
+	flag.StringVar(
+		&trustedProxies,
+		"trusted-proxies",
+		os.Getenv("TRUSTED_PROXIES"),
+		"Comma separated IPs or CIDRs of the proxies whose X-Forwarded-For is trusted",
+	)
+
 	flag.Parse()
 
+	prefixes, err := parsePrefixes(trustedProxies)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid value %q for flag -trusted-proxies: %v\n", trustedProxies, err)
+		os.Exit(2)
+	}
+	cfg.TrustedProxies = prefixes
+
 	return &cfg
 }
+
+// / Parse a comma separated list of IPs and CIDRs, a single IP is a prefix
+// / of its full length.
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		if strings.Contains(field, "/") {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,106 @@
+package analytics
+
+import (
+	"time"
+)
+
+// / Windows selectable for performance, "all" starts at the first ledger entry.
+var Windows = []string{"7d", "30d", "90d", "1y", "ytd", "all"}
+
+// / Start of the window ending at to.
+// # Parameters
+// - first: execution time of the first ledger entry, the start of "all"
+func WindowStart(window string, to, first time.Time) time.Time {
+	switch window {
+	case "7d":
+		return to.AddDate(0, 0, -7)
+	case "30d":
+		return to.AddDate(0, 0, -30)
+	case "90d":
+		return to.AddDate(0, 0, -90)
+	case "ytd":
+		return time.Date(to.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	case "all":
+		return first
+	default:
+		return to.AddDate(-1, 0, 0)
+	}
+}
+
+// / Performance of a portfolio over a window, money fields in USD until
+// / converted. Returns are fractions (0.12 is 12%).
+type Performance struct {
+	From                time.Time `json:"from"`
+	To                  time.Time `json:"to"`
+	StartValue          float64   `json:"start_value"`
+	EndValue            float64   `json:"end_value"`
+	Deposits            float64   `json:"deposits"`
+	Withdrawals         float64   `json:"withdrawals"`
+	TimeWeightedReturn  float64   `json:"time_weighted_return"`
+	AnnualizedTWR       *float64  `json:"annualized_time_weighted_return,omitempty"`
+	MoneyWeightedReturn *float64  `json:"money_weighted_return"`
+	MaxDrawdown         Drawdown  `json:"max_drawdown"`
+	Volatility          float64   `json:"volatility"`
+	SharpeRatio         *float64  `json:"sharpe_ratio"`
+	RiskFreeRate        float64   `json:"risk_free_rate"`
+	Series              []Point   `json:"series,omitempty"`
+}
+
+// / Compute every metric from a daily series.
+// # Parameters
+// - points: series from DailySeries
+// - riskFree: annual risk-free rate of the Sharpe ratio
+// # Return
+// - TWR is annualized only for windows of at least a year, XIRR and Sharpe
+// - are nil when they are undefined for the series
+func Compute(points []Point, riskFree float64) *Performance {
+	perf := &Performance{RiskFreeRate: riskFree}
+	if len(points) == 0 {
+		return perf
+	}
+
+	first, last := points[0], points[len(points)-1]
+	perf.From, perf.To = first.Time, last.Time
+	perf.StartValue, perf.EndValue = first.Value, last.Value
+
+	for _, p := range points[1:] {
+		if p.Flow > 0 {
+			perf.Deposits += p.Flow
+		} else {
+			perf.Withdrawals -= p.Flow
+		}
+	}
+
+	returns := PeriodReturns(points)
+
+	perf.TimeWeightedReturn = TWR(returns)
+	if span := perf.To.Sub(perf.From); span >= PeriodsPerYear*day {
+		annualized := Annualize(perf.TimeWeightedReturn, span)
+		perf.AnnualizedTWR = &annualized
+	}
+
+	if irr, err := XIRR(CashFlows(points)); err == nil {
+		perf.MoneyWeightedReturn = &irr
+	}
+
+	perf.MaxDrawdown = MaxDrawdown(returns)
+	perf.Volatility = Volatility(returns)
+
+	if sharpe, ok := Sharpe(returns, riskFree); ok {
+		perf.SharpeRatio = &sharpe
+	}
+
+	return perf
+}
+
+// / Convert the money fields into the reporting currency.
+func (p *Performance) Convert(rate float64) {
+	p.StartValue *= rate
+	p.EndValue *= rate
+	p.Deposits *= rate
+	p.Withdrawals *= rate
+	for i := range p.Series {
+		p.Series[i].Value *= rate
+		p.Series[i].Flow *= rate
+	}
+}
@@ -0,0 +1,207 @@
+package analytics
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	ActionBuy  = "buy"
+	ActionSell = "sell"
+	ActionHold = "hold"
+)
+
+// / Holding is a coin of the portfolio valued at its current USD price.
+// / Coins with a target that aren't held yet are holdings with no amount.
+type Holding struct {
+	CoinID string
+	Symbol string
+	Amount float64
+	Price  float64
+}
+
+// / RebalanceOptions bound the trades of a rebalance. Money is in USD.
+type RebalanceOptions struct {
+	// / Drift in percentage points a weight may have before the portfolio
+	// / is rebalanced.
+	Tolerance float64
+
+	// / Trades worth less than this are skipped.
+	MinTrade float64
+
+	// / New cash to invest, spread over the coins below their target.
+	Cash float64
+}
+
+// / Allocation compares the current weight of a coin with its target.
+// / Weights and drift are percentages, money is in USD until converted.
+type Allocation struct {
+	CoinID        string  `json:"coin_id"`
+	Symbol        string  `json:"symbol"`
+	Amount        float64 `json:"amount"`
+	Price         float64 `json:"price"`
+	Value         float64 `json:"value"`
+	CurrentWeight float64 `json:"current_weight"`
+	TargetWeight  float64 `json:"target_weight"`
+	Drift         float64 `json:"drift"`
+	OutOfBand     bool    `json:"out_of_band"`
+	Action        string  `json:"action"`
+	TradeAmount   float64 `json:"trade_amount"`
+	TradeValue    float64 `json:"trade_value"`
+}
+
+// / Rebalance is the plan that brings a portfolio back to its targets.
+type Rebalance struct {
+	TotalValue  float64       `json:"total_value"`
+	Cash        float64       `json:"cash"`
+	Tolerance   float64       `json:"tolerance"`
+	MinTrade    float64       `json:"min_trade"`
+	Rebalance   bool          `json:"rebalance"`
+	Buys        float64       `json:"buys"`
+	Sells       float64       `json:"sells"`
+	Unallocated float64       `json:"unallocated_cash"`
+	Shortfall   float64       `json:"funding_shortfall"`
+	Allocations []*Allocation `json:"allocations"`
+}
+
+// / PlanRebalance compares the holdings with the target weights and plans
+// / the trades to close the gap. Coins without a target have a target of
+// / zero.
+// /
+// / When any weight drifted out of the tolerance band every coin is traded
+// / back to its target. Otherwise new cash is only spread over the coins
+// / below their target, in proportion to how far below they are, and
+// / nothing is sold. Trades under the minimum size are skipped, the cash
+// / they leave over is reported as unallocated. A skipped sell leaves the
+// / buys short of funding, they are then scaled down to the cash and the
+// / sells and the difference is reported as the shortfall.
+// # Parameters
+// - holdings: every held coin and every coin with a target
+// - targets: target weight in percent per coin id, adding up to 100
+func PlanRebalance(holdings []Holding, targets map[string]float64, opts RebalanceOptions) *Rebalance {
+	plan := &Rebalance{
+		Cash:        opts.Cash,
+		Tolerance:   opts.Tolerance,
+		MinTrade:    opts.MinTrade,
+		Allocations: []*Allocation{},
+	}
+
+	invested := 0.0
+	for _, h := range holdings {
+		a := &Allocation{
+			CoinID:       h.CoinID,
+			Symbol:       h.Symbol,
+			Amount:       h.Amount,
+			Price:        h.Price,
+			Value:        h.Amount * h.Price,
+			TargetWeight: targets[h.CoinID],
+		}
+		plan.Allocations = append(plan.Allocations, a)
+		invested += a.Value
+	}
+
+	plan.TotalValue = invested + opts.Cash
+
+	for _, a := range plan.Allocations {
+		if invested > 0 {
+			a.CurrentWeight = a.Value / invested * 100
+		}
+		a.Drift = a.CurrentWeight - a.TargetWeight
+		a.OutOfBand = math.Abs(a.Drift) > opts.Tolerance
+		plan.Rebalance = plan.Rebalance || (a.OutOfBand && invested > 0)
+	}
+
+	trades := make(map[*Allocation]float64)
+	switch {
+	case plan.Rebalance || (invested == 0 && opts.Cash > 0):
+		for _, a := range plan.Allocations {
+			trades[a] = a.TargetWeight/100*plan.TotalValue - a.Value
+		}
+	case opts.Cash > 0:
+		gaps := 0.0
+		for _, a := range plan.Allocations {
+			gaps += max(0, a.TargetWeight/100*plan.TotalValue-a.Value)
+		}
+		for _, a := range plan.Allocations {
+			if gap := a.TargetWeight/100*plan.TotalValue - a.Value; gap > 0 {
+				trades[a] = gap / gaps * opts.Cash
+			}
+		}
+	}
+
+	for _, a := range plan.Allocations {
+		a.Action = ActionHold
+
+		trade := trades[a]
+		if trade >= 0 || -trade < opts.MinTrade || -trade < 1e-9 || a.Price <= 0 {
+			continue
+		}
+
+		a.Action = ActionSell
+		a.TradeAmount = min(-trade/a.Price, a.Amount)
+		a.TradeValue = a.TradeAmount * a.Price
+		plan.Sells += a.TradeValue
+	}
+
+	buys := 0.0
+	for _, a := range plan.Allocations {
+		if trade := trades[a]; trade >= opts.MinTrade && trade >= 1e-9 && a.Price > 0 {
+			buys += trade
+		}
+	}
+
+	scale := 1.0
+	if funds := opts.Cash + plan.Sells; buys > funds+1e-9 {
+		scale = funds / buys
+	}
+
+	for _, a := range plan.Allocations {
+		trade := trades[a]
+		if trade < opts.MinTrade || trade < 1e-9 || a.Price <= 0 {
+			continue
+		}
+
+		plan.Shortfall += trade * (1 - scale)
+		trade *= scale
+		if trade < opts.MinTrade || trade < 1e-9 {
+			continue
+		}
+
+		a.Action = ActionBuy
+		a.TradeValue = trade
+		a.TradeAmount = trade / a.Price
+		plan.Buys += trade
+	}
+	if left := opts.Cash + plan.Sells - plan.Buys; left > 1e-9 {
+		plan.Unallocated = left
+	}
+
+	sort.Slice(plan.Allocations, func(i, j int) bool {
+		a, b := plan.Allocations[i], plan.Allocations[j]
+		if a.TargetWeight != b.TargetWeight {
+			return a.TargetWeight > b.TargetWeight
+		}
+		if a.Value != b.Value {
+			return a.Value > b.Value
+		}
+		return a.CoinID < b.CoinID
+	})
+
+	return plan
+}
+
+// / Convert the money fields into the reporting currency.
+func (p *Rebalance) Convert(rate float64) {
+	p.TotalValue *= rate
+	p.Cash *= rate
+	p.MinTrade *= rate
+	p.Buys *= rate
+	p.Sells *= rate
+	p.Unallocated *= rate
+	p.Shortfall *= rate
+	for _, a := range p.Allocations {
+		a.Price *= rate
+		a.Value *= rate
+		a.TradeValue *= rate
+	}
+}
@@ -0,0 +1,126 @@
+package analytics
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// / Crypto trades every day, daily figures are annualized over 365 periods.
+const PeriodsPerYear = 365
+
+var ErrNoSolution = errors.New("cash flows have no internal rate of return")
+
+// / Return is the rate of return of the day ending at Time.
+type Return struct {
+	Time time.Time
+	Rate float64
+}
+
+// / PeriodReturns computes the return of every day of the series. Flows are
+// / assumed at the start of their day, so a day returns
+// / value / (previous value + flow) - 1. Days without capital are skipped.
+func PeriodReturns(points []Point) []Return {
+	returns := []Return{}
+	for i := 1; i < len(points); i++ {
+		base := points[i-1].Value + points[i].Flow
+		if base <= 0 {
+			continue
+		}
+		returns = append(returns, Return{Time: points[i].Time, Rate: points[i].Value/base - 1})
+	}
+	return returns
+}
+
+// / TWR chains the period returns into the time-weighted return, which
+// / removes the effect of the size and timing of deposits and withdrawals.
+func TWR(returns []Return) float64 {
+	growth := 1.0
+	for _, r := range returns {
+		growth *= 1 + r.Rate
+	}
+	return growth - 1
+}
+
+// / Annualize a return earned over the given duration.
+func Annualize(rate float64, over time.Duration) float64 {
+	years := over.Hours() / 24 / PeriodsPerYear
+	if years <= 0 || rate <= -1 {
+		return rate
+	}
+	return math.Pow(1+rate, 1/years) - 1
+}
+
+// / XIRR is the money-weighted return: the annual rate that discounts the
+// / investor cash flows to a net present value of zero. Newton's method is
+// / tried first, bisection is the fallback when it doesn't converge.
+// # Return
+// - ErrNoSolution if the flows don't change sign
+func XIRR(flows []CashFlow) (float64, error) {
+	var hasPositive, hasNegative bool
+	for _, f := range flows {
+		hasPositive = hasPositive || f.Amount > 0
+		hasNegative = hasNegative || f.Amount < 0
+	}
+	if !hasPositive || !hasNegative {
+		return 0, ErrNoSolution
+	}
+
+	start := flows[0].Time
+	years := make([]float64, len(flows))
+	for i, f := range flows {
+		years[i] = f.Time.Sub(start).Hours() / 24 / PeriodsPerYear
+	}
+
+	npv := func(rate float64) (float64, float64) {
+		var value, derivative float64
+		for i, f := range flows {
+			discount := math.Pow(1+rate, years[i])
+			value += f.Amount / discount
+			derivative -= years[i] * f.Amount / (discount * (1 + rate))
+		}
+		return value, derivative
+	}
+
+	rate := 0.1
+	for range 100 {
+		value, derivative := npv(rate)
+		if math.Abs(value) < 1e-7 {
+			return rate, nil
+		}
+		if derivative == 0 {
+			break
+		}
+		next := rate - value/derivative
+		if next <= -1 || math.IsNaN(next) || math.IsInf(next, 0) {
+			break
+		}
+		if math.Abs(next-rate) < 1e-10 {
+			return next, nil
+		}
+		rate = next
+	}
+
+	return bisect(func(r float64) float64 { v, _ := npv(r); return v }, -0.999999, 1e6)
+}
+
+func bisect(f func(float64) float64, low, high float64) (float64, error) {
+	fLow, fHigh := f(low), f(high)
+	if math.Signbit(fLow) == math.Signbit(fHigh) {
+		return 0, ErrNoSolution
+	}
+
+	for range 300 {
+		mid := (low + high) / 2
+		fMid := f(mid)
+		if math.Abs(fMid) < 1e-7 || high-low < 1e-12 {
+			return mid, nil
+		}
+		if math.Signbit(fMid) == math.Signbit(fLow) {
+			low, fLow = mid, fMid
+		} else {
+			high = mid
+		}
+	}
+	return (low + high) / 2, nil
+}
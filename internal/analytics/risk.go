@@ -0,0 +1,81 @@
+package analytics
+
+import (
+	"math"
+	"time"
+)
+
+// / Drawdown is the largest fall of the time-weighted wealth index from a
+// / previous peak, so deposits and withdrawals don't show up as losses.
+type Drawdown struct {
+	Max    float64   `json:"max"`
+	Peak   time.Time `json:"peak"`
+	Trough time.Time `json:"trough"`
+}
+
+// / MaxDrawdown of the wealth index built from the period returns, Max is
+// / zero or negative (-0.25 is a fall of 25% from the peak).
+func MaxDrawdown(returns []Return) Drawdown {
+	var dd Drawdown
+
+	index, peak := 1.0, 1.0
+	var peakTime time.Time
+	if len(returns) > 0 {
+		peakTime = returns[0].Time
+	}
+
+	for _, r := range returns {
+		index *= 1 + r.Rate
+		if index > peak {
+			peak, peakTime = index, r.Time
+			continue
+		}
+		if fall := index/peak - 1; fall < dd.Max {
+			dd = Drawdown{Max: fall, Peak: peakTime, Trough: r.Time}
+		}
+	}
+	return dd
+}
+
+// / Volatility is the annualized sample standard deviation of the returns.
+func Volatility(returns []Return) float64 {
+	return stddev(returns) * math.Sqrt(PeriodsPerYear)
+}
+
+// / Sharpe ratio of the returns over an annual risk-free rate, annualized.
+// # Return
+// - false when there are too few returns or they don't vary
+func Sharpe(returns []Return, riskFree float64) (float64, bool) {
+	sd := stddev(returns)
+	if len(returns) < 2 || sd == 0 {
+		return 0, false
+	}
+
+	excess := mean(returns) - riskFree/PeriodsPerYear
+	return excess / sd * math.Sqrt(PeriodsPerYear), true
+}
+
+func mean(returns []Return) float64 {
+	if len(returns) == 0 {
+		return 0
+	}
+
+	var sum float64
+	for _, r := range returns {
+		sum += r.Rate
+	}
+	return sum / float64(len(returns))
+}
+
+func stddev(returns []Return) float64 {
+	if len(returns) < 2 {
+		return 0
+	}
+
+	m := mean(returns)
+	var sum float64
+	for _, r := range returns {
+		sum += (r.Rate - m) * (r.Rate - m)
+	}
+	return math.Sqrt(sum / float64(len(returns)-1))
+}
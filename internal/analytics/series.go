@@ -0,0 +1,162 @@
+package analytics
+
+import (
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+)
+
+const day = 24 * time.Hour
+
+// / Point is the value of the portfolio at the end of a day together with
+// / the net external flow of that day, deposits positive and withdrawals
+// / negative. All amounts are in USD.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	Flow  float64   `json:"flow"`
+}
+
+// / CashFlow is an external flow seen from the investor: money put into the
+// / portfolio is negative, money taken out (and the final value) positive.
+type CashFlow struct {
+	Time   time.Time
+	Amount float64
+}
+
+// / Prices resolves the USD price of a coin on a UTC day.
+type Prices struct {
+	// / Daily closes per coin id and UTC day.
+	Closes map[string]map[time.Time]float64
+
+	// / Live prices, used for the current day.
+	Current map[string]float64
+
+	last map[string]float64
+}
+
+// / Price of the coin on the day: the live price for today, the daily close
+// / otherwise and the last known price when the history has a gap.
+func (p *Prices) at(coinID string, d time.Time, today bool) float64 {
+	if p.last == nil {
+		p.last = make(map[string]float64)
+	}
+
+	if price, ok := p.Current[coinID]; today && ok {
+		p.last[coinID] = price
+	} else if price, ok := p.Closes[coinID][d]; ok {
+		p.last[coinID] = price
+	}
+	return p.last[coinID]
+}
+
+// / Remember the price of a ledger entry as the last known price of the coin,
+// / so days before the first candle are still valued.
+func (p *Prices) observe(t *data.Transaction) {
+	if p.last == nil {
+		p.last = make(map[string]float64)
+	}
+	if t.Price > 0 {
+		p.last[t.CoinID] = t.PriceUSD()
+	}
+}
+
+// / Flow is the external cash flow of a ledger entry in USD. Buys bring in
+// / their cost, sells take out their proceeds and transfers move the coins
+// / at their value. Fees and airdrops are results of the portfolio, not flows.
+func Flow(t *data.Transaction, price float64) float64 {
+	switch t.Type {
+	case data.TransactionBuy:
+		return t.Quantity*t.PriceUSD() + t.FeeUSD()
+	case data.TransactionSell:
+		return -(t.Quantity*t.PriceUSD() - t.FeeUSD())
+	case data.TransactionTransferIn:
+		if t.Price > 0 {
+			return t.Quantity * t.PriceUSD()
+		}
+		return t.Quantity * price
+	case data.TransactionTransferOut:
+		return -t.Quantity * price
+	}
+	return 0
+}
+
+// / DailySeries replays the ledger and values the holdings at the end of
+// / every UTC day between from and to. The first point carries the value
+// / brought into the window, later points the flows of their day.
+// # Parameters
+// - txs: ledger entries in execution order
+// - prices: daily closes and live prices of the coins in the ledger
+// - from, to: window of the series, to is usually now
+// # Return
+// - one point per day, the last one valued at live prices
+func DailySeries(txs []*data.Transaction, prices *Prices, from, to time.Time) []Point {
+	quantities := make(map[string]float64)
+
+	apply := func(t *data.Transaction) {
+		prices.observe(t)
+		switch {
+		case t.Increases():
+			quantities[t.CoinID] += t.Quantity
+		default:
+			quantities[t.CoinID] -= t.Quantity
+		}
+	}
+
+	value := func(d time.Time, today bool) float64 {
+		var v float64
+		for coinID, q := range quantities {
+			if q > 0 {
+				v += q * prices.at(coinID, d, today)
+			}
+		}
+		return v
+	}
+
+	start := from.UTC().Truncate(day)
+	end := to.UTC().Truncate(day)
+
+	i := 0
+	for ; i < len(txs) && txs[i].ExecutedAt.Before(start); i++ {
+		apply(txs[i])
+	}
+
+	points := []Point{{Time: start, Value: value(start.Add(-day), false)}}
+
+	for d := start; !d.After(end); d = d.Add(day) {
+		var flow float64
+		for ; i < len(txs) && txs[i].ExecutedAt.Before(d.Add(day)); i++ {
+			t := txs[i]
+			flow += Flow(t, prices.at(t.CoinID, d, d.Equal(end)))
+			apply(t)
+		}
+
+		points = append(points, Point{Time: d.Add(day), Value: value(d, d.Equal(end)), Flow: flow})
+	}
+
+	points[len(points)-1].Time = to
+	return points
+}
+
+// / CashFlows turns a series into the investor flows of XIRR: the opening
+// / value and every deposit as negative amounts, withdrawals and the closing
+// / value as positive ones.
+func CashFlows(points []Point) []CashFlow {
+	if len(points) == 0 {
+		return nil
+	}
+
+	flows := []CashFlow{}
+	if points[0].Value > 0 {
+		flows = append(flows, CashFlow{Time: points[0].Time, Amount: -points[0].Value})
+	}
+	for _, p := range points[1:] {
+		if p.Flow != 0 {
+			flows = append(flows, CashFlow{Time: p.Time, Amount: -p.Flow})
+		}
+	}
+
+	last := points[len(points)-1]
+	flows = append(flows, CashFlow{Time: last.Time, Amount: last.Value})
+	return flows
+}
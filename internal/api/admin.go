@@ -0,0 +1,327 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+	"github.com/aalperen0/portfolio-tracker/internal/worker"
+)
+
+// / GET /v1/admin/users?email=&role=&page=&per_page=&sort=
+// / List user accounts. Needs admin:read.
+// # Parameters
+// @ email (string): part of the email
+// @ role (string): user, admin or support
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) AdminListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string
+		Role  string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+	input.Email = h.readURLstring(qs, "email", "")
+	input.Role = h.readURLstring(qs, "role", "")
+	input.Page = h.readURLint(qs, "page", 1, v)
+	input.PerPage = h.readURLint(qs, "per_page", 20, v)
+	input.Sort = h.readURLstring(qs, "sort", "id_asc")
+	input.SortList = []string{"id_asc", "id_desc", "created_at_asc", "created_at_desc", "email_asc", "email_desc"}
+
+	if input.Role != "" {
+		data.ValidateRole(v, input.Role)
+	}
+
+	if data.ValidateOtherFilters(v, input.Filters); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, total, err := h.models.User.GetAll(input.Email, input.Role, input.Filters)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"users": users, "total": total}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / GET /v1/admin/users/:id
+// / Needs admin:read.
+
+func (h *Handler) AdminGetUserHandler(w http.ResponseWriter, r *http.Request) {
+	target, ok := h.readAdminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.writeJSON(w, http.StatusOK, envelope{"user": target}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / PUT /v1/admin/users/:id/role
+// / Change the role of a user. Needs admin:write, admins can't change
+// / their own role so the last admin can't lock everyone out.
+// # Parameters
+// @ role (string, required): user, admin or support
+
+func (h *Handler) AdminUpdateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	target, ok := h.readAdminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Role string `json:"role"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateRole(v, input.Role); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !h.checkNotSelf(w, r, target) {
+		return
+	}
+
+	previous := target.Role
+	target.Role = input.Role
+
+	if !h.updateAdminTarget(w, r, target) {
+		return
+	}
+
+	h.audit(r, data.AuditUserRoleChanged, target.ID, map[string]any{"from": previous, "to": target.Role})
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"user": target}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / POST /v1/admin/users/:id/deactivate
+// / Disable an account: it can't log in and its sessions and API keys stop
+// / working. Needs admin:write.
+
+func (h *Handler) AdminDeactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	h.setUserDisabled(w, r, true)
+}
+
+// / POST /v1/admin/users/:id/reactivate
+// / Enable a deactivated account again. Needs admin:write.
+
+func (h *Handler) AdminReactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	h.setUserDisabled(w, r, false)
+}
+
+func (h *Handler) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	target, ok := h.readAdminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	if !h.checkNotSelf(w, r, target) {
+		return
+	}
+
+	target.Disabled = disabled
+
+	if !h.updateAdminTarget(w, r, target) {
+		return
+	}
+
+	action := data.AuditUserReactivated
+	if disabled {
+		action = data.AuditUserDeactivated
+
+		if err := h.revokeSessions(target.ID); err != nil {
+			h.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	h.audit(r, action, target.ID, nil)
+
+	err := h.writeJSON(w, http.StatusOK, envelope{"user": target}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / POST /v1/admin/users/:id/logout
+// / End every session of a user. API keys are left alone, the user revokes
+// / those. Needs admin:write.
+
+func (h *Handler) AdminLogoutUserHandler(w http.ResponseWriter, r *http.Request) {
+	target, ok := h.readAdminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.revokeSessions(target.ID); err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	h.audit(r, data.AuditUserLoggedOut, target.ID, nil)
+
+	err := h.writeJSON(w, http.StatusOK, envelope{"message": "all sessions of the user were revoked"}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / GET /v1/admin/workers
+// / Last runs of the background workers and the length of the PNL and export
+// / queues.
+// / Needs admin:read.
+
+func (h *Handler) AdminWorkersHandler(w http.ResponseWriter, r *http.Request) {
+	queues := envelope{}
+	for _, queue := range []string{"pnl_queue", data.ExportQueue} {
+		queued, err := h.models.RDB.LLen(r.Context(), queue).Result()
+		if err != nil {
+			h.serverErrorResponse(w, r, err)
+			return
+		}
+		queues[queue] = queued
+	}
+
+	env := envelope{
+		"workers": worker.Statuses(),
+		"queues":  queues,
+	}
+
+	err := h.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / GET /v1/admin/audit?actor=&target=&page=&per_page=
+// / The audit trail of admin actions, newest first. Needs admin:read.
+
+func (h *Handler) AdminAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ActorID  int
+		TargetID int
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+	input.ActorID = h.readURLint(qs, "actor", 0, v)
+	input.TargetID = h.readURLint(qs, "target", 0, v)
+	input.Page = h.readURLint(qs, "page", 1, v)
+	input.PerPage = h.readURLint(qs, "per_page", 50, v)
+	input.Sort = "created_at_desc"
+	input.SortList = []string{"created_at_desc"}
+
+	if data.ValidateOtherFilters(v, input.Filters); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entries, total, err := h.models.Audit.GetAll(int64(input.ActorID), int64(input.TargetID), input.Filters)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"audit_log": entries, "total": total}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Load the user of the :id parameter, sending 404 when there is none.
+func (h *Handler) readAdminTarget(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := h.readInt64IDParam(r)
+	if err != nil {
+		h.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	target, err := h.models.User.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return target, true
+}
+
+// / Admins change other accounts through these routes, not their own.
+func (h *Handler) checkNotSelf(w http.ResponseWriter, r *http.Request, target *data.User) bool {
+	if target.ID == data.ContextGetUser(r).ID {
+		v := validator.New()
+		v.AddError("id", "you can't change your own account through the admin endpoints")
+		h.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+	return true
+}
+
+func (h *Handler) updateAdminTarget(w http.ResponseWriter, r *http.Request, target *data.User) bool {
+	err := h.models.User.UpdateUser(target)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrEditConflict):
+			h.editConflictResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+	return true
+}
+
+// / Delete the access and refresh tokens of the user.
+func (h *Handler) revokeSessions(userID int64) error {
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		if err := h.models.Token.DeleteTokens(scope, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// / Record an admin action in the audit trail. The action already happened,
+// / so a failed insert is logged rather than failing the request.
+func (h *Handler) audit(r *http.Request, action string, targetUserID int64, details map[string]any) {
+	actorID := data.ContextGetUser(r).ID
+
+	entry := &data.AuditEntry{
+		ActorID:      &actorID,
+		Action:       action,
+		TargetUserID: &targetUserID,
+		Details:      details,
+		IP:           h.clientIP(r),
+	}
+
+	if err := h.models.Audit.Insert(entry); err != nil {
+		h.logger.Err(err).Msgf("failed to record %s of user %d in the audit log", action, targetUserID)
+	}
+}
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / POST /v1/users/alerts
+// / Create a price, 24h change or PNL alert. Triggered alerts are emailed to
+// / the user by the alert worker.
+// # Parameters
+// @ kind (string, required): price_above, price_below, change_up, change_down, pnl_above or pnl_below
+// @ coin_id (string): required for price and change alerts, empty for PNL alerts
+// @ threshold (float, required): price or PNL in the alert currency, change in percent
+// @ currency (string): defaults to the user's reporting currency
+// @ recurring (bool): trigger again after the cooldown instead of once
+// @ cooldown_minutes (int): minutes between two triggers, defaults to 60
+// # Response: Success (HTTP Status 201):
+
+func (h *Handler) CreateAlertHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Kind            string  `json:"kind"`
+		CoinID          string  `json:"coin_id"`
+		Threshold       float64 `json:"threshold"`
+		Currency        string  `json:"currency"`
+		Recurring       bool    `json:"recurring"`
+		CooldownMinutes *int    `json:"cooldown_minutes"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	alert := &data.Alert{
+		UserID:          user.ID,
+		Kind:            input.Kind,
+		CoinID:          strings.ToLower(input.CoinID),
+		Threshold:       input.Threshold,
+		Currency:        strings.ToLower(input.Currency),
+		Recurring:       input.Recurring,
+		CooldownMinutes: 60,
+	}
+	if alert.Currency == "" {
+		alert.Currency = user.Currency
+	}
+	if input.CooldownMinutes != nil {
+		alert.CooldownMinutes = *input.CooldownMinutes
+	}
+
+	v := validator.New()
+	if data.ValidateAlert(v, alert); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if err := h.checkAlertCurrency(alert.Currency); err != nil {
+		h.currencyErrorResponse(w, r, err)
+		return
+	}
+
+	if alert.CoinID != "" {
+		_, _, err := h.marketData.GetCoinCurrentPriceAndSymbol(alert.CoinID)
+		if err != nil {
+			switch {
+			case errors.Is(err, validator.ErrRecordNotFound):
+				h.notFoundResponse(w, r)
+			default:
+				h.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	err = h.models.Alert.Insert(alert)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/users/alerts/%d", alert.ID))
+
+	err = h.writeJSON(w, http.StatusCreated, envelope{"alert": alert}, headers)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / GET /v1/users/alerts?active=true
+
+func (h *Handler) GetAllAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	user := data.ContextGetUser(r)
+
+	activeOnly := h.readURLstring(r.URL.Query(), "active", "false") == "true"
+
+	alerts, err := h.models.Alert.GetAllForUser(user.ID, activeOnly)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"alerts": alerts}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / GET /v1/users/alerts/:id
+
+func (h *Handler) GetAlertHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := h.readInt64IDParam(r)
+	if err != nil {
+		h.notFoundResponse(w, r)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	alert, err := h.models.Alert.Get(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"alert": alert}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / PATCH /v1/users/alerts/:id
+// / Change the threshold or delivery of an alert, or (re)activate it. The
+// / kind and coin of an alert are fixed, create a new alert instead.
+// # Parameters
+// @ threshold (float)
+// @ currency (string)
+// @ recurring (bool)
+// @ cooldown_minutes (int)
+// @ active (bool)
+
+func (h *Handler) UpdateAlertHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := h.readInt64IDParam(r)
+	if err != nil {
+		h.notFoundResponse(w, r)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	alert, err := h.models.Alert.Get(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Threshold       *float64 `json:"threshold"`
+		Currency        *string  `json:"currency"`
+		Recurring       *bool    `json:"recurring"`
+		CooldownMinutes *int     `json:"cooldown_minutes"`
+		Active          *bool    `json:"active"`
+	}
+
+	err = h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Threshold != nil {
+		alert.Threshold = *input.Threshold
+	}
+	if input.Currency != nil {
+		alert.Currency = strings.ToLower(*input.Currency)
+	}
+	if input.Recurring != nil {
+		alert.Recurring = *input.Recurring
+	}
+	if input.CooldownMinutes != nil {
+		alert.CooldownMinutes = *input.CooldownMinutes
+	}
+	if input.Active != nil {
+		alert.Active = *input.Active
+	}
+
+	v := validator.New()
+	if data.ValidateAlert(v, alert); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if err := h.checkAlertCurrency(alert.Currency); err != nil {
+		h.currencyErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.models.Alert.Update(alert)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrEditConflict):
+			h.editConflictResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"alert": alert}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / DELETE /v1/users/alerts/:id
+
+func (h *Handler) DeleteAlertHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := h.readInt64IDParam(r)
+	if err != nil {
+		h.notFoundResponse(w, r)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	err = h.models.Alert.Delete(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"message": "alert successfully deleted"}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Make sure the provider has an exchange rate for the alert currency, so
+// / the worker can compare prices in it.
+func (h *Handler) checkAlertCurrency(currency string) error {
+	if currency == data.BaseCurrency {
+		return nil
+	}
+
+	rates, err := h.marketData.GetExchangeRates()
+	if err != nil {
+		return err
+	}
+	_, err = rates.Rate(currency)
+	return err
+}
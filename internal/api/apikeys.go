@@ -0,0 +1,118 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / Route: POST /v1/users/api-keys
+// / Create a personal API key for scripts. The key is sent as a Bearer token
+// / and only reaches the routes of its scopes. It is shown once in this
+// / response, only its hash is stored.
+// # Parameters
+// @ name (string, required): to recognize the key later
+// @ scopes ([]string, required): portfolio:read, portfolio:write, alerts:read, alerts:write,
+// @   watchlists:read, watchlists:write
+// @ expires_in_days (int): days until the key expires, never when omitted
+// # Response: Success (HTTP Status 201):
+
+func (h *Handler) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays *int     `json:"expires_in_days"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	var expiry *time.Time
+	if input.ExpiresInDays != nil {
+		days := *input.ExpiresInDays
+		v.Check(days > 0, "expires_in_days", "must be greater than zero")
+		v.Check(days <= 3650, "expires_in_days", "must not be more than 3650")
+
+		t := time.Now().AddDate(0, 0, days)
+		expiry = &t
+	}
+
+	user := data.ContextGetUser(r)
+
+	key, err := data.GenerateAPIKey(user.ID, input.Name, input.Scopes, expiry)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if data.ValidateAPIKey(v, key); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = h.models.APIKey.Insert(key)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusCreated, envelope{"api_key": key}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Route: GET /v1/users/api-keys
+// / List the API keys of the user with their scopes, expiry and last use.
+
+func (h *Handler) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := data.ContextGetUser(r)
+
+	keys, err := h.models.APIKey.GetAllForUser(user.ID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"api_keys": keys}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Route: DELETE /v1/users/api-keys/:id
+// / Revoke an API key, requests made with it fail from now on.
+
+func (h *Handler) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := h.readInt64IDParam(r)
+	if err != nil {
+		h.notFoundResponse(w, r)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	err = h.models.APIKey.Delete(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"message": "API key successfully revoked"}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
@@ -12,6 +12,10 @@ import (
 // / Decode incoming json request, and validate user email and password
 // / Compares hash password of the user, with given input password
 // / If any validation error occurs(wrong password etc.), we return 401.
+// / Opens a session with a short-lived access token and a refresh token,
+// / exchanged at POST /v1/tokens/refresh for a new pair. Users with 2FA get
+// / a 5 minute 2fa-pending token instead, exchanged with a code at
+// / POST /v1/tokens/2fa.
 
 func (h *Handler) authenticationHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
@@ -57,13 +61,49 @@ func (h *Handler) authenticationHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	token, err := h.models.Token.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	if user.Disabled {
+		h.accountDisabledResponse(w, r)
+		return
+	}
+
+	tf, err := h.models.TwoFactor.Get(user.ID)
 	if err != nil {
 		h.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = h.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	if tf.Enabled {
+		// One pending token per user, an earlier login's token stops working.
+		err = h.models.Token.DeleteTokens(data.ScopeTwoFactorPending, user.ID)
+		if err != nil {
+			h.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token, err := h.models.Token.New(user.ID, 5*time.Minute, data.ScopeTwoFactorPending)
+		if err != nil {
+			h.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env := envelope{"two_factor_required": true, "two_factor_token": token}
+
+		err = h.writeJSON(w, http.StatusAccepted, env, nil)
+		if err != nil {
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	access, refresh, err := h.models.Token.NewSession(user.ID, r.UserAgent(), h.clientIP(r))
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"authentication_token": access, "refresh_token": refresh}
+
+	err = h.writeJSON(w, http.StatusCreated, env, nil)
 	if err != nil {
 		h.serverErrorResponse(w, r, err)
 	}
@@ -5,30 +5,48 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/aalperen0/portfolio-tracker/internal/data"
 	"github.com/aalperen0/portfolio-tracker/internal/validator"
 )
 
+// / GET /v1/coins?currency=&ids=&page=&per_page=&order=
+// / Market listing quoted in the requested currency, defaults to the
+// / reporting currency of the user or USD for anonymous requests. Older
+// / clients send {"currency": "..."} as a JSON body, it is still read when
+// / the query string has no currency.
+
 func (h *Handler) GetCoinsFromMarketHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Currency string `json:"currency"`
 		data.Filters
 	}
 
-	err := h.readJSON(w, r, &input)
-	if err != nil {
-		h.badRequestResponse(w, r, err)
-		return
+	if r.ContentLength > 0 {
+		err := h.readJSON(w, r, &input)
+		if err != nil {
+			h.badRequestResponse(w, r, err)
+			return
+		}
+	}
+
+	if input.Currency == "" {
+		input.Currency = data.BaseCurrency
+		if user := data.ContextGetUser(r); !user.IsAnonymous() && user.Currency != "" {
+			input.Currency = user.Currency
+		}
 	}
 
 	v := validator.New()
 	qs := r.URL.Query()
+	input.Currency = strings.ToLower(h.readURLstring(qs, "currency", input.Currency))
 	input.Page = h.readURLint(qs, "page", 1, v)
 	input.PerPage = h.readURLint(qs, "per_page", 20, v)
 	input.Ids = h.readURLstring(qs, "ids", "")
 	input.Order = h.readURLstring(qs, "order", "market_cap_desc")
 
+	data.ValidateCurrency(v, input.Currency)
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		h.failedValidationResponse(w, r, v.Errors)
 		return
@@ -37,12 +55,38 @@ func (h *Handler) GetCoinsFromMarketHandler(w http.ResponseWriter, r *http.Reque
 	coins, err := h.marketData.GetCoinMarkets(input.Currency, input.Filters)
 	if err != nil {
 		switch {
-		case strings.Contains(err.Error(), "invalid vs_currency"):
+		case errors.Is(err, validator.ErrInvalidCurrency):
 			h.badRequestResponse(w, r, validator.ErrInvalidCurrency)
-			return
 		default:
 			h.serverErrorResponse(w, r, err)
 		}
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"coins": coins}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / GET /v1/search/coins?q=
+// / Look up coins by id, symbol or name through the market data provider.
+
+func (h *Handler) SearchCoinsHandler(w http.ResponseWriter, r *http.Request) {
+	query := h.readURLstring(r.URL.Query(), "q", "")
+
+	v := validator.New()
+	v.Check(query != "", "q", "must be provided")
+	v.Check(len(query) <= 100, "q", "must not be more than 100 bytes")
+	if !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	coins, err := h.marketData.LookupCoins(query)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
 	}
 
 	err = h.writeJSON(w, http.StatusOK, envelope{"coins": coins}, nil)
@@ -52,11 +96,13 @@ func (h *Handler) GetCoinsFromMarketHandler(w http.ResponseWriter, r *http.Reque
 }
 
 // POST /v1/users/coins
+// POST /v1/portfolios/:pid/coins
 // / Adding coins to portfolio
-// / We're asking user to coin name, amount of coin, purchase price
-// / calculating initial pnl and total cost
-// / fetching the coin from coingecko api, if the coin exists, it adds to db
-// / successfully, otherwise we return coin couldn't be found
+// / We're asking user to coin name, amount of coin, purchase price in the
+// / reporting currency (?currency= or the currency of the user)
+// / fetching the coin from the market data provider, if the coin exists, the purchase
+// / is recorded as a buy in the ledger and the holding is derived from it,
+// / otherwise we return coin couldn't be found
 
 func (h *Handler) AddCoinsHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
@@ -77,49 +123,28 @@ func (h *Handler) AddCoinsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	existingCoin, err := h.models.Coin.GetCoinForUser(input.CoinID, user.ID)
-	if err == nil {
-		err := h.writeJSON(
-			w,
-			http.StatusConflict,
-			envelope{"error": fmt.Sprintf("%s already exists in portfolio", existingCoin.CoinID)},
-			nil,
-		)
-		if err != nil {
-			h.serverErrorResponse(w, r, err)
-		}
-		return
-	} else if !errors.Is(err, validator.ErrRecordNotFound) {
-		h.serverErrorResponse(w, r, err)
-		return
-	}
-
-	currentPrice, symbol, err := h.marketData.GetCoinCurrentPriceAndSymbol(input.CoinID)
+	portfolio, err := h.readPortfolio(r, user.ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, validator.ErrRecordNotFound):
 			h.notFoundResponse(w, r)
-			return
 		default:
 			h.serverErrorResponse(w, r, err)
 		}
+		return
 	}
 
-	// INITIAL Total Cost
-	totalCost := input.Amount * input.PurchasePrice
-
-	// INITIAL PNL
-	currentValue := input.Amount * currentPrice
-	initialPNL := currentValue - totalCost
+	if portfolio.Archived {
+		h.portfolioArchivedResponse(w, r)
+		return
+	}
 
 	coin := &data.Coin{
 		CoinID:               input.CoinID,
 		UserID:               user.ID,
-		Symbol:               symbol,
 		Amount:               input.Amount,
 		PurchasePriceAverage: input.PurchasePrice,
-		TotalCost:            totalCost,
-		PNL:                  initialPNL,
+		TotalCost:            input.Amount * input.PurchasePrice,
 	}
 
 	v := validator.New()
@@ -128,19 +153,56 @@ func (h *Handler) AddCoinsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.models.Coin.InsertCoin(coin)
+	currency, rate, err := h.readCurrency(r, user)
 	if err != nil {
-		h.serverErrorResponse(w, r, err)
+		h.currencyErrorResponse(w, r, err)
+		return
+	}
+
+	currentPrice, symbol, err := h.marketData.GetCoinCurrentPriceAndSymbol(input.CoinID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	purchase := &data.Transaction{
+		UserID:      user.ID,
+		PortfolioID: portfolio.ID,
+		CoinID:      input.CoinID,
+		Symbol:      symbol,
+		Type:        data.TransactionBuy,
+		Quantity:    input.Amount,
+		Price:       input.PurchasePrice,
+		Currency:    currency,
+		FXRate:      rate,
+		ExecutedAt:  time.Now(),
+	}
+
+	coin, err = h.models.Transaction.InsertFirst(purchase, currentPrice)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrDuplicateCoin):
+			h.duplicateCoinResponse(w, r, input.CoinID)
+		default:
+			h.ledgerErrorResponse(w, r, err)
+		}
 		return
 	}
+	coin.Convert(currency, rate)
 
-	err = h.writeJSON(w, http.StatusCreated, envelope{"coin:": coin}, nil)
+	err = h.writeJSON(w, http.StatusCreated, envelope{"coin": coin}, nil)
 	if err != nil {
 		h.serverErrorResponse(w, r, err)
 	}
 }
 
 // / GET /v1/users/coins/:id
+// / GET /v1/portfolios/:pid/coins/:id
 
 func (h *Handler) GetCoinFromPortfolioHandler(w http.ResponseWriter, r *http.Request) {
 	coinID, err := h.readIDParam(r)
@@ -151,7 +213,7 @@ func (h *Handler) GetCoinFromPortfolioHandler(w http.ResponseWriter, r *http.Req
 
 	user := data.ContextGetUser(r)
 
-	coin, err := h.models.Coin.GetCoinForUser(coinID, user.ID)
+	portfolio, err := h.readPortfolio(r, user.ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, validator.ErrRecordNotFound):
@@ -160,8 +222,32 @@ func (h *Handler) GetCoinFromPortfolioHandler(w http.ResponseWriter, r *http.Req
 			h.serverErrorResponse(w, r, err)
 		}
 		return
+	}
+
+	coin, err := h.models.Coin.GetCoinForUser(coinID, portfolio.ID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+
+	}
+
+	currency, rate, err := h.readCurrency(r, user)
+	if err != nil {
+		h.currencyErrorResponse(w, r, err)
+		return
+	}
 
+	err = h.models.Transaction.AttachLots([]*data.Coin{coin}, user.ID, user.CostBasisMethod)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
 	}
+	coin.Convert(currency, rate)
 
 	err = h.writeJSON(w, http.StatusOK, envelope{"coin": coin}, nil)
 	if err != nil {
@@ -178,7 +264,23 @@ func (h *Handler) DeleteCoinFromPortfolioHandler(w http.ResponseWriter, r *http.
 
 	user := data.ContextGetUser(r)
 
-	err = h.models.Coin.DeleteCoin(coinID, user.ID)
+	portfolio, err := h.readPortfolio(r, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if portfolio.Archived {
+		h.portfolioArchivedResponse(w, r)
+		return
+	}
+
+	err = h.models.Coin.DeleteCoin(coinID, portfolio.ID, user.ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, validator.ErrRecordNotFound):
@@ -202,6 +304,7 @@ func (h *Handler) DeleteCoinFromPortfolioHandler(w http.ResponseWriter, r *http.
 }
 
 // / GET /v1/users/coins
+// / GET /v1/portfolios/:pid/coins
 func (h *Handler) GetAllCoinsFromPortfolioHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		CoinID string
@@ -222,6 +325,8 @@ func (h *Handler) GetAllCoinsFromPortfolioHandler(w http.ResponseWriter, r *http
 		"amount_desc",
 		"pnl_asc",
 		"pnl_desc",
+		"realized_pnl_asc",
+		"realized_pnl_desc",
 		"coin_id_asc",
 		"coin_id_desc",
 	}
@@ -231,12 +336,38 @@ func (h *Handler) GetAllCoinsFromPortfolioHandler(w http.ResponseWriter, r *http
 		return
 	}
 
-	coins, err := h.models.Coin.GetAllCoinsForUser(input.CoinID, user.ID, input.Filters)
+	portfolio, err := h.readPortfolio(r, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	coins, err := h.models.Coin.GetAllCoinsForUser(input.CoinID, portfolio.ID, user.ID, input.Filters)
 	if err != nil {
 		h.serverErrorResponse(w, r, err)
 		return
 	}
 
+	currency, rate, err := h.readCurrency(r, user)
+	if err != nil {
+		h.currencyErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.models.Transaction.AttachLots(coins, user.ID, user.CostBasisMethod)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+	for _, coin := range coins {
+		coin.Convert(currency, rate)
+	}
+
 	err = h.writeJSON(w, http.StatusOK, envelope{"coins": coins}, nil)
 	if err != nil {
 		h.serverErrorResponse(w, r, err)
@@ -245,6 +376,10 @@ func (h *Handler) GetAllCoinsFromPortfolioHandler(w http.ResponseWriter, r *http
 }
 
 // / UPDATE /v1/users/coins/:id
+// / UPDATE /v1/portfolios/:pid/coins/:id
+// / Buying more of a coin already held. The purchase is recorded as a buy in
+// / the ledger and the holding (amount, average, total cost, pnl) is derived
+// / from it instead of being edited in place.
 
 func (h *Handler) UpdateCoinsHandler(w http.ResponseWriter, r *http.Request) {
 	coinID, err := h.readIDParam(r)
@@ -255,7 +390,7 @@ func (h *Handler) UpdateCoinsHandler(w http.ResponseWriter, r *http.Request) {
 
 	user := data.ContextGetUser(r)
 
-	coin, err := h.models.Coin.GetCoinForUser(coinID, user.ID)
+	portfolio, err := h.readPortfolio(r, user.ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, validator.ErrRecordNotFound):
@@ -263,6 +398,23 @@ func (h *Handler) UpdateCoinsHandler(w http.ResponseWriter, r *http.Request) {
 		default:
 			h.serverErrorResponse(w, r, err)
 		}
+		return
+	}
+
+	if portfolio.Archived {
+		h.portfolioArchivedResponse(w, r)
+		return
+	}
+
+	coin, err := h.models.Coin.GetCoinForUser(coinID, portfolio.ID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
 	}
 
 	var input struct {
@@ -282,28 +434,209 @@ func (h *Handler) UpdateCoinsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	currency, rate, err := h.readCurrency(r, user)
+	if err != nil {
+		h.currencyErrorResponse(w, r, err)
+		return
+	}
+
 	currentPrice, _, err := h.marketData.GetCoinCurrentPriceAndSymbol(coinID)
 	if err != nil {
 		h.serverErrorResponse(w, r, err)
 		return
 	}
 
-	calculateFields(coin, input.Amount, input.PurchasePrice)
-	calculatePNL(coin, currentPrice)
+	purchase := &data.Transaction{
+		UserID:      user.ID,
+		PortfolioID: portfolio.ID,
+		CoinID:      coin.CoinID,
+		Symbol:      coin.Symbol,
+		Type:        data.TransactionBuy,
+		Quantity:    input.Amount,
+		Price:       input.PurchasePrice,
+		Currency:    currency,
+		FXRate:      rate,
+		ExecutedAt:  time.Now(),
+	}
 
-	err = h.models.Coin.UpdateCoinsForUser(coin)
+	coin, err = h.models.Transaction.Insert(purchase, currentPrice)
+	if err != nil {
+		h.ledgerErrorResponse(w, r, err)
+		return
+	}
+	coin.Convert(currency, rate)
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"coin": coin}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / GET /v1/users/holdings?currency=
+// / Holdings summed per coin across every non-archived portfolio of the user.
+
+func (h *Handler) GetAggregatedHoldingsHandler(w http.ResponseWriter, r *http.Request) {
+	user := data.ContextGetUser(r)
+
+	currency, rate, err := h.readCurrency(r, user)
+	if err != nil {
+		h.currencyErrorResponse(w, r, err)
+		return
+	}
+
+	coins, err := h.models.Coin.GetAggregatedForUser(user.ID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+	for _, coin := range coins {
+		coin.Convert(currency, rate)
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"holdings": coins}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Market data of the coins by id, fetched in a single provider call.
+func (h *Handler) coinMarkets(currency string, coinIDs []string) (map[string]data.CoinMarketData, error) {
+	markets := make(map[string]data.CoinMarketData, len(coinIDs))
+	if len(coinIDs) == 0 {
+		return markets, nil
+	}
+
+	filters := data.Filters{
+		Ids:     strings.Join(coinIDs, ","),
+		Page:    1,
+		PerPage: len(coinIDs),
+		Order:   "market_cap_desc",
+	}
+
+	coins, err := h.marketData.GetCoinMarkets(currency, filters)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range coins {
+		markets[m.ID] = m
+	}
+	return markets, nil
+}
+
+// / Check that the market data provider knows every coin, responding with
+// / 422 naming the unknown ones under field otherwise.
+func (h *Handler) checkMarketCoins(w http.ResponseWriter, r *http.Request, field string, coinIDs []string) bool {
+	markets, err := h.coinMarkets(data.BaseCurrency, coinIDs)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	unknown := []string{}
+	for _, coinID := range coinIDs {
+		if _, ok := markets[coinID]; !ok {
+			unknown = append(unknown, coinID)
+		}
+	}
+	if len(unknown) > 0 {
+		h.failedValidationResponse(w, r, map[string]string{field: "unknown coin ids: " + strings.Join(unknown, ", ")})
+		return false
+	}
+	return true
+}
+
+// / Lowercase and trim coin ids as the market data provider expects them.
+func normalizeCoinIDs(coinIDs []string) []string {
+	normalized := make([]string, 0, len(coinIDs))
+	for _, coinID := range coinIDs {
+		normalized = append(normalized, strings.ToLower(strings.TrimSpace(coinID)))
+	}
+	return normalized
+}
+
+// / GET /v1/users/coins/export?format=csv|json|ods&currency=
+// / GET /v1/portfolios/:pid/coins/export?format=csv|json|ods&currency=
+// / Download every holding of the portfolio valued at current prices, all
+// / fetched in one market data call before the download starts. Coins the
+// / provider doesn't list have no price or value. The format can also be
+// / negotiated through the Accept header, the rows are streamed as they are
+// / read.
+
+func (h *Handler) ExportCoinsHandler(w http.ResponseWriter, r *http.Request) {
+	format, err := readTableFormat(r)
+	if err != nil {
+		h.tableFormatErrorResponse(w, r, err)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	portfolio, err := h.readPortfolio(r, user.ID)
 	if err != nil {
 		switch {
-		case errors.Is(err, validator.ErrEditConflict):
-			h.editConflictResponse(w, r)
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
 		default:
 			h.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	err = h.writeJSON(w, http.StatusOK, envelope{"coin": coin}, nil)
+	currency, rate, err := h.readCurrency(r, user)
+	if err != nil {
+		h.currencyErrorResponse(w, r, err)
+		return
+	}
+
+	columns := []string{
+		"portfolio_id", "coin_id", "symbol", "amount", "purchase_price_average", "total_cost", "price", "value",
+		"unrealized_pnl", "realized_pnl", "currency",
+	}
+	name := fmt.Sprintf("portfolio-%d-%s", portfolio.ID, time.Now().UTC().Format("2006-01-02"))
+
+	// Prices are fetched before the download starts, a failure is still a 500.
+	coinIDs, err := h.models.Coin.CoinIDsForPortfolio(user.ID, portfolio.ID)
 	if err != nil {
 		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	markets, err := h.coinMarkets(data.BaseCurrency, coinIDs)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	h.streamTable(w, r, format, name, columns, func(emit func([]any) error) error {
+		return h.models.Coin.Each(r.Context(), user.ID, portfolio.ID, func(coin *data.Coin) error {
+			var price, value any
+			pnl := coin.PNL * rate
+
+			if m, ok := markets[coin.CoinID]; ok {
+				usd := m.CurrentPrice
+				price = usd * rate
+				value = coin.Amount * usd * rate
+				pnl = (coin.Amount*usd - coin.TotalCost) * rate
+			}
+			coin.Convert(currency, rate)
+
+			return emit([]any{
+				coin.PortfolioID, coin.CoinID, coin.Symbol, coin.Amount, coin.PurchasePriceAverage, coin.TotalCost,
+				price, value, pnl, coin.RealizedPNL, currency,
+			})
+		})
+	})
+}
+
+// / GET /v1/users/coins/:id
+// / GET /v1/portfolios/:pid/coins/:id
+// / httprouter can't register the export next to the :id wildcard, so an id
+// / of "export" is the download of ExportCoinsHandler.
+
+func (h *Handler) getCoinOrExportHandler(w http.ResponseWriter, r *http.Request) {
+	if id, _ := h.readIDParam(r); id == "export" {
+		h.ExportCoinsHandler(w, r)
+		return
 	}
+	h.GetCoinFromPortfolioHandler(w, r)
 }
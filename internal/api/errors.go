@@ -1,8 +1,12 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
 )
 
 // / Logging with level ERROR with  request method
@@ -61,6 +65,13 @@ func (h *Handler) methodNotAllowedResponse(w http.ResponseWriter, r *http.Reques
 	h.errorResponse(w, r, http.StatusMethodNotAllowed, msg)
 }
 
+// / The notAcceptableResponse() method will be used to send a 406 Not Acceptable
+// / status code when none of the media types of the Accept header can be produced.
+func (h *Handler) notAcceptableResponse(w http.ResponseWriter, r *http.Request, offered ...string) {
+	msg := "the resource can only be represented as " + strings.Join(offered, ", ")
+	h.errorResponse(w, r, http.StatusNotAcceptable, msg)
+}
+
 // / The failedValidationResponse() method will be used to send a 422
 // / status code and JSON response to the client due to
 // / validation process encountered with a problem.
@@ -77,6 +88,60 @@ func (h *Handler) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	h.errorResponse(w, r, http.StatusConflict, msg)
 }
 
+// / The duplicateCoinResponse() method will be used to send a 409 Conflict
+// / when the user already holds the given coin in the portfolio.
+func (h *Handler) duplicateCoinResponse(w http.ResponseWriter, r *http.Request, coinID string) {
+	msg := fmt.Sprintf("%s already exists in portfolio", coinID)
+	h.errorResponse(w, r, http.StatusConflict, msg)
+}
+
+// / The ledgerErrorResponse() method maps errors returned while recording
+// / ledger entries. Disposing more than is held is a validation failure of
+// / the quantity, not a server error.
+func (h *Handler) ledgerErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, validator.ErrInsufficientHoldings):
+		h.failedValidationResponse(w, r, map[string]string{"quantity": err.Error()})
+	case errors.Is(err, validator.ErrEditConflict):
+		h.editConflictResponse(w, r)
+	case errors.Is(err, validator.ErrRecordNotFound):
+		h.notFoundResponse(w, r)
+	default:
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / The currencyErrorResponse() method maps errors of resolving the reporting
+// / currency, a currency without an FX rate is a bad request.
+func (h *Handler) currencyErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, validator.ErrInvalidCurrency):
+		h.badRequestResponse(w, r, err)
+	default:
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / The portfolioArchivedResponse() method will be used to send a 409 Conflict
+// / when holdings of an archived portfolio are about to change.
+func (h *Handler) portfolioArchivedResponse(w http.ResponseWriter, r *http.Request) {
+	h.errorResponse(w, r, http.StatusConflict, validator.ErrPortfolioArchived.Error())
+}
+
+// / The rateLimitExceededResponse() method will be used to send a 429 Too Many
+// / Requests when a client repeats a rate limited request too often.
+func (h *Handler) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+	msg := "rate limit exceeded, please try again later"
+	h.errorResponse(w, r, http.StatusTooManyRequests, msg)
+}
+
+// / The twoFactorEnabledResponse() method will be used to send a 409 Conflict
+// / when enrolling while 2FA is already enabled.
+func (h *Handler) twoFactorEnabledResponse(w http.ResponseWriter, r *http.Request) {
+	msg := "two-factor authentication is already enabled, disable it first"
+	h.errorResponse(w, r, http.StatusConflict, msg)
+}
+
 func (h *Handler) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	msg := "invalid or wrong credentials"
 	h.errorResponse(w, r, http.StatusUnauthorized, msg)
@@ -88,7 +153,51 @@ func (h *Handler) invalidAuthTokenResponse(w http.ResponseWriter, r *http.Reques
 	h.errorResponse(w, r, http.StatusUnauthorized, msg)
 }
 
+// / The expiredAuthTokenResponse() method will be used to send a 401 with the
+// / token_expired code, telling clients to refresh instead of logging in.
+func (h *Handler) expiredAuthTokenResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="token expired"`)
+	env := envelope{"error": "authentication token has expired", "code": "token_expired"}
+	err := h.writeJSON(w, http.StatusUnauthorized, env, nil)
+	if err != nil {
+		h.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
+
+func (h *Handler) invalidRefreshTokenResponse(w http.ResponseWriter, r *http.Request, msg string) {
+	h.errorResponse(w, r, http.StatusUnauthorized, msg)
+}
+
 func (h *Handler) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	msg := "you must be authenticated to access this resource"
 	h.errorResponse(w, r, http.StatusUnauthorized, msg)
 }
+
+// / The missingScopeResponse() method will be used to send a 403 Forbidden
+// / when the API key of the request lacks the scope of the route.
+func (h *Handler) missingScopeResponse(w http.ResponseWriter, r *http.Request, scope string) {
+	msg := fmt.Sprintf("your API key needs the %s scope to access this resource", scope)
+	h.errorResponse(w, r, http.StatusForbidden, msg)
+}
+
+// / The sessionRequiredResponse() method will be used to send a 403 Forbidden
+// / when an API key is used on a route reserved to password sessions.
+func (h *Handler) sessionRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	msg := "this resource can't be accessed with an API key, please log in"
+	h.errorResponse(w, r, http.StatusForbidden, msg)
+}
+
+// / The notPermittedResponse() method will be used to send a 403 Forbidden
+// / when the role of the user lacks the permission of the route.
+func (h *Handler) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	msg := "your user account doesn't have the necessary permissions to access this resource"
+	h.errorResponse(w, r, http.StatusForbidden, msg)
+}
+
+// / The accountDisabledResponse() method will be used to send a 403 Forbidden
+// / when a deactivated user tries to log in.
+func (h *Handler) accountDisabledResponse(w http.ResponseWriter, r *http.Request) {
+	msg := "your user account has been deactivated, please contact support"
+	h.errorResponse(w, r, http.StatusForbidden, msg)
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / POST /v1/users/me/export
+// / Request an archive of everything stored about the user. It is built by
+// / the export worker, a download link is mailed once it's ready.
+// / Limited to 3 requests a day.
+// # Response: Success (HTTP Status 202):
+
+func (h *Handler) createExportHandler(w http.ResponseWriter, r *http.Request) {
+	user := data.ContextGetUser(r)
+
+	key := "ratelimit:export:" + strconv.FormatInt(user.ID, 10)
+
+	allowed, err := h.models.Cache.Allow(r.Context(), key, 3, 24*time.Hour)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		h.rateLimitExceededResponse(w, r)
+		return
+	}
+
+	export := &data.Export{UserID: user.ID}
+
+	err = h.models.Export.Insert(export)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"export":  export,
+		"message": "your export is being prepared, a download link will be sent to " + user.Email,
+	}
+
+	err = h.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / GET /v1/users/me/exports
+// / Status of the exports of the user, newest first.
+
+func (h *Handler) listExportsHandler(w http.ResponseWriter, r *http.Request) {
+	user := data.ContextGetUser(r)
+
+	exports, err := h.models.Export.GetAllForUser(user.ID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"exports": exports}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / GET /v1/exports/download?token=
+// / Download the zip archive of an export with the token of the mailed link.
+// / The token works until the link expires, the archive is deleted then.
+
+func (h *Handler) downloadExportHandler(w http.ResponseWriter, r *http.Request) {
+	token := h.readURLstring(r.URL.Query(), "token", "")
+
+	v := validator.New()
+	if data.ValidateToken(v, token); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	export, archive, err := h.models.Export.Download(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired download token")
+			h.failedValidationResponse(w, r, v.Errors)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	filename := fmt.Sprintf("portfolio-tracker-export-%d.zip", export.ID)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+	w.Header().Set("Cache-Control", "no-store")
+
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(archive); err != nil {
+		h.logError(r, err)
+	}
+}
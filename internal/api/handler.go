@@ -17,7 +17,7 @@ type Handler struct {
 	models     model.Models
 	mailer     mail.Mailer
 	wg         sync.WaitGroup
-	marketData *data.Client
+	marketData data.MarketDataProvider
 }
 
 func NewHandler(
@@ -25,7 +25,7 @@ func NewHandler(
 	logger zerolog.Logger,
 	models model.Models,
 	mailer mail.Mailer,
-	marketData *data.Client,
+	marketData data.MarketDataProvider,
 ) *Handler {
 	return &Handler{
 		config:     cfg,
@@ -5,10 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 
@@ -33,6 +36,76 @@ func (h *Handler) readIDParam(r *http.Request) (string, error) {
 	return paramID, nil
 }
 
+// / readInt64IDParam retrieve the numeric "id" URL parameter, ids of
+// / ledger entries and other serial records are positive integers.
+// # Parameters
+// @ - r : The incoming HTTP request
+// / # Returns
+// / - error: Returns an error if retrieved id is not a positive integer
+
+func (h *Handler) readInt64IDParam(r *http.Request) (int64, error) {
+	paramID := httprouter.ParamsFromContext(r.Context()).ByName("id")
+	id, err := strconv.ParseInt(paramID, 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid id parameter")
+	}
+	return id, nil
+}
+
+// / readPortfolio resolves the portfolio a holdings request works against.
+// / Routes under /v1/portfolios/:pid use the given portfolio of the user,
+// / the unscoped /v1/users/... routes use the default portfolio.
+// # Parameters
+// @ - r : The incoming HTTP request
+// @ - userID: owner of the portfolio
+// / # Returns
+// / - error: ErrRecordNotFound if pid is invalid or not owned by the user
+
+func (h *Handler) readPortfolio(r *http.Request, userID int64) (*data.Portfolio, error) {
+	paramID := httprouter.ParamsFromContext(r.Context()).ByName("pid")
+	if paramID == "" {
+		return h.models.Portfolio.GetDefault(userID)
+	}
+
+	id, err := strconv.ParseInt(paramID, 10, 64)
+	if err != nil {
+		return nil, validator.ErrRecordNotFound
+	}
+	return h.models.Portfolio.Get(id, userID)
+}
+
+// / readCurrency resolves the reporting currency of a request. The
+// / ?currency= query parameter overrides the currency chosen by the user,
+// / anonymous requests default to USD.
+// # Parameters
+// @ - r : The incoming HTTP request
+// @ - user: the user of the request
+// / # Returns
+// / - currency code and the units of it per USD at the cached FX rates
+// / - error: ErrInvalidCurrency if the provider has no rate for the currency
+
+func (h *Handler) readCurrency(r *http.Request, user *data.User) (string, float64, error) {
+	currency := data.BaseCurrency
+	if !user.IsAnonymous() && user.Currency != "" {
+		currency = user.Currency
+	}
+	currency = strings.ToLower(h.readURLstring(r.URL.Query(), "currency", currency))
+
+	if currency == data.BaseCurrency {
+		return currency, 1, nil
+	}
+
+	rates, err := h.marketData.GetExchangeRates()
+	if err != nil {
+		return "", 0, err
+	}
+	rate, err := rates.Rate(currency)
+	if err != nil {
+		return "", 0, err
+	}
+	return currency, rate, nil
+}
+
 func (h *Handler) writeJSON(
 	w http.ResponseWriter,
 	status int,
@@ -156,15 +229,113 @@ func (h *Handler) readURLint(
 	return i
 }
 
-func calculateFields(c *data.Coin, amount float64, price float64) {
-	totalNewCost := amount * price
-	c.TotalCost += totalNewCost
+// / readURLtime reads an RFC3339 timestamp or a 2006-01-02 date from the
+// / query string, an invalid value is added to the validator errors.
+func (h *Handler) readURLtime(
+	qs url.Values,
+	key string,
+	defaultValue time.Time,
+	v *validator.Validator,
+) time.Time {
+	str := qs.Get(key)
+	if str == "" {
+		return defaultValue
+	}
+
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t
+	}
+	if t, err := time.Parse(time.DateOnly, str); err == nil {
+		return t
+	}
+
+	v.AddError(key, "must be an RFC3339 timestamp or a YYYY-MM-DD date")
+	return defaultValue
+}
+
+func (h *Handler) readURLfloat(
+	qs url.Values,
+	key string,
+	defaultValue float64,
+	v *validator.Validator,
+) float64 {
+	str := qs.Get(key)
+	if str == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		v.AddError(key, "must be a number")
+		return defaultValue
+	}
+	return f
+}
+
+// / background runs fn in a goroutine tracked by the handler's wait group,
+// / so graceful shutdown waits for it, and recovers from its panics.
+// # Parameters
+// @ - fn : The function to run, e.g. sending an email
+func (h *Handler) background(fn func()) {
+	h.wg.Add(1)
+
+	go func() {
+		defer h.wg.Done()
+
+		defer func() {
+			if err := recover(); err != nil {
+				h.logger.Error().Err(fmt.Errorf("%s", err)).Msg("background task panicked")
+			}
+		}()
+
+		fn()
+	}()
+}
+
+// / clientIP returns the address of the client. X-Forwarded-For is only
+// / honored when the request comes from a trusted proxy: its entries are
+// / walked from the right, past the trusted proxies, to the first address
+// / that isn't one. An entry that isn't an IP ends the walk at the proxy
+// / that added it. Empty if the remote address can't be parsed.
+// # Parameters
+// @ - r : The incoming HTTP request
+func (h *Handler) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+
+	if !h.trustedProxy(addr) {
+		return addr.String()
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
 
-	c.Amount += amount
-	c.PurchasePriceAverage = c.TotalCost / c.Amount
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !h.trustedProxy(addr) {
+			break
+		}
+	}
+	return addr.String()
 }
 
-func calculatePNL(c *data.Coin, currentPrice float64) {
-	newPNL := (c.Amount * currentPrice) - c.TotalCost
-	c.PNL = newPNL
+func (h *Handler) trustedProxy(addr netip.Addr) bool {
+	for _, prefix := range h.config.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
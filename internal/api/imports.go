@@ -0,0 +1,578 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/importer"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / Largest CSV file accepted by the import endpoint.
+const maxImportSize = 10 << 20
+
+// / A row of an import as it was or would be recorded.
+type importedRow struct {
+	Line        int               `json:"line"`
+	Duplicate   bool              `json:"duplicate"`
+	Transaction *data.Transaction `json:"transaction"`
+}
+
+// / Coin a ticker or coin id of an import resolved to.
+type importCoin struct {
+	id     string
+	symbol string
+	price  float64
+	err    error
+}
+
+// / POST /v1/users/imports (multipart/form-data)
+// / Import trades from the CSV export of an exchange into a portfolio.
+// / Tickers are mapped to coins through the market data provider. Rows
+// / that can't be read, mapped or priced, and sells of more than the
+// / portfolio holds at the time, are reported by line. The others are
+// / recorded together in one database transaction, dry runs check them the
+// / same way. Rows imported into the portfolio before are skipped, so
+// / re-importing an overlapping export is safe.
+// # Parameters
+// @ file (file, required): the CSV export
+// @ format (string, required): binance, coinbase, kraken or generic
+// @ mapping (JSON): columns of the generic format, e.g.
+// @   {"date":"Time","type":"Side","symbol":"Ticker","quantity":"Qty","price":"Price"},
+// @   an fx_rate column (units of the currency per USD) is needed for rows
+// @   older than a day in another currency than USD
+// @ symbols (JSON): coin ids of ambiguous tickers, e.g. {"uni":"uniswap"}
+// @ portfolio_id (int): defaults to the default portfolio
+// @ currency (string): currency of rows that don't name one, defaults to
+// @   the reporting currency of the user
+// @ dry_run (bool): only preview the rows, nothing is recorded
+// # Response: Success (HTTP Status 201, 200 for dry runs):
+
+func (h *Handler) ImportTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	err := r.ParseMultipartForm(maxImportSize)
+	if err != nil {
+		h.badRequestResponse(w, r, fmt.Errorf("body must be a multipart form of at most %d MB", maxImportSize>>20))
+		return
+	}
+
+	v := validator.New()
+
+	format := strings.ToLower(r.FormValue("format"))
+	v.Check(
+		validator.PermittedValues(format, importer.Formats...),
+		"format",
+		"must be one of binance, coinbase, kraken, generic",
+	)
+
+	var mapping importer.Mapping
+	if format == importer.FormatGeneric {
+		err := json.Unmarshal([]byte(r.FormValue("mapping")), &mapping)
+		v.Check(err == nil, "mapping", "must be a JSON object of column names")
+	}
+
+	symbols := map[string]string{}
+	if raw := r.FormValue("symbols"); raw != "" {
+		err := json.Unmarshal([]byte(raw), &symbols)
+		v.Check(err == nil, "symbols", "must be a JSON object of tickers to coin ids")
+	}
+
+	dryRun := false
+	if raw := r.FormValue("dry_run"); raw != "" {
+		dryRun, err = strconv.ParseBool(raw)
+		v.Check(err == nil, "dry_run", "must be a boolean value")
+	}
+
+	var portfolioID int64
+	if raw := r.FormValue("portfolio_id"); raw != "" {
+		portfolioID, err = strconv.ParseInt(raw, 10, 64)
+		v.Check(err == nil && portfolioID > 0, "portfolio_id", "must be a positive integer")
+	}
+
+	user := data.ContextGetUser(r)
+
+	currency := strings.ToLower(r.FormValue("currency"))
+	if currency == "" {
+		currency = user.Currency
+	}
+	data.ValidateCurrency(v, currency)
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		v.AddError("file", "must be provided")
+	} else {
+		defer file.Close()
+	}
+
+	if !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var portfolio *data.Portfolio
+	if portfolioID == 0 {
+		portfolio, err = h.models.Portfolio.GetDefault(user.ID)
+	} else {
+		portfolio, err = h.models.Portfolio.Get(portfolioID, user.ID)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if portfolio.Archived {
+		h.portfolioArchivedResponse(w, r)
+		return
+	}
+
+	rows, rowErrors, err := importer.Parse(format, file, mapping)
+	if err != nil {
+		h.failedValidationResponse(w, r, map[string]string{"file": err.Error()})
+		return
+	}
+
+	rates, err := h.marketData.GetExchangeRates()
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	tickers := make(map[string]string, len(symbols))
+	for ticker, coinID := range symbols {
+		tickers[strings.ToLower(ticker)] = strings.ToLower(coinID)
+	}
+
+	coins := map[string]*importCoin{}
+	txs := []*data.Transaction{}
+	lines := map[*data.Transaction]int{}
+
+	for _, row := range rows {
+		coin, err := h.resolveImportCoin(row, tickers, coins)
+		if err != nil {
+			h.serverErrorResponse(w, r, err)
+			return
+		}
+		if coin.err != nil {
+			rowErrors = append(rowErrors, importer.RowError{Line: row.Line, Error: coin.err.Error()})
+			continue
+		}
+
+		t, err := h.importTransaction(row, coin, portfolio.ID, currency, format, rates)
+		if err != nil {
+			if errors.Is(err, errImportRow) {
+				rowErrors = append(rowErrors, importer.RowError{Line: row.Line, Error: err.Error()})
+				continue
+			}
+			h.serverErrorResponse(w, r, err)
+			return
+		}
+
+		txs = append(txs, t)
+		lines[t] = row.Line
+	}
+
+	err = h.importPrices(txs)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	valid := make([]*data.Transaction, 0, len(txs))
+	for _, t := range txs {
+		if err := validateImportTransaction(t); err != nil {
+			rowErrors = append(rowErrors, importer.RowError{Line: lines[t], Error: err.Error()})
+			continue
+		}
+		valid = append(valid, t)
+	}
+	txs = valid
+
+	hashes := make([]string, 0, len(txs))
+	for _, t := range txs {
+		hashes = append(hashes, t.ImportHash)
+	}
+
+	existing, err := h.models.Transaction.ExistingImportHashes(user.ID, portfolio.ID, hashes)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	duplicates := map[*data.Transaction]bool{}
+	fresh := []*data.Transaction{}
+	for _, t := range txs {
+		duplicates[t] = existing[t.ImportHash]
+		existing[t.ImportHash] = true
+
+		if !duplicates[t] {
+			fresh = append(fresh, t)
+		}
+	}
+
+	fresh, oversold, err := h.importOversells(portfolio.ID, user.CostBasisMethod, fresh, lines)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+	rowErrors = append(rowErrors, oversold...)
+
+	sort.Slice(rowErrors, func(i, j int) bool { return rowErrors[i].Line < rowErrors[j].Line })
+
+	rejected := make(map[int]bool, len(oversold))
+	for _, e := range oversold {
+		rejected[e.Line] = true
+	}
+
+	imported := make([]importedRow, 0, len(txs))
+	for _, t := range txs {
+		if !rejected[lines[t]] {
+			imported = append(imported, importedRow{Line: lines[t], Duplicate: duplicates[t], Transaction: t})
+		}
+	}
+
+	summary := envelope{
+		"rows":       len(imported) + len(rowErrors),
+		"new":        len(fresh),
+		"duplicates": len(imported) - len(fresh),
+		"failed":     len(rowErrors),
+	}
+
+	if dryRun {
+		env := envelope{"dry_run": true, "summary": summary, "rows": imported, "errors": rowErrors}
+
+		err = h.writeJSON(w, http.StatusOK, env, nil)
+		if err != nil {
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	prices := make(map[string]float64, len(coins))
+	for _, coin := range coins {
+		if coin.err == nil {
+			prices[coin.id] = coin.price
+		}
+	}
+
+	inserted, err := h.models.Transaction.Import(user.ID, fresh, prices)
+	if err != nil {
+		h.ledgerErrorResponse(w, r, err)
+		return
+	}
+	summary["imported"] = inserted
+
+	env := envelope{"dry_run": false, "summary": summary, "rows": imported, "errors": rowErrors}
+
+	err = h.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Errors of a single row of an import, reported with its line.
+var errImportRow = errors.New("invalid row")
+
+// / Map the coin of a row to a coin of the market data provider. Lookups
+// / are cached in coins by ticker or coin id, failed ones too. A coin the
+// / provider doesn't know is a row error, any other failure is returned.
+func (h *Handler) resolveImportCoin(
+	row *importer.Row,
+	tickers map[string]string,
+	coins map[string]*importCoin,
+) (*importCoin, error) {
+	key := "id:" + row.CoinID
+	if row.CoinID == "" {
+		key = "symbol:" + row.Symbol
+	}
+	if coin, ok := coins[key]; ok {
+		return coin, nil
+	}
+
+	coin := &importCoin{id: row.CoinID}
+	coins[key] = coin
+
+	if coin.id == "" {
+		coin.id = tickers[row.Symbol]
+	}
+
+	if coin.id == "" {
+		matches, err := h.marketData.LookupCoins(row.Symbol)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if match.Symbol == row.Symbol {
+				coin.id = match.ID
+				break
+			}
+		}
+		if coin.id == "" {
+			coin.err = fmt.Errorf("no coin with the ticker %q, map it with symbols", row.Symbol)
+			return coin, nil
+		}
+	}
+
+	price, symbol, err := h.marketData.GetCoinCurrentPriceAndSymbol(coin.id)
+	if err != nil {
+		if errors.Is(err, validator.ErrRecordNotFound) {
+			coin.err = fmt.Errorf("unknown coin %q", coin.id)
+			return coin, nil
+		}
+		return nil, err
+	}
+	coin.price = price
+	coin.symbol = symbol
+	return coin, nil
+}
+
+// / Build the ledger entry of an import row. Rows in another currency than
+// / USD take their FX rate from the fx_rate column, or today's rate when
+// / they were executed within the last day.
+func (h *Handler) importTransaction(
+	row *importer.Row,
+	coin *importCoin,
+	portfolioID int64,
+	currency string,
+	format string,
+	rates data.ExchangeRates,
+) (*data.Transaction, error) {
+	t := &data.Transaction{
+		PortfolioID: portfolioID,
+		CoinID:      coin.id,
+		Symbol:      coin.symbol,
+		Type:        row.Type,
+		Quantity:    row.Quantity,
+		Price:       row.Price,
+		Fee:         row.Fee,
+		Currency:    row.Currency,
+		Note:        row.Note,
+		ExecutedAt:  row.Time,
+		ImportHash:  row.Hash,
+	}
+	if t.Currency == "" {
+		t.Currency = currency
+	}
+	if t.Note == "" {
+		t.Note = "imported from " + format
+	}
+
+	// The providers only know today's rates, see currentFXRate.
+	switch {
+	case row.FXRate > 0:
+		t.FXRate = row.FXRate
+	case t.Currency == data.BaseCurrency:
+		t.FXRate = 1
+	case time.Since(t.ExecutedAt) > currentFXRateMaxAge:
+		return nil, fmt.Errorf(
+			"%w: fx_rate must be provided for rows executed more than a day ago in %s",
+			errImportRow,
+			t.Currency,
+		)
+	default:
+		rate, err := rates.Rate(t.Currency)
+		if err != nil {
+			return nil, fmt.Errorf("%w: no exchange rate for the currency %q", errImportRow, t.Currency)
+		}
+		t.FXRate = rate
+	}
+	return t, nil
+}
+
+// / Validate an import row once its price is known.
+func validateImportTransaction(t *data.Transaction) error {
+	if t.Price == 0 && (t.Type == data.TransactionBuy || t.Type == data.TransactionSell) {
+		return fmt.Errorf(
+			"%w: no historical price on %s, add a price column",
+			errImportRow,
+			t.ExecutedAt.Format(time.DateOnly),
+		)
+	}
+
+	v := validator.New()
+	if data.ValidateTransaction(v, t); !v.Valid() {
+		fields := make([]string, 0, len(v.Errors))
+		for field, msg := range v.Errors {
+			fields = append(fields, field+" "+msg)
+		}
+		sort.Strings(fields)
+		return fmt.Errorf("%w: %s", errImportRow, strings.Join(fields, ", "))
+	}
+	return nil
+}
+
+// / Set the price of the buys and sells without one to the historical price
+// / at execution, like CreateTransactionHandler does. Prices missing from
+// / the history are backfilled with one provider call per coin over the
+// / span of its rows, cut to the window of the provider. Rows still without
+// / a price keep zero.
+func (h *Handler) importPrices(txs []*data.Transaction) error {
+	type span struct {
+		from, to time.Time
+	}
+
+	missing := map[string]*span{}
+	pending := []*data.Transaction{}
+
+	for _, t := range txs {
+		if t.Price != 0 || (t.Type != data.TransactionBuy && t.Type != data.TransactionSell) {
+			continue
+		}
+
+		price, err := h.models.Price.PriceAt(t.CoinID, t.ExecutedAt)
+		switch {
+		case err == nil:
+			t.Price = price * t.FXRate
+			continue
+		case !errors.Is(err, validator.ErrRecordNotFound):
+			return err
+		}
+
+		pending = append(pending, t)
+		s, ok := missing[t.CoinID]
+		switch {
+		case !ok:
+			missing[t.CoinID] = &span{from: t.ExecutedAt, to: t.ExecutedAt}
+		case t.ExecutedAt.Before(s.from):
+			s.from = t.ExecutedAt
+		case t.ExecutedAt.After(s.to):
+			s.to = t.ExecutedAt
+		}
+	}
+
+	day := data.CandleIntervals["1d"]
+
+	for coinID, s := range missing {
+		from, to, ok := backfillWindow(s.from.Add(-day), s.to.Add(day))
+		if !ok {
+			continue
+		}
+
+		err := h.models.Price.Backfill(h.marketData, coinID, from, to)
+		if err != nil && !errors.Is(err, validator.ErrRecordNotFound) {
+			return err
+		}
+	}
+
+	for _, t := range pending {
+		price, err := h.models.Price.PriceAt(t.CoinID, t.ExecutedAt)
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			continue
+		case err != nil:
+			return err
+		}
+		t.Price = price * t.FXRate
+	}
+	return nil
+}
+
+// / Replay every position the import touches with its stored ledger, the
+// / way Import rebuilds it, and reject the rows that would dispose more than
+// / the portfolio holds. When a stored entry runs short, the latest new
+// / disposal executed before it is rejected.
+// # Parameters
+// - fresh: the rows to import, lines maps them to their line in the file
+// # Return
+// - fresh without the rejected rows
+// - an error for each rejected row
+func (h *Handler) importOversells(
+	portfolioID int64,
+	method string,
+	fresh []*data.Transaction,
+	lines map[*data.Transaction]int,
+) ([]*data.Transaction, []importer.RowError, error) {
+	byCoin := map[string][]*data.Transaction{}
+	coinIDs := []string{}
+	for _, t := range fresh {
+		if _, ok := byCoin[t.CoinID]; !ok {
+			coinIDs = append(coinIDs, t.CoinID)
+		}
+		byCoin[t.CoinID] = append(byCoin[t.CoinID], t)
+	}
+	if len(coinIDs) == 0 {
+		return fresh, nil, nil
+	}
+
+	ledgers, err := h.models.Transaction.LedgersForPortfolio(portfolioID, coinIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rejected := map[*data.Transaction]bool{}
+	rowErrors := []importer.RowError{}
+
+	for _, coinID := range coinIDs {
+		for {
+			rows := byCoin[coinID]
+
+			// Stored entries first at equal times, they keep the lower ids.
+			ledger := make([]*data.Transaction, 0, len(ledgers[coinID])+len(rows))
+			ledger = append(ledger, ledgers[coinID]...)
+			ledger = append(ledger, rows...)
+			sort.SliceStable(ledger, func(i, j int) bool {
+				return ledger[i].ExecutedAt.Before(ledger[j].ExecutedAt)
+			})
+
+			_, err := data.BuildLots(ledger, method)
+			var oversell *data.OversellError
+			if !errors.As(err, &oversell) {
+				if err != nil {
+					return nil, nil, err
+				}
+				break
+			}
+
+			culprit := oversell.Transaction
+			if _, ok := lines[culprit]; !ok {
+				culprit = nil
+				for _, t := range ledger {
+					if t == oversell.Transaction {
+						break
+					}
+					if _, ok := lines[t]; ok && !t.Increases() {
+						culprit = t
+					}
+				}
+			}
+			// The stored ledger is short on its own, Import reports it.
+			if culprit == nil {
+				break
+			}
+
+			rejected[culprit] = true
+			rowErrors = append(rowErrors, importer.RowError{
+				Line:  lines[culprit],
+				Error: validator.ErrInsufficientHoldings.Error(),
+			})
+
+			kept := make([]*data.Transaction, 0, len(rows))
+			for _, t := range rows {
+				if t != culprit {
+					kept = append(kept, t)
+				}
+			}
+			byCoin[coinID] = kept
+		}
+	}
+
+	kept := make([]*data.Transaction, 0, len(fresh))
+	for _, t := range fresh {
+		if !rejected[t] {
+			kept = append(kept, t)
+		}
+	}
+	return kept, rowErrors, nil
+}
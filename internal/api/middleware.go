@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/aalperen0/portfolio-tracker/internal/data"
 	"github.com/aalperen0/portfolio-tracker/internal/validator"
@@ -42,6 +43,11 @@ func (h *Handler) authenticate(next http.Handler) http.Handler {
 
 		token := headerParts[1]
 
+		if data.IsAPIKey(token) {
+			h.authenticateAPIKey(w, r, next, token)
+			return
+		}
+
 		v := validator.New()
 
 		if data.ValidateToken(v, token); !v.Valid() {
@@ -49,11 +55,13 @@ func (h *Handler) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		hash := data.HashToken(token)
+
 		user, err := h.models.User.GetUserByToken(data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, validator.ErrRecordNotFound):
-				h.invalidAuthTokenResponse(w, r)
+				h.rejectAuthToken(w, r, hash)
 			default:
 				h.serverErrorResponse(w, r, err)
 
@@ -61,13 +69,68 @@ func (h *Handler) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		if err := h.models.Token.Touch(hash, time.Now()); err != nil {
+			h.logError(r, err)
+		}
+
 		r = data.ContextSetUser(r, user)
+		r = data.ContextSetTokenHash(r, hash)
 
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (h *Handler) requiredAuthenticatedUser(next http.Handler) http.HandlerFunc {
+// / Reject an unknown or expired access token. Expired tokens get their own
+// / error code, so clients know to use their refresh token.
+func (h *Handler) rejectAuthToken(w http.ResponseWriter, r *http.Request, hash []byte) {
+	expired, err := h.models.Token.Expired(hash, data.ScopeAuthentication)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if expired {
+		h.expiredAuthTokenResponse(w, r)
+		return
+	}
+	h.invalidAuthTokenResponse(w, r)
+}
+
+// / Authenticate a request made with a personal API key. The key is stored
+// / in the context so routes can check its scopes.
+func (h *Handler) authenticateAPIKey(
+	w http.ResponseWriter,
+	r *http.Request,
+	next http.Handler,
+	token string,
+) {
+	key, user, err := h.models.APIKey.GetForKey(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.invalidAuthTokenResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := h.models.APIKey.Touch(key.ID, time.Now()); err != nil {
+		h.logError(r, err)
+	}
+
+	r = data.ContextSetUser(r, user)
+	r = data.ContextSetAPIKey(r, key)
+
+	next.ServeHTTP(w, r)
+}
+
+// / Require an authenticated user. Requests made with an API key also need
+// / the scope of the route, routes without a scope are only open to
+// / password sessions, e.g. managing API keys.
+// # Parameters
+// @ scope (string): scope the route needs, empty for session only routes
+func (h *Handler) requiredAuthenticatedUser(scope string, next http.Handler) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := data.ContextGetUser(r)
 
@@ -75,6 +138,35 @@ func (h *Handler) requiredAuthenticatedUser(next http.Handler) http.HandlerFunc
 			h.authenticationRequiredResponse(w, r)
 			return
 		}
+
+		if key := data.ContextGetAPIKey(r); key != nil {
+			switch {
+			case scope == "":
+				h.sessionRequiredResponse(w, r)
+				return
+			case !key.HasScope(scope):
+				h.missingScopeResponse(w, r, scope)
+				return
+			}
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// / Require a password session of a user whose role grants the permission.
+// / Admin routes are never open to API keys.
+// # Parameters
+// @ permission (string): e.g. admin:read
+func (h *Handler) requirePermission(permission string, next http.Handler) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user := data.ContextGetUser(r)
+
+		if !user.Can(permission) {
+			h.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+
+	return h.requiredAuthenticatedUser(sessionOnly, http.HandlerFunc(fn))
+}
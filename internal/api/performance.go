@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/analytics"
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / GET /v1/users/portfolio/performance?window=&portfolio=&risk_free=&series=&currency=
+// / Time-weighted return, money-weighted return (XIRR), max drawdown,
+// / volatility and Sharpe ratio of the user's holdings. The ledger is valued
+// / every day of the window with the stored daily closes, today with live
+// / prices. Buys and transfers in are deposits, sells and transfers out
+// / withdrawals. Money is converted into the currency at today's rate for
+// / the whole series, returns and ratios don't depend on it.
+// # Parameters
+// @ window (string): 7d, 30d, 90d, 1y (default), ytd or all
+// @ portfolio (int): a single portfolio, defaults to every non-archived one
+// @ risk_free (float): annual risk-free rate of the Sharpe ratio, e.g. 0.04
+// @ series (bool): include the daily values and flows
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) GetPortfolioPerformanceHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Window      string
+		PortfolioID int
+		RiskFree    float64
+		Series      bool
+	}
+
+	user := data.ContextGetUser(r)
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+	input.Window = h.readURLstring(qs, "window", "1y")
+	input.PortfolioID = h.readURLint(qs, "portfolio", 0, v)
+	input.RiskFree = h.readURLfloat(qs, "risk_free", 0, v)
+	input.Series = h.readURLstring(qs, "series", "false") == "true"
+
+	v.Check(
+		validator.PermittedValues(input.Window, analytics.Windows...),
+		"window",
+		"must be one of 7d, 30d, 90d, 1y, ytd, all",
+	)
+	v.Check(input.RiskFree >= 0 && input.RiskFree < 1, "risk_free", "must be between 0 and 1")
+	if !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if input.PortfolioID != 0 {
+		_, err := h.models.Portfolio.Get(int64(input.PortfolioID), user.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, validator.ErrRecordNotFound):
+				h.notFoundResponse(w, r)
+			default:
+				h.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	currency, rate, err := h.readCurrency(r, user)
+	if err != nil {
+		h.currencyErrorResponse(w, r, err)
+		return
+	}
+
+	txs, err := h.models.Transaction.LedgerForUser(user.ID, int64(input.PortfolioID))
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	perf := analytics.Compute(nil, input.RiskFree)
+
+	if len(txs) > 0 {
+		to := time.Now()
+		from := analytics.WindowStart(input.Window, to, txs[0].ExecutedAt)
+		if from.Before(txs[0].ExecutedAt) {
+			from = txs[0].ExecutedAt
+		}
+
+		prices, err := h.performancePrices(txs, from, to)
+		if err != nil {
+			h.serverErrorResponse(w, r, err)
+			return
+		}
+
+		points := analytics.DailySeries(txs, prices, from, to)
+		perf = analytics.Compute(points, input.RiskFree)
+		if input.Series {
+			perf.Series = points
+		}
+	}
+
+	perf.Convert(rate)
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"currency": currency, "performance": perf}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Daily closes and live prices of every coin in the ledger, the live
+// / prices in a single market data call. Coins without stored closes in the
+// / window are backfilled in the background and valued at their last ledger
+// / price until then, as are coins the provider can't price.
+func (h *Handler) performancePrices(
+	txs []*data.Transaction,
+	from, to time.Time,
+) (*analytics.Prices, error) {
+	var coinIDs []string
+	seen := make(map[string]bool)
+	for _, t := range txs {
+		if !seen[t.CoinID] {
+			seen[t.CoinID] = true
+			coinIDs = append(coinIDs, t.CoinID)
+		}
+	}
+
+	from = from.UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour)
+
+	closes, err := h.models.Price.DailyCloses(coinIDs, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, coinID := range coinIDs {
+		if len(closes[coinID]) == 0 {
+			missing = append(missing, coinID)
+		}
+	}
+	if len(missing) > 0 {
+		h.background(func() {
+			for _, coinID := range missing {
+				_, err := h.backfillHistory(context.Background(), coinID, "1d", from, to)
+				if err != nil {
+					h.logger.Err(err).Msgf("failed to backfill price history of %s", coinID)
+				}
+			}
+		})
+	}
+
+	markets, err := h.coinMarkets(data.BaseCurrency, coinIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]float64, len(coinIDs))
+	for _, coinID := range coinIDs {
+		m, ok := markets[coinID]
+		if !ok {
+			h.logger.Warn().Msgf("no current price of %s", coinID)
+			continue
+		}
+		current[coinID] = m.CurrentPrice
+	}
+
+	return &analytics.Prices{Closes: closes, Current: current}, nil
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / POST /v1/portfolios
+// / Create a named portfolio, e.g. "Long term", "Trading" or "Cold wallet".
+// # Parameters
+// @ name (string, required): unique per user
+// # Response: Success (HTTP Status 201):
+
+func (h *Handler) CreatePortfolioHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name string `json:"name"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	// Make sure the default portfolio exists before the first named one
+	_, err = h.models.Portfolio.GetDefault(user.ID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	portfolio := &data.Portfolio{
+		UserID: user.ID,
+		Name:   input.Name,
+	}
+
+	v := validator.New()
+	if data.ValidatePortfolio(v, portfolio); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = h.models.Portfolio.Insert(portfolio)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrDuplicatePortfolio):
+			v.AddError("name", "a portfolio with this name already exists")
+			h.failedValidationResponse(w, r, v.Errors)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/portfolios/%d", portfolio.ID))
+
+	err = h.writeJSON(w, http.StatusCreated, envelope{"portfolio": portfolio}, headers)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / GET /v1/portfolios?include_archived=true
+
+func (h *Handler) GetAllPortfoliosHandler(w http.ResponseWriter, r *http.Request) {
+	user := data.ContextGetUser(r)
+
+	_, err := h.models.Portfolio.GetDefault(user.ID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	includeArchived := h.readURLstring(r.URL.Query(), "include_archived", "false") == "true"
+
+	portfolios, err := h.models.Portfolio.GetAllForUser(user.ID, includeArchived)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"portfolios": portfolios}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / GET /v1/portfolios/:pid
+
+func (h *Handler) GetPortfolioHandler(w http.ResponseWriter, r *http.Request) {
+	user := data.ContextGetUser(r)
+
+	portfolio, err := h.readPortfolio(r, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"portfolio": portfolio}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / PATCH /v1/portfolios/:pid
+// / Rename or (un)archive a portfolio. Holdings of an archived portfolio are
+// / kept but can't be changed and are left out of the aggregated view.
+// # Parameters
+// @ name (string)
+// @ archived (bool)
+
+func (h *Handler) UpdatePortfolioHandler(w http.ResponseWriter, r *http.Request) {
+	user := data.ContextGetUser(r)
+
+	portfolio, err := h.readPortfolio(r, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Name     *string `json:"name"`
+		Archived *bool   `json:"archived"`
+	}
+
+	err = h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		portfolio.Name = *input.Name
+	}
+	if input.Archived != nil {
+		portfolio.Archived = *input.Archived
+	}
+
+	v := validator.New()
+	if data.ValidatePortfolio(v, portfolio); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = h.models.Portfolio.Update(portfolio)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrDuplicatePortfolio):
+			v.AddError("name", "a portfolio with this name already exists")
+			h.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, validator.ErrEditConflict):
+			h.editConflictResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"portfolio": portfolio}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / DELETE /v1/portfolios/:pid
+// / Delete a portfolio with its holdings and transactions. The default
+// / portfolio can't be deleted.
+
+func (h *Handler) DeletePortfolioHandler(w http.ResponseWriter, r *http.Request) {
+	user := data.ContextGetUser(r)
+
+	portfolio, err := h.readPortfolio(r, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if portfolio.IsDefault {
+		v := validator.New()
+		v.AddError("portfolio", "the default portfolio can't be deleted")
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = h.models.Portfolio.Delete(portfolio.ID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = h.writeJSON(
+		w,
+		http.StatusOK,
+		envelope{"portfolio": fmt.Sprintf("%s deleted", portfolio.Name)},
+		nil,
+	)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,200 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / GET /v1/coins/:id/history?interval=&from=&to=&currency=
+// / OHLC price history of the coin. Missing candles of the range are
+// / backfilled from the market data provider, within the window the
+// / provider serves and at most once an hour per coin and interval.
+// # Parameters
+// @ interval (string): 1h or 1d (default)
+// @ from (RFC3339 or YYYY-MM-DD): defaults to 7 days (1h) or a year (1d) before to
+// @ to (RFC3339 or YYYY-MM-DD): defaults to now
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) GetCoinHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	coinID, err := h.readIDParam(r)
+	if err != nil {
+		h.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Interval string
+		From     time.Time
+		To       time.Time
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+	input.Interval = h.readURLstring(qs, "interval", "1d")
+	input.To = h.readURLtime(qs, "to", time.Now(), v)
+
+	from := input.To.AddDate(-1, 0, 0)
+	if input.Interval == "1h" {
+		from = input.To.AddDate(0, 0, -7)
+	}
+	input.From = h.readURLtime(qs, "from", from, v)
+
+	data.ValidateCandleInterval(v, input.Interval)
+	v.Check(input.From.Before(input.To), "from", "must be before to")
+	if input.Interval == "1h" {
+		v.Check(input.To.Sub(input.From) <= 90*24*time.Hour, "from", "hourly history is limited to 90 days")
+	}
+	if !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	currency, rate, err := h.readCurrency(r, data.ContextGetUser(r))
+	if err != nil {
+		h.currencyErrorResponse(w, r, err)
+		return
+	}
+
+	candles, err := h.models.Price.GetForCoin(coinID, input.Interval, input.From, input.To)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if from, to, ok := candleGap(candles, input.Interval, input.From, input.To); ok {
+		filled, err := h.backfillHistory(r.Context(), coinID, input.Interval, from, to)
+		if err != nil {
+			switch {
+			case errors.Is(err, validator.ErrRecordNotFound):
+				h.notFoundResponse(w, r)
+			default:
+				h.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if filled {
+			candles, err = h.models.Price.GetForCoin(coinID, input.Interval, input.From, input.To)
+			if err != nil {
+				h.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	}
+
+	for _, c := range candles {
+		c.Convert(rate)
+	}
+
+	err = h.writeJSON(
+		w,
+		http.StatusOK,
+		envelope{"coin_id": coinID, "currency": currency, "interval": input.Interval, "candles": candles},
+		nil,
+	)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Span from the first to the last closed candle of the range that isn't
+// / stored, ok is false when none is missing. The open candle of the
+// / current interval is left to the price history worker.
+func candleGap(candles []*data.Candle, interval string, from, to time.Time) (time.Time, time.Time, bool) {
+	length := data.CandleIntervals[interval]
+
+	stored := make(map[time.Time]bool, len(candles))
+	for _, c := range candles {
+		stored[c.Bucket.UTC()] = true
+	}
+
+	end := to
+	if now := time.Now(); end.After(now) {
+		end = now
+	}
+
+	var first, last time.Time
+	bucket := from.UTC().Truncate(length)
+	if bucket.Before(from) {
+		bucket = bucket.Add(length)
+	}
+	for ; !bucket.Add(length).After(end); bucket = bucket.Add(length) {
+		if stored[bucket] {
+			continue
+		}
+		if first.IsZero() {
+			first = bucket
+		}
+		last = bucket.Add(length)
+	}
+	return first, last, !first.IsZero()
+}
+
+// / Backfill the candles between from and to, cut to the window of the
+// / provider and widened to whole days so no daily candle is rebuilt from
+// / part of its day. A coin and interval is backfilled at most once an
+// / hour, so ranges the provider can't fill, e.g. before the coin was
+// / listed, don't reach the provider on every request.
+// # Return
+// - whether candles were backfilled
+func (h *Handler) backfillHistory(ctx context.Context, coinID, interval string, from, to time.Time) (bool, error) {
+	from, to, ok := backfillWindow(from, to)
+	if !ok {
+		return false, nil
+	}
+
+	key := "history_backfill:" + coinID + ":" + interval
+	allowed, err := h.models.Cache.Allow(ctx, key, 1, time.Hour)
+	if err != nil || !allowed {
+		return false, err
+	}
+
+	return true, h.models.Price.Backfill(h.marketData, coinID, from, to)
+}
+
+// / Widen the range to whole UTC days, so no daily candle is rebuilt from
+// / part of its day, and cut it to the window of the provider. ok is false
+// / when nothing of it is left.
+func backfillWindow(from, to time.Time) (time.Time, time.Time, bool) {
+	day := data.CandleIntervals["1d"]
+	now := time.Now()
+
+	from = from.UTC().Truncate(day)
+	if oldest := now.Add(-data.PriceHistoryLimit).UTC().Truncate(day).Add(day); from.Before(oldest) {
+		from = oldest
+	}
+	if end := to.UTC().Truncate(day); end.Before(to) {
+		to = end.Add(day)
+	}
+	if to.After(now) {
+		to = now
+	}
+	return from, to, from.Before(to)
+}
+
+// / historicalPrice returns the USD price of the coin at a past time from the
+// / price history, backfilling the whole UTC days around it when nothing is
+// / stored.
+// / Returns ErrRecordNotFound when neither the history nor the provider has it.
+func (h *Handler) historicalPrice(coinID string, at time.Time) (float64, error) {
+	price, err := h.models.Price.PriceAt(coinID, at)
+	if !errors.Is(err, validator.ErrRecordNotFound) {
+		return price, err
+	}
+
+	day := data.CandleIntervals["1d"]
+	from, to, ok := backfillWindow(at.Add(-day), at.Add(day))
+	if !ok {
+		return 0, validator.ErrRecordNotFound
+	}
+	if err := h.models.Price.Backfill(h.marketData, coinID, from, to); err != nil {
+		return 0, err
+	}
+	return h.models.Price.PriceAt(coinID, at)
+}
@@ -0,0 +1,275 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/aalperen0/portfolio-tracker/internal/analytics"
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / GET /v1/users/portfolio/targets
+// / GET /v1/portfolios/:pid/targets
+// / Target allocation of the portfolio, largest weight first.
+
+func (h *Handler) GetAllocationTargetsHandler(w http.ResponseWriter, r *http.Request) {
+	user := data.ContextGetUser(r)
+
+	portfolio, err := h.readPortfolio(r, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	targets, err := h.models.Target.GetForPortfolio(portfolio.ID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"portfolio_id": portfolio.ID, "targets": targets}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / PUT /v1/users/portfolio/targets
+// / PUT /v1/portfolios/:pid/targets
+// / Replace the target allocation of the portfolio, e.g. 50% bitcoin, 30%
+// / ethereum and 20% tether. An empty list clears it.
+// # Parameters
+// @ targets ([]object, required): {"coin_id": "bitcoin", "weight": 50},
+// @   weights in percent adding up to 100
+
+func (h *Handler) UpdateAllocationTargetsHandler(w http.ResponseWriter, r *http.Request) {
+	user := data.ContextGetUser(r)
+
+	portfolio, err := h.readPortfolio(r, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Targets []*data.AllocationTarget `json:"targets"`
+	}
+
+	err = h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Targets != nil, "targets", "must be provided")
+
+	coinIDs := make([]string, 0, len(input.Targets))
+	for _, t := range input.Targets {
+		if t == nil {
+			v.AddError("targets", "must not contain null entries")
+			break
+		}
+		t.CoinID = strings.ToLower(strings.TrimSpace(t.CoinID))
+		coinIDs = append(coinIDs, t.CoinID)
+	}
+
+	if v.Valid() {
+		data.ValidateAllocationTargets(v, input.Targets)
+	}
+	if !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !h.checkMarketCoins(w, r, "targets", coinIDs) {
+		return
+	}
+
+	err = h.models.Target.Replace(portfolio.ID, input.Targets)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	targets, err := h.models.Target.GetForPortfolio(portfolio.ID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"portfolio_id": portfolio.ID, "targets": targets}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / GET /v1/users/portfolio/rebalance?portfolio=&tolerance=&min_trade=&cash=&currency=
+// / Compare the current weights of the holdings with the target allocation
+// / and suggest the trades that restore it. Holdings are valued at current
+// / prices fetched in one market data call. Within the tolerance band only
+// / new cash is invested, nothing is sold. Held coins without a price are
+// / left out of the plan and listed as unpriced, targets without a price
+// / fail the request.
+// # Parameters
+// @ portfolio (int): defaults to the default portfolio
+// @ tolerance (float): drift in percentage points allowed before
+// @   rebalancing, defaults to 5
+// @ min_trade (float): smallest trade worth suggesting, in the currency
+// @ cash (float): new cash to invest, in the currency
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) GetRebalanceHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		PortfolioID int
+		Tolerance   float64
+		MinTrade    float64
+		Cash        float64
+	}
+
+	user := data.ContextGetUser(r)
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+	input.PortfolioID = h.readURLint(qs, "portfolio", 0, v)
+	input.Tolerance = h.readURLfloat(qs, "tolerance", 5, v)
+	input.MinTrade = h.readURLfloat(qs, "min_trade", 0, v)
+	input.Cash = h.readURLfloat(qs, "cash", 0, v)
+
+	v.Check(input.Tolerance >= 0 && input.Tolerance <= 100, "tolerance", "must be between 0 and 100")
+	v.Check(input.MinTrade >= 0, "min_trade", "must not be negative")
+	v.Check(input.Cash >= 0, "cash", "must not be negative")
+	if !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var (
+		portfolio *data.Portfolio
+		err       error
+	)
+	if input.PortfolioID == 0 {
+		portfolio, err = h.models.Portfolio.GetDefault(user.ID)
+	} else {
+		portfolio, err = h.models.Portfolio.Get(int64(input.PortfolioID), user.ID)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	currency, rate, err := h.readCurrency(r, user)
+	if err != nil {
+		h.currencyErrorResponse(w, r, err)
+		return
+	}
+
+	targets, err := h.models.Target.GetForPortfolio(portfolio.ID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+	if len(targets) == 0 {
+		v.AddError("targets", "the portfolio has no target allocation, set one first")
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	weights := make(map[string]float64, len(targets))
+	for _, t := range targets {
+		weights[t.CoinID] = t.Weight
+	}
+
+	var holdings []analytics.Holding
+	held := make(map[string]bool)
+	err = h.models.Coin.Each(r.Context(), user.ID, portfolio.ID, func(coin *data.Coin) error {
+		if coin.Amount > 0 || weights[coin.CoinID] > 0 {
+			holdings = append(holdings, analytics.Holding{CoinID: coin.CoinID, Symbol: coin.Symbol, Amount: coin.Amount})
+			held[coin.CoinID] = true
+		}
+		return nil
+	})
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+	for _, t := range targets {
+		if !held[t.CoinID] {
+			holdings = append(holdings, analytics.Holding{CoinID: t.CoinID})
+		}
+	}
+
+	coinIDs := make([]string, 0, len(holdings))
+	for _, holding := range holdings {
+		coinIDs = append(coinIDs, holding.CoinID)
+	}
+
+	markets, err := h.coinMarkets(data.BaseCurrency, coinIDs)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Coins without a price can't be weighed. Untargeted ones are left out
+	// of the plan, a target that can't be priced can't be planned for.
+	unpriced := []string{}
+	unpricedTargets := []string{}
+	priced := make([]analytics.Holding, 0, len(holdings))
+	for _, holding := range holdings {
+		m, ok := markets[holding.CoinID]
+		if !ok {
+			if weights[holding.CoinID] > 0 {
+				unpricedTargets = append(unpricedTargets, holding.CoinID)
+			}
+			unpriced = append(unpriced, holding.CoinID)
+			continue
+		}
+		holding.Price = m.CurrentPrice
+		if holding.Symbol == "" {
+			holding.Symbol = m.Symbol
+		}
+		priced = append(priced, holding)
+	}
+	if len(unpricedTargets) > 0 {
+		v.AddError("targets", "no current price of "+strings.Join(unpricedTargets, ", ")+", can't plan without it")
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	holdings = priced
+
+	plan := analytics.PlanRebalance(holdings, weights, analytics.RebalanceOptions{
+		Tolerance: input.Tolerance,
+		MinTrade:  input.MinTrade / rate,
+		Cash:      input.Cash / rate,
+	})
+	plan.Convert(rate)
+
+	env := envelope{
+		"portfolio_id": portfolio.ID,
+		"currency":     currency,
+		"rebalance":    plan,
+		"unpriced":     unpriced,
+	}
+
+	err = h.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
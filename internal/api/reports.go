@@ -0,0 +1,199 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/reporting"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / GET /v1/users/reports/tax?year=&portfolio=&currency=&format=json|csv
+// / Capital gains of a fiscal year: every disposal with its acquisition
+// / date, proceeds, cost basis, gain and short- or long-term classification,
+// / matched with the cost-basis method of the user. Entries recorded without
+// / a price are valued at the historical market price and flagged estimated,
+// / except transfers in from another portfolio of the user, which keep the
+// / basis and acquisition date of the lots sent.
+// / Proceeds and cost basis are converted at the exchange rate of their own
+// / day when the ledger has one, else at today's rate and flagged
+// / fx_estimated.
+// # Parameters
+// @ year (int): calendar year the fiscal year starts in, defaults to the
+// @   current one
+// @ portfolio (int): a single portfolio, defaults to every portfolio,
+// @   archived ones included
+// @ year_start (string): first day of the fiscal year as MM-DD, defaults
+// @   to the configured one
+// @ long_term_days (int): holding period of long-term gains in days,
+// @   defaults to the configured one
+// @ format (string): json (default) or csv with a row per disposal
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) GetTaxReportHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Year         int
+		PortfolioID  int
+		YearStart    string
+		LongTermDays int
+		Format       string
+	}
+
+	user := data.ContextGetUser(r)
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+	input.Year = h.readURLint(qs, "year", time.Now().UTC().Year(), v)
+	input.PortfolioID = h.readURLint(qs, "portfolio", 0, v)
+	input.YearStart = h.readURLstring(qs, "year_start", h.config.Tax.YearStart)
+	input.LongTermDays = h.readURLint(qs, "long_term_days", h.config.Tax.LongTermDays, v)
+	input.Format = h.readURLstring(qs, "format", tableJSON)
+
+	rules := reporting.TaxRules{LongTermDays: input.LongTermDays}
+
+	var err error
+	rules.YearStartMonth, rules.YearStartDay, err = reporting.ParseYearStart(input.YearStart)
+	if err != nil {
+		v.AddError("year_start", "must be a day of the year as MM-DD")
+	}
+
+	v.Check(input.Year >= 2009 && input.Year <= time.Now().UTC().Year(), "year", "must be between 2009 and this year")
+	v.Check(input.LongTermDays >= 0 && input.LongTermDays <= 3650, "long_term_days", "must be between 0 and 3650")
+	v.Check(validator.PermittedValues(input.Format, tableJSON, tableCSV), "format", "must be one of json, csv")
+	if !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if input.PortfolioID != 0 {
+		_, err := h.models.Portfolio.Get(int64(input.PortfolioID), user.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, validator.ErrRecordNotFound):
+				h.notFoundResponse(w, r)
+			default:
+				h.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	currency, rate, err := h.readCurrency(r, user)
+	if err != nil {
+		h.currencyErrorResponse(w, r, err)
+		return
+	}
+
+	// The whole ledger even for a single portfolio, so transfers from the
+	// other portfolios carry their basis.
+	txs, err := h.models.Transaction.AllForUser(user.ID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	_, to := rules.FiscalYear(input.Year)
+	err = h.backfillUnpriced(r.Context(), txs, to)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	report, err := reporting.BuildTaxReport(
+		txs,
+		int64(input.PortfolioID),
+		user.CostBasisMethod,
+		rules,
+		input.Year,
+		h.models.Price.PriceAt,
+	)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+	report.Convert(currency, rate)
+
+	if input.Format == tableCSV {
+		columns := []string{
+			"transaction_id", "lot_transaction_id", "portfolio_id", "coin_id", "symbol", "type", "quantity",
+			"acquired_at", "disposed_at", "holding_days", "term", "proceeds", "cost_basis", "gain", "currency",
+			"estimated", "fx_estimated",
+		}
+		name := "tax-report-" + strconv.Itoa(input.Year)
+
+		h.streamTable(w, r, tableCSV, name, columns, func(emit func([]any) error) error {
+			for _, d := range report.Disposals {
+				err := emit([]any{
+					d.TransactionID, d.LotTransactionID, d.PortfolioID, d.CoinID, d.Symbol, d.Type, d.Quantity,
+					d.AcquiredAt, d.DisposedAt, int64(d.HoldingDays), d.Term, d.Proceeds, d.CostBasis, d.Gain,
+					report.Currency, strconv.FormatBool(d.Estimated), strconv.FormatBool(d.FXEstimated),
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"report": report}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Backfill the price history the tax report values entries recorded
+// / without a price from. Each coin missing a price is backfilled once over
+// / the span of its entries, and at most once an hour, like the price
+// / history endpoint does.
+// # Parameters
+// - to: entries from this time on are left out of the report
+func (h *Handler) backfillUnpriced(ctx context.Context, txs []*data.Transaction, to time.Time) error {
+	type span struct {
+		from, to time.Time
+	}
+
+	missing := map[string]*span{}
+	var coinIDs []string
+
+	for _, t := range txs {
+		if t.Price > 0 || !t.ExecutedAt.Before(to) || !(t.Increases() || t.Type == data.TransactionSell) {
+			continue
+		}
+
+		_, err := h.models.Price.PriceAt(t.CoinID, t.ExecutedAt)
+		switch {
+		case err == nil:
+			continue
+		case !errors.Is(err, validator.ErrRecordNotFound):
+			return err
+		}
+
+		s, ok := missing[t.CoinID]
+		switch {
+		case !ok:
+			missing[t.CoinID] = &span{from: t.ExecutedAt, to: t.ExecutedAt}
+			coinIDs = append(coinIDs, t.CoinID)
+		case t.ExecutedAt.Before(s.from):
+			s.from = t.ExecutedAt
+		case t.ExecutedAt.After(s.to):
+			s.to = t.ExecutedAt
+		}
+	}
+
+	day := data.CandleIntervals["1d"]
+	for _, coinID := range coinIDs {
+		s := missing[coinID]
+		_, err := h.backfillHistory(ctx, coinID, "1d", s.from.Add(-day), s.to.Add(day))
+		if err != nil && !errors.Is(err, validator.ErrRecordNotFound) {
+			return err
+		}
+	}
+	return nil
+}
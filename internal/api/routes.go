@@ -4,8 +4,13 @@ import (
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
 )
 
+// / Scope of the routes API keys can't access, e.g. managing API keys.
+const sessionOnly = ""
+
 // / Register the relevant methods, URL patterns and handler functions for
 // / endpoints using the HandlerFunc() method.
 // / # Return
@@ -20,25 +25,112 @@ func (h *Handler) Routes() http.Handler {
 	router.HandlerFunc(http.MethodPost, "/v1/users", h.registerUserHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/users/auth", h.authenticationHandler)
 	router.HandlerFunc(http.MethodPatch, "/v1/users/activate", h.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", h.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/email", h.confirmEmailChangeHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/exports/download", h.downloadExportHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", h.createPasswordResetTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", h.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", h.refreshTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/2fa", h.twoFactorLoginHandler)
 	router.HandlerFunc(http.MethodGet, "/v1/coins", h.GetCoinsFromMarketHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/search/coins", h.SearchCoinsHandler)
 
 	protectedRoutes := []struct {
 		method  string
 		path    string
+		scope   string
 		handler http.HandlerFunc
 	}{
-		{http.MethodPost, "/v1/users/coins", h.AddCoinsHandler},
-		{http.MethodGet, "/v1/users/coins/:id", h.GetCoinFromPortfolioHandler},
-		{http.MethodDelete, "/v1/users/coins/:id", h.DeleteCoinFromPortfolioHandler},
-		{http.MethodPut, "/v1/users/coins/:id", h.UpdateCoinsHandler},
-		{http.MethodGet, "/v1/users/coins", h.GetAllCoinsFromPortfolioHandler},
+		{http.MethodPost, "/v1/users/coins", data.ScopePortfolioWrite, h.AddCoinsHandler},
+		{http.MethodGet, "/v1/users/coins/:id", data.ScopePortfolioRead, h.getCoinOrExportHandler},
+		{http.MethodDelete, "/v1/users/coins/:id", data.ScopePortfolioWrite, h.DeleteCoinFromPortfolioHandler},
+		{http.MethodPut, "/v1/users/coins/:id", data.ScopePortfolioWrite, h.UpdateCoinsHandler},
+		{http.MethodGet, "/v1/users/coins", data.ScopePortfolioRead, h.GetAllCoinsFromPortfolioHandler},
+		{http.MethodGet, "/v1/users/holdings", data.ScopePortfolioRead, h.GetAggregatedHoldingsHandler},
+		{http.MethodGet, "/v1/coins/:id/history", data.ScopePortfolioRead, h.GetCoinHistoryHandler},
+		{http.MethodGet, "/v1/users/portfolio/history", data.ScopePortfolioRead, h.GetPortfolioHistoryHandler},
+		{http.MethodGet, "/v1/users/portfolio/performance", data.ScopePortfolioRead, h.GetPortfolioPerformanceHandler},
+		{http.MethodGet, "/v1/users/reports/tax", data.ScopePortfolioRead, h.GetTaxReportHandler},
+		{http.MethodGet, "/v1/users/portfolio/rebalance", data.ScopePortfolioRead, h.GetRebalanceHandler},
+		{http.MethodGet, "/v1/users/portfolio/targets", data.ScopePortfolioRead, h.GetAllocationTargetsHandler},
+		{http.MethodPut, "/v1/users/portfolio/targets", data.ScopePortfolioWrite, h.UpdateAllocationTargetsHandler},
+		{http.MethodPost, "/v1/portfolios", data.ScopePortfolioWrite, h.CreatePortfolioHandler},
+		{http.MethodGet, "/v1/portfolios", data.ScopePortfolioRead, h.GetAllPortfoliosHandler},
+		{http.MethodGet, "/v1/portfolios/:pid", data.ScopePortfolioRead, h.GetPortfolioHandler},
+		{http.MethodPatch, "/v1/portfolios/:pid", data.ScopePortfolioWrite, h.UpdatePortfolioHandler},
+		{http.MethodDelete, "/v1/portfolios/:pid", data.ScopePortfolioWrite, h.DeletePortfolioHandler},
+		{http.MethodPost, "/v1/portfolios/:pid/coins", data.ScopePortfolioWrite, h.AddCoinsHandler},
+		{http.MethodGet, "/v1/portfolios/:pid/coins", data.ScopePortfolioRead, h.GetAllCoinsFromPortfolioHandler},
+		{http.MethodGet, "/v1/portfolios/:pid/coins/:id", data.ScopePortfolioRead, h.getCoinOrExportHandler},
+		{http.MethodPut, "/v1/portfolios/:pid/coins/:id", data.ScopePortfolioWrite, h.UpdateCoinsHandler},
+		{http.MethodDelete, "/v1/portfolios/:pid/coins/:id", data.ScopePortfolioWrite, h.DeleteCoinFromPortfolioHandler},
+		{http.MethodGet, "/v1/portfolios/:pid/targets", data.ScopePortfolioRead, h.GetAllocationTargetsHandler},
+		{http.MethodPut, "/v1/portfolios/:pid/targets", data.ScopePortfolioWrite, h.UpdateAllocationTargetsHandler},
+		{http.MethodPut, "/v1/users/cost-basis", data.ScopePortfolioWrite, h.updateCostBasisMethodHandler},
+		{http.MethodPut, "/v1/users/currency", sessionOnly, h.updateReportingCurrencyHandler},
+		{http.MethodGet, "/v1/users/me", sessionOnly, h.getCurrentUserHandler},
+		{http.MethodPatch, "/v1/users/me", sessionOnly, h.updateCurrentUserHandler},
+		{http.MethodDelete, "/v1/users/me", sessionOnly, h.deleteCurrentUserHandler},
+		{http.MethodPost, "/v1/users/me/export", sessionOnly, h.createExportHandler},
+		{http.MethodGet, "/v1/users/me/exports", sessionOnly, h.listExportsHandler},
+		{http.MethodPost, "/v1/users/transactions", data.ScopePortfolioWrite, h.CreateTransactionHandler},
+		{http.MethodGet, "/v1/users/transactions", data.ScopePortfolioRead, h.GetAllTransactionsHandler},
+		{http.MethodGet, "/v1/users/transactions/:id", data.ScopePortfolioRead, h.getTransactionOrExportHandler},
+		{http.MethodPatch, "/v1/users/transactions/:id", data.ScopePortfolioWrite, h.UpdateTransactionHandler},
+		{http.MethodDelete, "/v1/users/transactions/:id", data.ScopePortfolioWrite, h.DeleteTransactionHandler},
+		{http.MethodPost, "/v1/users/imports", data.ScopePortfolioWrite, h.ImportTransactionsHandler},
+		{http.MethodDelete, "/v1/tokens/authentication", sessionOnly, h.deleteAuthenticationTokenHandler},
+		{http.MethodGet, "/v1/users/sessions", sessionOnly, h.listSessionsHandler},
+		{http.MethodDelete, "/v1/users/sessions/:id", sessionOnly, h.deleteSessionHandler},
+		{http.MethodPost, "/v1/users/watchlists", data.ScopeWatchlistsWrite, h.CreateWatchlistHandler},
+		{http.MethodGet, "/v1/users/watchlists", data.ScopeWatchlistsRead, h.GetAllWatchlistsHandler},
+		{http.MethodGet, "/v1/users/watchlists/:id", data.ScopeWatchlistsRead, h.GetWatchlistHandler},
+		{http.MethodGet, "/v1/users/watchlists/:id/markets", data.ScopeWatchlistsRead, h.GetWatchlistMarketsHandler},
+		{http.MethodPatch, "/v1/users/watchlists/:id", data.ScopeWatchlistsWrite, h.UpdateWatchlistHandler},
+		{http.MethodDelete, "/v1/users/watchlists/:id", data.ScopeWatchlistsWrite, h.DeleteWatchlistHandler},
+		{http.MethodPost, "/v1/users/alerts", data.ScopeAlertsWrite, h.CreateAlertHandler},
+		{http.MethodGet, "/v1/users/alerts", data.ScopeAlertsRead, h.GetAllAlertsHandler},
+		{http.MethodGet, "/v1/users/alerts/:id", data.ScopeAlertsRead, h.GetAlertHandler},
+		{http.MethodPatch, "/v1/users/alerts/:id", data.ScopeAlertsWrite, h.UpdateAlertHandler},
+		{http.MethodDelete, "/v1/users/alerts/:id", data.ScopeAlertsWrite, h.DeleteAlertHandler},
+		{http.MethodGet, "/v1/users/2fa", sessionOnly, h.getTwoFactorHandler},
+		{http.MethodPost, "/v1/users/2fa/enroll", sessionOnly, h.enrollTwoFactorHandler},
+		{http.MethodPost, "/v1/users/2fa/verify", sessionOnly, h.verifyTwoFactorHandler},
+		{http.MethodDelete, "/v1/users/2fa", sessionOnly, h.disableTwoFactorHandler},
+		{http.MethodPost, "/v1/users/api-keys", sessionOnly, h.createAPIKeyHandler},
+		{http.MethodGet, "/v1/users/api-keys", sessionOnly, h.listAPIKeysHandler},
+		{http.MethodDelete, "/v1/users/api-keys/:id", sessionOnly, h.deleteAPIKeyHandler},
 	}
 
 	for _, route := range protectedRoutes {
 		router.HandlerFunc(
 			route.method,
 			route.path,
-			h.requiredAuthenticatedUser(http.HandlerFunc(route.handler)),
+			h.requiredAuthenticatedUser(route.scope, http.HandlerFunc(route.handler)),
+		)
+	}
+
+	adminRoutes := []struct {
+		method     string
+		path       string
+		permission string
+		handler    http.HandlerFunc
+	}{
+		{http.MethodGet, "/v1/admin/users", data.PermissionAdminRead, h.AdminListUsersHandler},
+		{http.MethodGet, "/v1/admin/users/:id", data.PermissionAdminRead, h.AdminGetUserHandler},
+		{http.MethodPut, "/v1/admin/users/:id/role", data.PermissionAdminWrite, h.AdminUpdateRoleHandler},
+		{http.MethodPost, "/v1/admin/users/:id/deactivate", data.PermissionAdminWrite, h.AdminDeactivateUserHandler},
+		{http.MethodPost, "/v1/admin/users/:id/reactivate", data.PermissionAdminWrite, h.AdminReactivateUserHandler},
+		{http.MethodPost, "/v1/admin/users/:id/logout", data.PermissionAdminWrite, h.AdminLogoutUserHandler},
+		{http.MethodGet, "/v1/admin/workers", data.PermissionAdminRead, h.AdminWorkersHandler},
+		{http.MethodGet, "/v1/admin/audit", data.PermissionAdminRead, h.AdminAuditLogHandler},
+	}
+
+	for _, route := range adminRoutes {
+		router.HandlerFunc(
+			route.method,
+			route.path,
+			h.requirePermission(route.permission, http.HandlerFunc(route.handler)),
 		)
 	}
 
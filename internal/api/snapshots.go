@@ -0,0 +1,65 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / GET /v1/users/portfolio/history?from=&to=&interval=&portfolio=&coin=&currency=
+// / Value history of the user for equity curves, recorded by the snapshot
+// / worker and downsampled to the last snapshot of every interval.
+// # Parameters
+// @ from (RFC3339 or YYYY-MM-DD): defaults to 30 days before to
+// @ to (RFC3339 or YYYY-MM-DD): defaults to now
+// @ interval (string): 1h, 1d (default) or 1w
+// @ portfolio (int): only the holdings of the portfolio
+// @ coin (string): only the holdings of the coin, adds amount and price
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) GetPortfolioHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	var input data.SnapshotFilters
+
+	user := data.ContextGetUser(r)
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+	input.To = h.readURLtime(qs, "to", time.Now(), v)
+	input.From = h.readURLtime(qs, "from", input.To.AddDate(0, 0, -30), v)
+	input.Interval = h.readURLstring(qs, "interval", "1d")
+	input.PortfolioID = int64(h.readURLint(qs, "portfolio", 0, v))
+	input.CoinID = h.readURLstring(qs, "coin", "")
+
+	if data.ValidateSnapshotFilters(v, input); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	currency, rate, err := h.readCurrency(r, user)
+	if err != nil {
+		h.currencyErrorResponse(w, r, err)
+		return
+	}
+
+	history, err := h.models.Snapshot.GetHistory(user.ID, input)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+	for _, s := range history {
+		s.Convert(rate)
+	}
+
+	err = h.writeJSON(
+		w,
+		http.StatusOK,
+		envelope{"currency": currency, "interval": input.Interval, "history": history},
+		nil,
+	)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
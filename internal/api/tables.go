@@ -0,0 +1,364 @@
+package api
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"hash/crc32"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/csvutil"
+)
+
+// / Formats of the table downloads and their media types.
+const (
+	tableCSV  = "csv"
+	tableJSON = "json"
+	tableODS  = "ods"
+)
+
+var tableMediaTypes = map[string]string{
+	tableCSV:  "text/csv",
+	tableJSON: "application/json",
+	tableODS:  "application/vnd.oasis.opendocument.spreadsheet",
+}
+
+// / Rows are flushed to the client in batches of this size.
+const tableFlushRows = 200
+
+var errNotAcceptable = errors.New("none of the accepted media types can be produced")
+
+// / Pick the format of a table download. The format query parameter wins,
+// / otherwise the first media type of the Accept header that can be
+// / produced. No preference means CSV.
+// # Return
+// - errNotAcceptable if the Accept header only names other media types
+func readTableFormat(r *http.Request) (string, error) {
+	if format := strings.ToLower(r.URL.Query().Get("format")); format != "" {
+		if _, ok := tableMediaTypes[format]; !ok {
+			return "", errors.New("format must be one of csv, json, ods")
+		}
+		return format, nil
+	}
+
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return tableCSV, nil
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+
+		switch mediaType {
+		case "*/*", "text/*", tableMediaTypes[tableCSV]:
+			return tableCSV, nil
+		case "application/*", tableMediaTypes[tableJSON]:
+			return tableJSON, nil
+		case tableMediaTypes[tableODS]:
+			return tableODS, nil
+		}
+	}
+	return "", errNotAcceptable
+}
+
+// / Respond to an error of readTableFormat.
+func (h *Handler) tableFormatErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errNotAcceptable):
+		h.notAcceptableResponse(w, r, tableMediaTypes[tableCSV], tableMediaTypes[tableJSON], tableMediaTypes[tableODS])
+	default:
+		h.failedValidationResponse(w, r, map[string]string{"format": err.Error()})
+	}
+}
+
+// / Writes a table row by row in one of the download formats. Cells are
+// / strings, float64, int64, time.Time or nil for an empty cell.
+type tableWriter interface {
+	writeRow(cells []any) error
+	close() error
+}
+
+// / Stream a table to the client. The headers are sent before the first
+// / row, so an error of rows is only logged and cuts the download short.
+// # Parameters
+// - name: file name of the download without extension
+// - rows: calls emit with each row in order
+func (h *Handler) streamTable(
+	w http.ResponseWriter,
+	r *http.Request,
+	format string,
+	name string,
+	columns []string,
+	rows func(emit func(cells []any) error) error,
+) {
+	w.Header().Set("Content-Type", tableMediaTypes[format])
+	w.Header().Set(
+		"Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}),
+	)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	buf := bufio.NewWriter(w)
+
+	var tw tableWriter
+	switch format {
+	case tableJSON:
+		tw = newJSONTable(buf, columns)
+	case tableODS:
+		tw = newODSTable(buf, name, columns)
+	default:
+		tw = newCSVTable(buf, columns)
+	}
+
+	count := 0
+	err := rows(func(cells []any) error {
+		if err := tw.writeRow(cells); err != nil {
+			return err
+		}
+
+		count++
+		if count%tableFlushRows == 0 {
+			if err := buf.Flush(); err != nil {
+				return err
+			}
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = tw.close()
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		h.logError(r, err)
+	}
+}
+
+type csvTable struct {
+	cw *csv.Writer
+}
+
+func newCSVTable(w io.Writer, columns []string) *csvTable {
+	t := &csvTable{cw: csv.NewWriter(w)}
+	t.cw.Write(columns)
+	return t
+}
+
+func (t *csvTable) writeRow(cells []any) error {
+	record := make([]string, len(cells))
+	for i, cell := range cells {
+		if s, ok := cell.(string); ok {
+			record[i] = csvutil.EscapeFormula(s)
+			continue
+		}
+		record[i] = formatCell(cell)
+	}
+	return t.cw.Write(record)
+}
+
+func (t *csvTable) close() error {
+	t.cw.Flush()
+	return t.cw.Error()
+}
+
+// / A JSON array with an object per row, keyed by column.
+type jsonTable struct {
+	w       io.Writer
+	columns []string
+	rows    int
+}
+
+func newJSONTable(w io.Writer, columns []string) *jsonTable {
+	return &jsonTable{w: w, columns: columns}
+}
+
+func (t *jsonTable) writeRow(cells []any) error {
+	row := make(map[string]any, len(cells))
+	for i, cell := range cells {
+		if tm, ok := cell.(time.Time); ok {
+			cell = tm.UTC().Format(time.RFC3339)
+		}
+		row[t.columns[i]] = cell
+	}
+
+	js, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+
+	sep := ",\n"
+	if t.rows == 0 {
+		sep = "[\n"
+	}
+	t.rows++
+
+	if _, err := io.WriteString(t.w, sep); err != nil {
+		return err
+	}
+	_, err = t.w.Write(js)
+	return err
+}
+
+func (t *jsonTable) close() error {
+	end := "\n]\n"
+	if t.rows == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(t.w, end)
+	return err
+}
+
+// / An OpenDocument spreadsheet with a single sheet. The archive is written
+// / as it goes: the mimetype entry comes first and uncompressed as the
+// / format requires, content.xml is deflated row by row.
+type odsTable struct {
+	zw      *zip.Writer
+	content io.Writer
+	err     error
+}
+
+const odsMimetype = "application/vnd.oasis.opendocument.spreadsheet"
+
+const odsManifest = xml.Header + `<manifest:manifest xmlns:manifest="urn:oasis:names:tc:opendocument:xmlns:manifest:1.0" manifest:version="1.2">
+ <manifest:file-entry manifest:full-path="/" manifest:media-type="` + odsMimetype + `"/>
+ <manifest:file-entry manifest:full-path="content.xml" manifest:media-type="text/xml"/>
+</manifest:manifest>
+`
+
+const odsContentStart = xml.Header + `<office:document-content` +
+	` xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0"` +
+	` xmlns:table="urn:oasis:names:tc:opendocument:xmlns:table:1.0"` +
+	` xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0"` +
+	` office:version="1.2"><office:body><office:spreadsheet>`
+
+const odsContentEnd = `</table:table></office:spreadsheet></office:body></office:document-content>`
+
+func newODSTable(w io.Writer, name string, columns []string) *odsTable {
+	t := &odsTable{zw: zip.NewWriter(w)}
+	t.err = t.start(name, columns)
+	return t
+}
+
+// / Write the entries before content.xml and open it with the header row.
+func (t *odsTable) start(name string, columns []string) error {
+	mimetype, err := t.zw.CreateRaw(&zip.FileHeader{
+		Name:               "mimetype",
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE([]byte(odsMimetype)),
+		CompressedSize64:   uint64(len(odsMimetype)),
+		UncompressedSize64: uint64(len(odsMimetype)),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(mimetype, odsMimetype); err != nil {
+		return err
+	}
+
+	manifest, err := t.zw.Create("META-INF/manifest.xml")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(manifest, odsManifest); err != nil {
+		return err
+	}
+
+	t.content, err = t.zw.Create("content.xml")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(t.content, odsContentStart+`<table:table table:name="`+xmlEscape(name)+`">`)
+	if err != nil {
+		return err
+	}
+
+	header := make([]any, len(columns))
+	for i, column := range columns {
+		header[i] = column
+	}
+	return t.writeRow(header)
+}
+
+func (t *odsTable) writeRow(cells []any) error {
+	if t.err != nil {
+		return t.err
+	}
+
+	var b strings.Builder
+	b.WriteString("<table:table-row>")
+	for _, cell := range cells {
+		switch v := cell.(type) {
+		case nil:
+			b.WriteString("<table:table-cell/>")
+		case float64:
+			s := formatCell(v)
+			b.WriteString(`<table:table-cell office:value-type="float" office:value="` + s + `"><text:p>` + s +
+				`</text:p></table:table-cell>`)
+		case int64:
+			s := formatCell(v)
+			b.WriteString(`<table:table-cell office:value-type="float" office:value="` + s + `"><text:p>` + s +
+				`</text:p></table:table-cell>`)
+		case time.Time:
+			s := v.UTC().Format("2006-01-02T15:04:05")
+			b.WriteString(`<table:table-cell office:value-type="date" office:date-value="` + s + `"><text:p>` + s +
+				`</text:p></table:table-cell>`)
+		default:
+			b.WriteString(`<table:table-cell office:value-type="string"><text:p>` + xmlEscape(formatCell(v)) +
+				`</text:p></table:table-cell>`)
+		}
+	}
+	b.WriteString("</table:table-row>")
+
+	_, t.err = io.WriteString(t.content, b.String())
+	return t.err
+}
+
+func (t *odsTable) close() error {
+	if t.err != nil {
+		return t.err
+	}
+	if _, err := io.WriteString(t.content, odsContentEnd); err != nil {
+		return err
+	}
+	return t.zw.Close()
+}
+
+// / Text of a cell as CSV writes it, strings as they are.
+func formatCell(cell any) string {
+	switch v := cell.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	}
+	return ""
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
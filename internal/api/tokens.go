@@ -0,0 +1,279 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / Route: POST /v1/tokens/password-reset
+// / Generate a password reset token for an activated user and email it. The
+// / token is valid for 45 minutes and is redeemed at PUT /v1/users/password.
+// # Parameters
+// @ email (string, required): The email address of the account.
+// # Response: Success (HTTP Status 202):
+
+func (h *Handler) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := h.models.User.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			h.failedValidationResponse(w, r, v.Errors)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !user.Activated {
+		v.AddError("email", "user account must be activated")
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := h.models.Token.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	h.background(func() {
+		data := map[string]any{
+			"Name":               user.Name,
+			"passwordResetToken": token.Plaintext,
+		}
+
+		err := h.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		if err != nil {
+			h.logger.Err(err).Msgf("failed to send password reset email to user %d", user.ID)
+		}
+	})
+
+	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
+
+	err = h.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Route: POST /v1/tokens/activation
+// / Mail a fresh activation token when the welcome email got lost. Older
+// / activation tokens of the user are deleted. Every address can ask 3 times
+// / an hour, and the response is the same whether or not it belongs to an
+// / unactivated account, so the endpoint doesn't reveal registered emails.
+// # Parameters
+// @ email (string, required): The email address of the account.
+// # Response: Success (HTTP Status 202):
+
+func (h *Handler) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	key := "ratelimit:activation:" + strings.ToLower(input.Email)
+
+	allowed, err := h.models.Cache.Allow(r.Context(), key, 3, time.Hour)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		h.rateLimitExceededResponse(w, r)
+		return
+	}
+
+	// Look the user up in the background as well, so the response time
+	// doesn't tell whether the address is registered either.
+	h.background(func() {
+		user, err := h.models.User.GetByEmail(input.Email)
+		if err != nil {
+			if !errors.Is(err, validator.ErrRecordNotFound) {
+				h.logger.Err(err).Msg("failed to look up user for activation token")
+			}
+			return
+		}
+		if user.Activated {
+			return
+		}
+
+		err = h.models.Token.DeleteTokens(data.ScopeActivation, user.ID)
+		if err != nil {
+			h.logger.Err(err).Msgf("failed to delete activation tokens of user %d", user.ID)
+			return
+		}
+
+		token, err := h.models.Token.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			h.logger.Err(err).Msgf("failed to create activation token of user %d", user.ID)
+			return
+		}
+
+		data := map[string]any{
+			"Name":            user.Name,
+			"activationToken": token.Plaintext,
+		}
+
+		err = h.mailer.Send(user.Email, "token_activation.tmpl", data)
+		if err != nil {
+			h.logger.Err(err).Msgf("failed to send activation email to user %d", user.ID)
+		}
+	})
+
+	msg := "if the address belongs to an unactivated account, " +
+		"an email will be sent to it containing activation instructions"
+	env := envelope{"message": msg}
+
+	err = h.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Route: DELETE /v1/tokens/authentication
+// / Log out: revoke the access token of the current request together with
+// / the refresh tokens of its session.
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	err := h.models.Token.DeleteSessionByHash(data.ContextGetTokenHash(r))
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Route: GET /v1/users/sessions
+// / List the active sessions of the user with when and where they were
+// / opened and last used. The session of the request is marked as current.
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := data.ContextGetUser(r)
+
+	sessions, err := h.models.Token.GetSessions(user.ID, data.ContextGetTokenHash(r))
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Route: DELETE /v1/users/sessions/:id
+// / Revoke a session of the user, e.g. one left open on a lost device.
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := h.readInt64IDParam(r)
+	if err != nil {
+		h.notFoundResponse(w, r)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	err = h.models.Token.DeleteSession(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Route: POST /v1/tokens/refresh
+// / Exchange a refresh token for a new access token and refresh token. Each
+// / refresh token works once, presenting a used one again revokes the whole
+// / session since the token must have leaked.
+// # Parameters
+// @ refresh_token (string, required)
+// # Response: Success (HTTP Status 201):
+
+func (h *Handler) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateToken(v, input.RefreshToken); !v.Valid() {
+		h.failedValidationResponse(w, r, map[string]string{"refresh_token": v.Errors["token"]})
+		return
+	}
+
+	access, refresh, err := h.models.Token.Rotate(input.RefreshToken, r.UserAgent(), h.clientIP(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.invalidRefreshTokenResponse(w, r, "invalid or expired refresh token")
+		case errors.Is(err, validator.ErrTokenReused):
+			h.logger.Warn().Str("ip", h.clientIP(r)).Msg("refresh token reuse detected, session revoked")
+			h.invalidRefreshTokenResponse(w, r, err.Error())
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"authentication_token": access, "refresh_token": refresh}
+
+	err = h.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,528 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / POST /v1/users/transactions
+// / Record a ledger entry (buy, sell, transfer_in, transfer_out, fee, airdrop)
+// / and rebuild the holding of the coin from the whole ledger.
+// # Parameters
+// @ portfolio_id (int): defaults to the default portfolio
+// @ coin_id (string, required)
+// @ type (string, required)
+// @ quantity (float, required)
+// @ price (float): unit price in the currency, defaults to the historical
+// @   price at executed_at, required for buy and sell
+// @ fee (float): fee paid in the currency
+// @ currency (string): currency of price and fee, defaults to the reporting
+// @   currency of the user
+// @ fx_rate (float): units of the currency per USD at execution, defaults to
+// @   the current rate, required for entries executed more than a day ago
+// @   in another currency than USD
+// @ note (string)
+// @ executed_at (RFC3339): defaults to now
+// # Response: Success (HTTP Status 201):
+// / The created transaction and the rebuilt holding.
+
+func (h *Handler) CreateTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		PortfolioID int64      `json:"portfolio_id"`
+		CoinID      string     `json:"coin_id"`
+		Type        string     `json:"type"`
+		Quantity    float64    `json:"quantity"`
+		Price       *float64   `json:"price"`
+		Fee         float64    `json:"fee"`
+		Currency    string     `json:"currency"`
+		FXRate      *float64   `json:"fx_rate"`
+		Note        string     `json:"note"`
+		ExecutedAt  *time.Time `json:"executed_at"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	var portfolio *data.Portfolio
+	if input.PortfolioID == 0 {
+		portfolio, err = h.models.Portfolio.GetDefault(user.ID)
+	} else {
+		portfolio, err = h.models.Portfolio.Get(input.PortfolioID, user.ID)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if portfolio.Archived {
+		h.portfolioArchivedResponse(w, r)
+		return
+	}
+
+	currency, rate, err := h.readCurrency(r, user)
+	if err != nil {
+		h.currencyErrorResponse(w, r, err)
+		return
+	}
+
+	t := &data.Transaction{
+		UserID:      user.ID,
+		PortfolioID: portfolio.ID,
+		CoinID:      input.CoinID,
+		Type:        input.Type,
+		Quantity:    input.Quantity,
+		Fee:         input.Fee,
+		Currency:    strings.ToLower(input.Currency),
+		FXRate:      1,
+		Note:        input.Note,
+		ExecutedAt:  time.Now(),
+	}
+	if input.ExecutedAt != nil {
+		t.ExecutedAt = *input.ExecutedAt
+	}
+	if t.Currency == "" {
+		t.Currency = user.Currency
+	}
+
+	if input.FXRate != nil {
+		t.FXRate = *input.FXRate
+	} else if !h.currentFXRate(w, r, t) {
+		return
+	}
+
+	v := validator.New()
+
+	if input.Price != nil {
+		t.Price = *input.Price
+	} else if t.CoinID != "" {
+		price, err := h.historicalPrice(t.CoinID, t.ExecutedAt)
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			if t.Type == data.TransactionBuy || t.Type == data.TransactionSell {
+				v.AddError("price", "no historical price at executed_at, supply price")
+			}
+		case err != nil:
+			h.serverErrorResponse(w, r, err)
+			return
+		}
+		t.Price = price * t.FXRate
+	}
+
+	if data.ValidateTransaction(v, t); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	currentPrice, symbol, err := h.marketData.GetCoinCurrentPriceAndSymbol(t.CoinID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	t.Symbol = symbol
+
+	coin, err := h.models.Transaction.Insert(t, currentPrice)
+	if err != nil {
+		h.ledgerErrorResponse(w, r, err)
+		return
+	}
+	coin.Convert(currency, rate)
+
+	err = h.writeJSON(w, http.StatusCreated, envelope{"transaction": t, "coin": coin}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / GET /v1/users/transactions/:id
+
+func (h *Handler) GetTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := h.readInt64IDParam(r)
+	if err != nil {
+		h.notFoundResponse(w, r)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	t, err := h.models.Transaction.Get(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"transaction": t}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / GET /v1/users/transactions?portfolio=&coin=&type=&page=&per_page=&sort=
+
+func (h *Handler) GetAllTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		PortfolioID int
+		CoinID      string
+		Type        string
+		data.Filters
+	}
+
+	user := data.ContextGetUser(r)
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+	input.PortfolioID = h.readURLint(qs, "portfolio", 0, v)
+	input.CoinID = h.readURLstring(qs, "coin", "")
+	input.Type = h.readURLstring(qs, "type", "")
+	input.Page = h.readURLint(qs, "page", 1, v)
+	input.PerPage = h.readURLint(qs, "per_page", 20, v)
+	input.Sort = h.readURLstring(qs, "sort", "executed_at_desc")
+	input.SortList = []string{
+		"executed_at_asc",
+		"executed_at_desc",
+		"quantity_asc",
+		"quantity_desc",
+		"price_asc",
+		"price_desc",
+	}
+
+	if input.Type != "" {
+		v.Check(
+			validator.PermittedValues(input.Type, data.TransactionTypes...),
+			"type",
+			"invalid transaction type",
+		)
+	}
+
+	if data.ValidateOtherFilters(v, input.Filters); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	txs, err := h.models.Transaction.GetAllForUser(
+		input.CoinID,
+		input.Type,
+		int64(input.PortfolioID),
+		user.ID,
+		input.Filters,
+	)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"transactions": txs}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / PATCH /v1/users/transactions/:id
+// / Partially update a ledger entry, the coin of an entry can't be changed.
+// / The holding is rebuilt from the ledger after the change.
+
+func (h *Handler) UpdateTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := h.readInt64IDParam(r)
+	if err != nil {
+		h.notFoundResponse(w, r)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	t, err := h.models.Transaction.Get(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !h.transactionPortfolioWritable(w, r, t) {
+		return
+	}
+
+	currency, rate, err := h.readCurrency(r, user)
+	if err != nil {
+		h.currencyErrorResponse(w, r, err)
+		return
+	}
+
+	var input struct {
+		Type       *string    `json:"type"`
+		Quantity   *float64   `json:"quantity"`
+		Price      *float64   `json:"price"`
+		Fee        *float64   `json:"fee"`
+		Currency   *string    `json:"currency"`
+		FXRate     *float64   `json:"fx_rate"`
+		Note       *string    `json:"note"`
+		ExecutedAt *time.Time `json:"executed_at"`
+	}
+
+	err = h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Type != nil {
+		t.Type = *input.Type
+	}
+	if input.Quantity != nil {
+		t.Quantity = *input.Quantity
+	}
+	if input.Price != nil {
+		t.Price = *input.Price
+	}
+	if input.Fee != nil {
+		t.Fee = *input.Fee
+	}
+	if input.Note != nil {
+		t.Note = *input.Note
+	}
+	if input.ExecutedAt != nil {
+		t.ExecutedAt = *input.ExecutedAt
+	}
+
+	if input.FXRate != nil {
+		t.FXRate = *input.FXRate
+	}
+	if input.Currency != nil && strings.ToLower(*input.Currency) != t.Currency {
+		t.Currency = strings.ToLower(*input.Currency)
+		if input.FXRate == nil && !h.currentFXRate(w, r, t) {
+			return
+		}
+	}
+
+	v := validator.New()
+	if data.ValidateTransaction(v, t); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	currentPrice, _, err := h.marketData.GetCoinCurrentPriceAndSymbol(t.CoinID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	coin, err := h.models.Transaction.Update(t, currentPrice)
+	if err != nil {
+		h.ledgerErrorResponse(w, r, err)
+		return
+	}
+	if coin != nil {
+		coin.Convert(currency, rate)
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"transaction": t, "coin": coin}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / DELETE /v1/users/transactions/:id
+
+func (h *Handler) DeleteTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := h.readInt64IDParam(r)
+	if err != nil {
+		h.notFoundResponse(w, r)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	t, err := h.models.Transaction.Get(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !h.transactionPortfolioWritable(w, r, t) {
+		return
+	}
+
+	currency, rate, err := h.readCurrency(r, user)
+	if err != nil {
+		h.currencyErrorResponse(w, r, err)
+		return
+	}
+
+	currentPrice, _, err := h.marketData.GetCoinCurrentPriceAndSymbol(t.CoinID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	coin, err := h.models.Transaction.Delete(t, currentPrice)
+	if err != nil {
+		h.ledgerErrorResponse(w, r, err)
+		return
+	}
+	if coin != nil {
+		coin.Convert(currency, rate)
+	}
+
+	err = h.writeJSON(
+		w,
+		http.StatusOK,
+		envelope{"transaction": fmt.Sprintf("transaction %d deleted", t.ID), "coin": coin},
+		nil,
+	)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Ledger entries of archived portfolios are read-only. Sends the error
+// / response and returns false when the entry can't be changed.
+func (h *Handler) transactionPortfolioWritable(
+	w http.ResponseWriter,
+	r *http.Request,
+	t *data.Transaction,
+) bool {
+	portfolio, err := h.models.Portfolio.Get(t.PortfolioID, t.UserID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if portfolio.Archived {
+		h.portfolioArchivedResponse(w, r)
+		return false
+	}
+	return true
+}
+
+// / Entries executed longer ago than this need an explicit FX rate.
+const currentFXRateMaxAge = 24 * time.Hour
+
+// / Set the FX rate of the entry to the current rate of its currency when the
+// / client didn't send the rate at execution. The providers only know
+// / today's rates, so backdated entries in another currency than USD must
+// / carry their own rate, or their cost basis would drift from what was
+// / paid. Sends the error response and returns false when there is no rate.
+func (h *Handler) currentFXRate(w http.ResponseWriter, r *http.Request, t *data.Transaction) bool {
+	if t.Currency == data.BaseCurrency {
+		t.FXRate = 1
+		return true
+	}
+
+	if time.Since(t.ExecutedAt) > currentFXRateMaxAge {
+		h.failedValidationResponse(w, r, map[string]string{
+			"fx_rate": "must be provided for entries executed more than a day ago in " + t.Currency,
+		})
+		return false
+	}
+
+	rates, err := h.marketData.GetExchangeRates()
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	rate, err := rates.Rate(t.Currency)
+	if err != nil {
+		h.failedValidationResponse(w, r, map[string]string{"currency": err.Error()})
+		return false
+	}
+	t.FXRate = rate
+	return true
+}
+
+// / GET /v1/users/transactions/export?format=csv|json|ods&portfolio=
+// / Download the ledger in execution order, of one portfolio or of all of
+// / them. The format can also be negotiated through the Accept header, the
+// / rows are streamed as they are read.
+
+func (h *Handler) ExportTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	format, err := readTableFormat(r)
+	if err != nil {
+		h.tableFormatErrorResponse(w, r, err)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	v := validator.New()
+	portfolioID := h.readURLint(r.URL.Query(), "portfolio", 0, v)
+	if !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	name := "transactions-" + time.Now().UTC().Format("2006-01-02")
+	if portfolioID != 0 {
+		_, err := h.models.Portfolio.Get(int64(portfolioID), user.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, validator.ErrRecordNotFound):
+				h.notFoundResponse(w, r)
+			default:
+				h.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		name = fmt.Sprintf("transactions-%d-%s", portfolioID, time.Now().UTC().Format("2006-01-02"))
+	}
+
+	columns := []string{
+		"id", "portfolio_id", "coin_id", "symbol", "type", "quantity", "price", "fee", "currency", "fx_rate",
+		"note", "executed_at",
+	}
+
+	h.streamTable(w, r, format, name, columns, func(emit func([]any) error) error {
+		return h.models.Transaction.Each(r.Context(), user.ID, int64(portfolioID), func(t *data.Transaction) error {
+			return emit([]any{
+				t.ID, t.PortfolioID, t.CoinID, t.Symbol, t.Type, t.Quantity, t.Price, t.Fee, t.Currency, t.FXRate,
+				t.Note, t.ExecutedAt,
+			})
+		})
+	})
+}
+
+// / GET /v1/users/transactions/:id
+// / httprouter can't register the export next to the :id wildcard, so an id
+// / of "export" is the download of ExportTransactionsHandler.
+
+func (h *Handler) getTransactionOrExportHandler(w http.ResponseWriter, r *http.Request) {
+	if id, _ := h.readIDParam(r); id == "export" {
+		h.ExportTransactionsHandler(w, r)
+		return
+	}
+	h.GetTransactionHandler(w, r)
+}
@@ -0,0 +1,325 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/totp"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+const totpIssuer = "PortfolioTracker"
+
+// / Route: GET /v1/users/2fa
+// / Whether 2FA is enabled and how many recovery codes are left.
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) getTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := data.ContextGetUser(r)
+
+	tf, err := h.models.TwoFactor.Get(user.ID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	remaining, err := h.models.TwoFactor.RemainingRecoveryCodes(user.ID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"two_factor": envelope{"enabled": tf.Enabled, "recovery_codes_remaining": remaining}}
+
+	err = h.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Route: POST /v1/users/2fa/enroll
+// / Start enrolling an authenticator app. Returns a new secret and its
+// / otpauth:// URI, 2FA is enabled once a code of it is verified at
+// / POST /v1/users/2fa/verify. Enrolling again replaces a pending secret.
+// # Response: Success (HTTP Status 201):
+
+func (h *Handler) enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := data.ContextGetUser(r)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.models.TwoFactor.Enroll(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrEditConflict):
+			h.twoFactorEnabledResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(totpIssuer, user.Email, secret),
+	}
+
+	err = h.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Route: POST /v1/users/2fa/verify
+// / Verify the first code of the enrolled secret and enable 2FA. Returns the
+// / recovery codes, each logs in once when the authenticator is lost. They
+// / are shown only here.
+// # Parameters
+// @ code (string, required): current code of the authenticator app
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) verifyTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	if !h.allowTwoFactorAttempt(w, r, fmt.Sprintf("ratelimit:2fa:user:%d", user.ID)) {
+		return
+	}
+
+	tf, err := h.models.TwoFactor.Get(user.ID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if tf.Enabled {
+		h.twoFactorEnabledResponse(w, r)
+		return
+	}
+	if tf.Secret == "" {
+		v.AddError("code", "enroll at POST /v1/users/2fa/enroll first")
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	step, ok := totp.Validate(tf.Secret, input.Code, time.Now())
+	if !ok {
+		v.AddError("code", "invalid code")
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	codes, err := data.GenerateRecoveryCodes()
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.models.TwoFactor.Enable(user.ID, step, codes)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"two_factor": envelope{"enabled": true}, "recovery_codes": codes}
+
+	err = h.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Route: DELETE /v1/users/2fa
+// / Disable 2FA. Needs the password and a current code or recovery code.
+// # Parameters
+// @ password (string, required)
+// @ code (string, required)
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidatePasswordPlainText(v, input.Password)
+	data.ValidateTOTPCode(v, input.Code)
+
+	if !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	if !h.allowTwoFactorAttempt(w, r, fmt.Sprintf("ratelimit:2fa:user:%d", user.ID)) {
+		return
+	}
+
+	matches, err := user.Password.Matches(input.Password)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+	if !matches {
+		h.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	ok, err := h.models.TwoFactor.Verify(user.ID, input.Code, time.Now())
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		v.AddError("code", "invalid code")
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = h.models.TwoFactor.Disable(user.ID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"two_factor": envelope{"enabled": false}}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Route: POST /v1/tokens/2fa
+// / Second step of a login with 2FA: exchange the 2fa-pending token of
+// / POST /v1/users/auth and a code of the authenticator app, or a recovery
+// / code, for a session.
+// # Parameters
+// @ token (string, required): the 2fa-pending token
+// @ code (string, required)
+// # Response: Success (HTTP Status 201):
+
+func (h *Handler) twoFactorLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlainText string `json:"token"`
+		Code           string `json:"code"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateToken(v, input.TokenPlainText)
+	data.ValidateTOTPCode(v, input.Code)
+
+	if !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := h.models.User.GetUserByToken(data.ScopeTwoFactorPending, input.TokenPlainText)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired token")
+			h.failedValidationResponse(w, r, v.Errors)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Keyed on the user, so logging in again for a fresh pending token
+	// doesn't reset the attempts. A correct code clears the count, only
+	// failed codes lead to the lockout.
+	key := fmt.Sprintf("ratelimit:2fa:login:user:%d", user.ID)
+	if !h.allowTwoFactorAttempt(w, r, key) {
+		return
+	}
+
+	ok, err := h.models.TwoFactor.Verify(user.ID, input.Code, time.Now())
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		v.AddError("code", "invalid code")
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = h.models.Cache.Delete(r.Context(), key)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.models.Token.DeleteTokens(data.ScopeTwoFactorPending, user.ID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	access, refresh, err := h.models.Token.NewSession(user.ID, r.UserAgent(), h.clientIP(r))
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"authentication_token": access, "refresh_token": refresh}
+
+	err = h.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Allow 5 code attempts per key every 15 minutes, so the 10^6 codes
+// / can't be brute forced. Sends the 429 response when over the limit.
+// # Parameters
+// - key: the user of a session or of a login
+func (h *Handler) allowTwoFactorAttempt(w http.ResponseWriter, r *http.Request, key string) bool {
+	allowed, err := h.models.Cache.Allow(r.Context(), key, 5, 15*time.Minute)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !allowed {
+		h.rateLimitExceededResponse(w, r)
+		return false
+	}
+	return true
+}
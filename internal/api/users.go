@@ -2,12 +2,10 @@ package api
 
 import (
 	"errors"
-	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
-	"github.com/rs/zerolog"
-
 	"github.com/aalperen0/portfolio-tracker/internal/data"
 	"github.com/aalperen0/portfolio-tracker/internal/validator"
 )
@@ -73,27 +71,17 @@ func (h *Handler) registerUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Sending email with goroutine at the backround
-	// and catching errors before terminating
-	h.wg.Add(1)
-	go func() {
-		defer h.wg.Done()
-
-		defer func() {
-			if err := recover(); err != nil {
-				h.logger.Level(zerolog.ErrorLevel).With().Err(fmt.Errorf("%s", err))
-			}
-		}()
-
+	h.background(func() {
 		data := map[string]any{
 			"Name":            user.Name,
 			"activationToken": token.Plaintext,
 		}
 
-		err = h.mailer.Send(user.Email, "user_welcome.tmpl", data)
+		err := h.mailer.Send(user.Email, "user_welcome.tmpl", data)
 		if err != nil {
-			h.logger.Level(zerolog.ErrorLevel).With().Err(err)
+			h.logger.Err(err).Msgf("failed to send welcome email to user %d", user.ID)
 		}
-	}()
+	})
 
 	err = h.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
 	if err != nil {
@@ -165,3 +153,487 @@ func (h *Handler) activateUserHandler(w http.ResponseWriter, r *http.Request) {
 		h.serverErrorResponse(w, r, err)
 	}
 }
+
+// / Route: PUT /v1/users/cost-basis
+// / Select the cost-basis method (fifo, lifo, hifo, average) used to match
+// / disposals against tax lots. Every holding of the user is rebuilt from the
+// / ledger with the new method so realized and unrealized PNL stay consistent.
+// # Parameters
+// @ cost_basis_method (string, required)
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) updateCostBasisMethodHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		CostBasisMethod string `json:"cost_basis_method"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateCostBasisMethod(v, input.CostBasisMethod); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	coinIDs, err := h.models.Transaction.CoinIDsForUser(user.ID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	prices := make(map[string]float64, len(coinIDs))
+	for _, coinID := range coinIDs {
+		price, _, err := h.marketData.GetCoinCurrentPriceAndSymbol(coinID)
+		if err != nil {
+			h.serverErrorResponse(w, r, err)
+			return
+		}
+		prices[coinID] = price
+	}
+
+	// Prices are fetched first: the method is only saved together with
+	// the holdings rebuilt with it.
+	user.CostBasisMethod = input.CostBasisMethod
+
+	err = h.models.Transaction.RebuildAll(user, prices)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrEditConflict):
+			h.editConflictResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Route: PUT /v1/users/currency
+// / Select the reporting currency holdings, PNL and market prices are
+// / converted to. It can be overridden per request with ?currency=.
+// # Parameters
+// @ reporting_currency (string, required): e.g. usd, eur, gbp, try
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) updateReportingCurrencyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Currency string `json:"reporting_currency"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	input.Currency = strings.ToLower(input.Currency)
+
+	v := validator.New()
+	if data.ValidateCurrency(v, input.Currency); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	rates, err := h.marketData.GetExchangeRates()
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+	if _, err := rates.Rate(input.Currency); err != nil {
+		h.failedValidationResponse(w, r, map[string]string{"reporting_currency": err.Error()})
+		return
+	}
+
+	user := data.ContextGetUser(r)
+	user.Currency = input.Currency
+
+	err = h.models.User.UpdateUser(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrEditConflict):
+			h.editConflictResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Route: PUT /v1/users/password
+// / Set a new password with a password reset token. Every password reset,
+// / access and refresh token of the user is revoked, so sessions opened
+// / with the old password end.
+// # Parameters
+// @ password (string, required): The new password.
+// @ token (string, required): The password reset token.
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlainText string `json:"token"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidatePasswordPlainText(v, input.Password)
+	data.ValidateToken(v, input.TokenPlainText)
+
+	if !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := h.models.User.GetUserByToken(data.ScopePasswordReset, input.TokenPlainText)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			h.failedValidationResponse(w, r, v.Errors)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.models.User.UpdateUser(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrEditConflict):
+			h.editConflictResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	for _, scope := range []string{data.ScopePasswordReset, data.ScopeAuthentication, data.ScopeRefresh} {
+		err = h.models.Token.DeleteTokens(scope, user.ID)
+		if err != nil {
+			h.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"message": "your password was successfully reset"}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Route: GET /v1/users/me
+// / The account of the authenticated user. Its version is sent back with
+// / PATCH /v1/users/me to detect concurrent edits.
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) getCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := data.ContextGetUser(r)
+
+	err := h.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Route: PATCH /v1/users/me
+// / Change the name, email or password of the account. Email and password
+// / changes need the current password. A new email isn't used until it's
+// / confirmed with the token mailed to it at PUT /v1/users/me/email. A new
+// / password ends every other session of the user.
+// # Parameters
+// @ name (string)
+// @ email (string)
+// @ password (string): the new password
+// @ current_password (string): required to change email or password
+// @ version (int): version of the account the changes are based on
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name            *string `json:"name"`
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+		Version         *int    `json:"version"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	if input.Version != nil && *input.Version != user.Version {
+		h.editConflictResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	newEmail := ""
+	if input.Email != nil && *input.Email != user.Email {
+		newEmail = *input.Email
+		data.ValidateEmail(v, newEmail)
+	}
+
+	if newEmail != "" || input.Password != nil {
+		v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	}
+
+	if input.CurrentPassword != "" {
+		matches, err := user.Password.Matches(input.CurrentPassword)
+		if err != nil {
+			h.serverErrorResponse(w, r, err)
+			return
+		}
+		v.Check(matches, "current_password", "is incorrect")
+	}
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	if input.Password != nil {
+		err = user.Password.Set(*input.Password)
+		if err != nil {
+			h.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if newEmail != "" {
+		_, err := h.models.User.GetByEmail(newEmail)
+		switch {
+		case err == nil:
+			v.AddError("email", "a user with this email already exists")
+			h.failedValidationResponse(w, r, v.Errors)
+			return
+		case !errors.Is(err, validator.ErrRecordNotFound):
+			h.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = h.models.User.UpdateUser(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrEditConflict):
+			h.editConflictResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if input.Password != nil {
+		err = h.models.Token.DeleteTokens(data.ScopePasswordReset, user.ID)
+		if err != nil {
+			h.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = h.models.Token.DeleteOtherSessions(user.ID, data.ContextGetTokenHash(r))
+		if err != nil {
+			h.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	env := envelope{"user": user}
+
+	if newEmail != "" {
+		err = h.requestEmailChange(user, newEmail)
+		if err != nil {
+			h.serverErrorResponse(w, r, err)
+			return
+		}
+		env["pending_email"] = newEmail
+		env["message"] = "an email was sent to " + newEmail + " containing instructions to confirm it"
+	}
+
+	err = h.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Store the new email as pending and mail a 24 hour email-change token to
+// / it. Tokens sent for an earlier change stop working.
+func (h *Handler) requestEmailChange(user *data.User, email string) error {
+	err := h.models.User.SetPendingEmail(user.ID, email)
+	if err != nil {
+		return err
+	}
+
+	err = h.models.Token.DeleteTokens(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		return err
+	}
+
+	token, err := h.models.Token.New(user.ID, 24*time.Hour, data.ScopeEmailChange)
+	if err != nil {
+		return err
+	}
+
+	h.background(func() {
+		data := map[string]any{
+			"Name":             user.Name,
+			"emailChangeToken": token.Plaintext,
+		}
+
+		err := h.mailer.Send(email, "token_email_change.tmpl", data)
+		if err != nil {
+			h.logger.Err(err).Msgf("failed to send email change email to user %d", user.ID)
+		}
+	})
+	return nil
+}
+
+// / Route: PUT /v1/users/me/email
+// / Confirm a change of email with the token mailed to the new address.
+// # Parameters
+// @ token (string, required): The email-change token.
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlainText string `json:"token"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateToken(v, input.TokenPlainText); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := h.models.User.ConfirmPendingEmail(input.TokenPlainText)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			h.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, validator.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email already exists")
+			h.failedValidationResponse(w, r, v.Errors)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = h.models.Token.DeleteTokens(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Route: DELETE /v1/users/me
+// / Delete the account together with its holdings, transactions, sessions
+// / and API keys. A confirmation is mailed to the deleted address.
+// # Parameters
+// @ password (string, required): The current password.
+// # Response: Success (HTTP Status 200):
+
+func (h *Handler) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidatePasswordPlainText(v, input.Password); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	matches, err := user.Password.Matches(input.Password)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+	if !matches {
+		v.AddError("password", "is incorrect")
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = h.models.User.Delete(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	h.background(func() {
+		data := map[string]any{
+			"Name": user.Name,
+		}
+
+		err := h.mailer.Send(user.Email, "user_deleted.tmpl", data)
+		if err != nil {
+			h.logger.Err(err).Msgf("failed to send deletion email to user %d", user.ID)
+		}
+	})
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"message": "your account was successfully deleted"}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
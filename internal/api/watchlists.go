@@ -0,0 +1,309 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / POST /v1/users/watchlists
+// / Create a named list of coins to follow without holding them.
+// # Parameters
+// @ name (string, required): unique per user
+// @ coins ([]string): coin ids, at most 100
+// # Response: Success (HTTP Status 201):
+
+func (h *Handler) CreateWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name  string   `json:"name"`
+		Coins []string `json:"coins"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	watchlist := &data.Watchlist{
+		UserID:  user.ID,
+		Name:    input.Name,
+		CoinIDs: normalizeCoinIDs(input.Coins),
+	}
+
+	v := validator.New()
+	if data.ValidateWatchlist(v, watchlist); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !h.checkMarketCoins(w, r, "coins", watchlist.CoinIDs) {
+		return
+	}
+
+	err = h.models.Watchlist.Insert(watchlist)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrDuplicateWatchlist):
+			v.AddError("name", "a watchlist with this name already exists")
+			h.failedValidationResponse(w, r, v.Errors)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/users/watchlists/%d", watchlist.ID))
+
+	err = h.writeJSON(w, http.StatusCreated, envelope{"watchlist": watchlist}, headers)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / GET /v1/users/watchlists
+
+func (h *Handler) GetAllWatchlistsHandler(w http.ResponseWriter, r *http.Request) {
+	user := data.ContextGetUser(r)
+
+	watchlists, err := h.models.Watchlist.GetAllForUser(user.ID)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"watchlists": watchlists}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / GET /v1/users/watchlists/:id
+
+func (h *Handler) GetWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	watchlist, ok := h.readWatchlist(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.writeJSON(w, http.StatusOK, envelope{"watchlist": watchlist}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / GET /v1/users/watchlists/:id/markets?currency=
+// / The coins of a watchlist with their market data: price, 24h change,
+// / market cap and distance from the all-time high, quoted in the requested
+// / currency. The whole list is fetched in one market data call. Coins the
+// / provider has no data for are listed as unavailable.
+
+func (h *Handler) GetWatchlistMarketsHandler(w http.ResponseWriter, r *http.Request) {
+	watchlist, ok := h.readWatchlist(w, r)
+	if !ok {
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	currency := user.Currency
+	if currency == "" {
+		currency = data.BaseCurrency
+	}
+	currency = strings.ToLower(h.readURLstring(r.URL.Query(), "currency", currency))
+
+	v := validator.New()
+	if data.ValidateCurrency(v, currency); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	markets, err := h.coinMarkets(currency, watchlist.CoinIDs)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrInvalidCurrency):
+			h.badRequestResponse(w, r, validator.ErrInvalidCurrency)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	coins := []*data.WatchlistCoin{}
+	unavailable := []string{}
+	for _, coinID := range watchlist.CoinIDs {
+		m, ok := markets[coinID]
+		if !ok {
+			unavailable = append(unavailable, coinID)
+			continue
+		}
+		coins = append(coins, data.NewWatchlistCoin(m))
+	}
+
+	env := envelope{
+		"watchlist":   watchlist,
+		"currency":    currency,
+		"coins":       coins,
+		"unavailable": unavailable,
+	}
+
+	err = h.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / PATCH /v1/users/watchlists/:id
+// / Rename a watchlist or change its coins.
+// # Parameters
+// @ name (string)
+// @ coins ([]string): replaces the coins of the list
+// @ add ([]string): coins appended to the list
+// @ remove ([]string): coins removed from the list
+// @ version (int): rejected with 409 if the list changed since
+
+func (h *Handler) UpdateWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	watchlist, ok := h.readWatchlist(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Name    *string  `json:"name"`
+		Coins   []string `json:"coins"`
+		Add     []string `json:"add"`
+		Remove  []string `json:"remove"`
+		Version *int     `json:"version"`
+	}
+
+	err := h.readJSON(w, r, &input)
+	if err != nil {
+		h.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Version != nil && *input.Version != watchlist.Version {
+		h.editConflictResponse(w, r)
+		return
+	}
+
+	before := make(map[string]bool, len(watchlist.CoinIDs))
+	for _, coinID := range watchlist.CoinIDs {
+		before[coinID] = true
+	}
+
+	if input.Name != nil {
+		watchlist.Name = *input.Name
+	}
+	if input.Coins != nil {
+		watchlist.CoinIDs = normalizeCoinIDs(input.Coins)
+	}
+	for _, coinID := range normalizeCoinIDs(input.Add) {
+		if !validator.PermittedValues(coinID, watchlist.CoinIDs...) {
+			watchlist.CoinIDs = append(watchlist.CoinIDs, coinID)
+		}
+	}
+	if remove := normalizeCoinIDs(input.Remove); len(remove) > 0 {
+		kept := []string{}
+		for _, coinID := range watchlist.CoinIDs {
+			if !validator.PermittedValues(coinID, remove...) {
+				kept = append(kept, coinID)
+			}
+		}
+		watchlist.CoinIDs = kept
+	}
+
+	v := validator.New()
+	if data.ValidateWatchlist(v, watchlist); !v.Valid() {
+		h.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	added := []string{}
+	for _, coinID := range watchlist.CoinIDs {
+		if !before[coinID] {
+			added = append(added, coinID)
+		}
+	}
+	if !h.checkMarketCoins(w, r, "coins", added) {
+		return
+	}
+
+	err = h.models.Watchlist.Update(watchlist)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrDuplicateWatchlist):
+			v.AddError("name", "a watchlist with this name already exists")
+			h.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, validator.ErrEditConflict):
+			h.editConflictResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"watchlist": watchlist}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / DELETE /v1/users/watchlists/:id
+
+func (h *Handler) DeleteWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := h.readInt64IDParam(r)
+	if err != nil {
+		h.notFoundResponse(w, r)
+		return
+	}
+
+	user := data.ContextGetUser(r)
+
+	err = h.models.Watchlist.Delete(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = h.writeJSON(w, http.StatusOK, envelope{"message": "watchlist successfully deleted"}, nil)
+	if err != nil {
+		h.serverErrorResponse(w, r, err)
+	}
+}
+
+// / Load the watchlist of the :id parameter, responding with 404 if the
+// / user has no such watchlist.
+func (h *Handler) readWatchlist(w http.ResponseWriter, r *http.Request) (*data.Watchlist, bool) {
+	id, err := h.readInt64IDParam(r)
+	if err != nil {
+		h.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user := data.ContextGetUser(r)
+
+	watchlist, err := h.models.Watchlist.Get(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, validator.ErrRecordNotFound):
+			h.notFoundResponse(w, r)
+		default:
+			h.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return watchlist, true
+}
@@ -83,3 +83,27 @@ func (c *Cache) Invalidate(ctx context.Context, pattern string) error {
 	}
 	return nil
 }
+
+// / Count a hit against a fixed window rate limit. The first hit of a
+// / window starts its expiry.
+// # Parameters
+// - context
+// - key(limit key, e.g. ratelimit:activation:<email>)
+// - limit(hits allowed per window)
+// - window(length of the window)
+// # Return
+// - true while the key is within its limit
+// - error
+func (c *Cache) Allow(ctx context.Context, key string, limit int64, window time.Duration) (bool, error) {
+	hits, err := c.RDB.Incr(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+
+	if hits == 1 {
+		if err := c.RDB.Expire(ctx, key, window).Err(); err != nil {
+			return false, err
+		}
+	}
+	return hits <= limit, nil
+}
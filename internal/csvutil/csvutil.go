@@ -0,0 +1,14 @@
+// / Package csvutil holds helpers for CSV files users open in a spreadsheet.
+package csvutil
+
+import "strings"
+
+// / EscapeFormula prefixes text a spreadsheet would run as a formula with a
+// / quote, so notes and names like =HYPERLINK(...) are shown as typed. Only
+// / for free text, numbers are written as numbers and never escaped.
+func EscapeFormula(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,423 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+const (
+	AlertPriceAbove = "price_above"
+	AlertPriceBelow = "price_below"
+	AlertChangeUp   = "change_up"
+	AlertChangeDown = "change_down"
+	AlertPNLAbove   = "pnl_above"
+	AlertPNLBelow   = "pnl_below"
+)
+
+var AlertKinds = []string{
+	AlertPriceAbove,
+	AlertPriceBelow,
+	AlertChangeUp,
+	AlertChangeDown,
+	AlertPNLAbove,
+	AlertPNLBelow,
+}
+
+type AlertModel struct {
+	DB *sql.DB
+}
+
+// / An alert watches a coin price, the 24h change of a coin in percent or
+// / the total PNL of the user. Price and PNL thresholds are in the alert
+// / currency. An alert triggers when the value crosses its threshold, or on
+// / its first evaluation when the value is already past it. One-shot alerts
+// / deactivate after they trigger, recurring ones trigger on the next
+// / crossing once the cooldown has passed.
+type Alert struct {
+	ID              int64      `json:"id"`
+	UserID          int64      `json:"-"`
+	CreatedAt       time.Time  `json:"created_at"`
+	CoinID          string     `json:"coin_id,omitempty"`
+	Kind            string     `json:"kind"`
+	Threshold       float64    `json:"threshold"`
+	Currency        string     `json:"currency"`
+	Recurring       bool       `json:"recurring"`
+	CooldownMinutes int        `json:"cooldown_minutes"`
+	Active          bool       `json:"active"`
+	LastTriggeredAt *time.Time `json:"last_triggered_at"`
+	TriggerCount    int        `json:"trigger_count"`
+	Version         int        `json:"version"`
+
+	// Whether the value was past the threshold at the last evaluation, nil
+	// before the first one.
+	ConditionMet *bool `json:"-"`
+
+	// Recipient of the alert, only loaded for evaluation.
+	UserName  string `json:"-"`
+	UserEmail string `json:"-"`
+}
+
+func ValidateAlert(v *validator.Validator, a *Alert) {
+	v.Check(
+		validator.PermittedValues(a.Kind, AlertKinds...),
+		"kind",
+		"must be one of price_above, price_below, change_up, change_down, pnl_above, pnl_below",
+	)
+
+	if a.IsPNL() {
+		v.Check(a.CoinID == "", "coin_id", "must be empty for pnl alerts")
+	} else {
+		v.Check(a.CoinID != "", "coin_id", "must be provided")
+		v.Check(len(a.CoinID) <= 100, "coin_id", "must be not longer than 100 bytes")
+		v.Check(a.Threshold > 0, "threshold", "must be greater than zero")
+	}
+	if a.Kind == AlertChangeUp || a.Kind == AlertChangeDown {
+		v.Check(a.Threshold <= 1000, "threshold", "must be a percentage up to 1000")
+	}
+
+	ValidateCurrency(v, a.Currency)
+	v.Check(a.CooldownMinutes > 0, "cooldown_minutes", "must be greater than zero")
+	v.Check(a.CooldownMinutes <= 7*24*60, "cooldown_minutes", "must not be more than a week")
+}
+
+func (a *Alert) IsPNL() bool {
+	return a.Kind == AlertPNLAbove || a.Kind == AlertPNLBelow
+}
+
+func (a *Alert) IsChange() bool {
+	return a.Kind == AlertChangeUp || a.Kind == AlertChangeDown
+}
+
+// / Met reports whether the observed value is past the threshold: a price
+// / or PNL in the alert currency, or a 24h change in percent.
+func (a *Alert) Met(value float64) bool {
+	switch a.Kind {
+	case AlertPriceAbove, AlertPNLAbove:
+		return value >= a.Threshold
+	case AlertPriceBelow, AlertPNLBelow:
+		return value <= a.Threshold
+	case AlertChangeUp:
+		return value >= a.Threshold
+	case AlertChangeDown:
+		return value <= -a.Threshold
+	}
+	return false
+}
+
+// / Crossed reports whether the observed value crossed the threshold since
+// / the last evaluation. Staying past it doesn't trigger again.
+func (a *Alert) Crossed(value float64) bool {
+	return a.Met(value) && (a.ConditionMet == nil || !*a.ConditionMet)
+}
+
+// / Due reports whether the cooldown since the last trigger has passed.
+func (a *Alert) Due(now time.Time) bool {
+	cooldown := time.Duration(a.CooldownMinutes) * time.Minute
+	return a.LastTriggeredAt == nil || !a.LastTriggeredAt.After(now.Add(-cooldown))
+}
+
+func (m AlertModel) Insert(a *Alert) error {
+	query := `INSERT INTO alerts(user_id, coin_id, kind, threshold, currency, recurring, cooldown_minutes)
+              VALUES($1, $2, $3, $4, $5, $6, $7)
+              RETURNING id, created_at, active, trigger_count, version`
+
+	args := []any{a.UserID, a.CoinID, a.Kind, a.Threshold, a.Currency, a.Recurring, a.CooldownMinutes}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).
+		Scan(&a.ID, &a.CreatedAt, &a.Active, &a.TriggerCount, &a.Version)
+}
+
+// / Retrieve an alert of the user by id.
+func (m AlertModel) Get(id, userID int64) (*Alert, error) {
+	if id < 1 {
+		return nil, validator.ErrRecordNotFound
+	}
+
+	query := `SELECT id, user_id, created_at, coin_id, kind, threshold, currency, recurring, cooldown_minutes,
+              active, last_triggered_at, trigger_count, version
+              FROM alerts
+              WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanAlert(m.DB.QueryRowContext(ctx, query, id, userID))
+}
+
+// / List the alerts of the user, newest first.
+func (m AlertModel) GetAllForUser(userID int64, activeOnly bool) ([]*Alert, error) {
+	query := `SELECT id, user_id, created_at, coin_id, kind, threshold, currency, recurring, cooldown_minutes,
+              active, last_triggered_at, trigger_count, version
+              FROM alerts
+              WHERE user_id = $1 AND (active OR NOT $2)
+              ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, activeOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := []*Alert{}
+	for rows.Next() {
+		a, err := scanAlert(rows)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return alerts, nil
+}
+
+// / Update an alert with optimistic locking on version. The side of the
+// / threshold is forgotten, so the next evaluation starts afresh.
+func (m AlertModel) Update(a *Alert) error {
+	query := `UPDATE alerts
+              SET threshold = $1, currency = $2, recurring = $3, cooldown_minutes = $4, active = $5,
+              condition_met = NULL, version = version + 1
+              WHERE id = $6 AND user_id = $7 AND version = $8
+              RETURNING version`
+
+	args := []any{
+		a.Threshold,
+		a.Currency,
+		a.Recurring,
+		a.CooldownMinutes,
+		a.Active,
+		a.ID,
+		a.UserID,
+		a.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&a.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return validator.ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m AlertModel) Delete(id, userID int64) error {
+	if id < 1 {
+		return validator.ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM alerts WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return validator.ErrRecordNotFound
+	}
+	return nil
+}
+
+// / Active alerts of activated, enabled users with the name and email of the
+// / recipient. Alerts in their cooldown are included, so crossings back
+// / over the threshold are still observed.
+func (m AlertModel) GetActive() ([]*Alert, error) {
+	query := `SELECT alerts.id, alerts.user_id, alerts.created_at, alerts.coin_id, alerts.kind, alerts.threshold,
+              alerts.currency, alerts.recurring, alerts.cooldown_minutes, alerts.active,
+              alerts.last_triggered_at, alerts.trigger_count, alerts.version, alerts.condition_met,
+              users.name, users.email
+              FROM alerts
+              JOIN users ON users.id = alerts.user_id
+              WHERE alerts.active AND users.activated AND NOT users.disabled`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := []*Alert{}
+	for rows.Next() {
+		var a Alert
+		err := rows.Scan(
+			&a.ID,
+			&a.UserID,
+			&a.CreatedAt,
+			&a.CoinID,
+			&a.Kind,
+			&a.Threshold,
+			&a.Currency,
+			&a.Recurring,
+			&a.CooldownMinutes,
+			&a.Active,
+			&a.LastTriggeredAt,
+			&a.TriggerCount,
+			&a.Version,
+			&a.ConditionMet,
+			&a.UserName,
+			&a.UserEmail,
+		)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, &a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return alerts, nil
+}
+
+// / Record that the alert triggered at now. One-shot alerts are deactivated.
+// / The update only succeeds when the alert is still due, so concurrent
+// / evaluators deliver it once. RevertTrigger undoes it when the delivery
+// / fails.
+// # Return
+// - false if another evaluator already triggered the alert
+func (m AlertModel) MarkTriggered(a *Alert, now time.Time) (bool, error) {
+	query := `UPDATE alerts
+              SET last_triggered_at = $1, trigger_count = trigger_count + 1, active = recurring,
+              condition_met = true
+              WHERE id = $2 AND active
+              AND (last_triggered_at IS NULL OR last_triggered_at <= $1 - make_interval(mins => cooldown_minutes))
+              RETURNING active, trigger_count`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, now, a.ID).Scan(&a.Active, &a.TriggerCount)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	a.LastTriggeredAt = &now
+	return true, nil
+}
+
+// / Undo MarkTriggered after the alert couldn't be delivered, so it triggers
+// / again on the next evaluation.
+// # Parameters
+// - lastTriggeredAt: the last trigger before MarkTriggered
+// - now: the time passed to MarkTriggered
+func (m AlertModel) RevertTrigger(a *Alert, lastTriggeredAt *time.Time, now time.Time) error {
+	query := `UPDATE alerts
+              SET last_triggered_at = $1, trigger_count = trigger_count - 1, active = true, condition_met = NULL
+              WHERE id = $2 AND last_triggered_at = $3
+              RETURNING active, trigger_count`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, lastTriggeredAt, a.ID, now).Scan(&a.Active, &a.TriggerCount)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	a.LastTriggeredAt = lastTriggeredAt
+	a.ConditionMet = nil
+	return nil
+}
+
+// / Store the side of the threshold the alert was observed on.
+func (m AlertModel) SetConditionMet(a *Alert, met bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `UPDATE alerts SET condition_met = $1 WHERE id = $2`, met, a.ID)
+	if err != nil {
+		return err
+	}
+	a.ConditionMet = &met
+	return nil
+}
+
+// / Total PNL (unrealized and realized) of the non-archived holdings of each
+// / user in USD.
+func (m AlertModel) TotalPNL(userIDs []int64) (map[int64]float64, error) {
+	query := `SELECT coins.user_id, SUM(coins.pnl + coins.realized_pnl)
+              FROM coins
+              JOIN portfolios ON portfolios.id = coins.portfolio_id
+              WHERE coins.user_id = ANY($1) AND NOT portfolios.archived
+              GROUP BY coins.user_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[int64]float64, len(userIDs))
+	for rows.Next() {
+		var (
+			userID int64
+			total  float64
+		)
+		if err := rows.Scan(&userID, &total); err != nil {
+			return nil, err
+		}
+		totals[userID] = total
+	}
+	return totals, rows.Err()
+}
+
+func scanAlert(row rowScanner) (*Alert, error) {
+	var a Alert
+	err := row.Scan(
+		&a.ID,
+		&a.UserID,
+		&a.CreatedAt,
+		&a.CoinID,
+		&a.Kind,
+		&a.Threshold,
+		&a.Currency,
+		&a.Recurring,
+		&a.CooldownMinutes,
+		&a.Active,
+		&a.LastTriggeredAt,
+		&a.TriggerCount,
+		&a.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, validator.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &a, nil
+}
@@ -0,0 +1,255 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / Scopes of API keys. Sessions opened with a password carry every scope,
+// / API keys only the ones they were created with.
+const (
+	ScopePortfolioRead   = "portfolio:read"
+	ScopePortfolioWrite  = "portfolio:write"
+	ScopeAlertsRead      = "alerts:read"
+	ScopeAlertsWrite     = "alerts:write"
+	ScopeWatchlistsRead  = "watchlists:read"
+	ScopeWatchlistsWrite = "watchlists:write"
+)
+
+var APIKeyScopes = []string{
+	ScopePortfolioRead,
+	ScopePortfolioWrite,
+	ScopeAlertsRead,
+	ScopeAlertsWrite,
+	ScopeWatchlistsRead,
+	ScopeWatchlistsWrite,
+}
+
+// / API keys start with this prefix so they can be told apart from session
+// / tokens in the Authorization header.
+const APIKeyPrefix = "ptk_"
+
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// / A long-lived credential for scripts. Only the hash of the key is stored,
+// / Prefix keeps its first characters so users can recognize it in a list.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Name       string     `json:"name"`
+	Plaintext  string     `json:"key,omitempty"`
+	Prefix     string     `json:"prefix"`
+	Hash       []byte     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	Expiry     *time.Time `json:"expiry"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// / Create an API key with a random secret. The plaintext is only returned
+// / here, it can't be shown again.
+func GenerateAPIKey(userID int64, name string, scopes []string, expiry *time.Time) (*APIKey, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	plaintext := APIKeyPrefix + strings.ToLower(secret)
+
+	return &APIKey{
+		UserID:    userID,
+		Name:      name,
+		Plaintext: plaintext,
+		Prefix:    plaintext[:len(APIKeyPrefix)+6],
+		Hash:      HashToken(plaintext),
+		Scopes:    scopes,
+		Expiry:    expiry,
+	}, nil
+}
+
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes")
+
+	v.Check(len(key.Scopes) > 0, "scopes", "must contain at least one scope")
+	for _, scope := range key.Scopes {
+		v.Check(
+			validator.PermittedValues(scope, APIKeyScopes...),
+			"scopes",
+			"must only contain portfolio:read, portfolio:write, alerts:read, alerts:write, watchlists:read, "+
+				"watchlists:write",
+		)
+	}
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (m APIKeyModel) Insert(key *APIKey) error {
+	query := `INSERT INTO api_keys(user_id, name, prefix, hash, scopes, expiry)
+              VALUES($1, $2, $3, $4, $5, $6)
+              RETURNING id, created_at`
+
+	args := []any{key.UserID, key.Name, key.Prefix, key.Hash, pq.Array(key.Scopes), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// / List the API keys of the user, newest first.
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `SELECT id, user_id, created_at, name, prefix, scopes, expiry, last_used_at
+              FROM api_keys
+              WHERE user_id = $1
+              ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		var k APIKey
+		err := rows.Scan(
+			&k.ID,
+			&k.UserID,
+			&k.CreatedAt,
+			&k.Name,
+			&k.Prefix,
+			pq.Array(&k.Scopes),
+			&k.Expiry,
+			&k.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// / Resolve an unexpired API key and its owner from the plaintext.
+// # Return
+// - ErrRecordNotFound if the key is unknown or expired, or its user disabled
+func (m APIKeyModel) GetForKey(plaintext string) (*APIKey, *User, error) {
+	query := `SELECT api_keys.id, api_keys.created_at, api_keys.name, api_keys.prefix, api_keys.scopes,
+              api_keys.expiry, api_keys.last_used_at,
+              users.id, users.created_at, users.name, users.email, users.password_hash, users.activated,
+              users.version, users.cost_basis_method, users.reporting_currency, users.role, users.disabled
+              FROM api_keys
+              JOIN users ON users.id = api_keys.user_id
+              WHERE api_keys.hash = $1 AND (api_keys.expiry IS NULL OR api_keys.expiry > NOW())
+              AND NOT users.disabled`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var (
+		key  APIKey
+		user User
+	)
+	err := m.DB.QueryRowContext(ctx, query, HashToken(plaintext)).Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Scopes),
+		&key.Expiry,
+		&key.LastUsedAt,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.CostBasisMethod,
+		&user.Currency,
+		&user.Role,
+		&user.Disabled,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, validator.ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	key.UserID = user.ID
+	return &key, &user, nil
+}
+
+// / Record that the key was used at now, at most once a minute.
+func (m APIKeyModel) Touch(id int64, now time.Time) error {
+	query := `UPDATE api_keys
+              SET last_used_at = $2
+              WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < $2 - INTERVAL '1 minute')`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, now)
+	return err
+}
+
+// / Revoke an API key of the user.
+func (m APIKeyModel) Delete(id, userID int64) error {
+	if id < 1 {
+		return validator.ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM api_keys WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return validator.ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// / Actions recorded in the audit trail.
+const (
+	AuditUserRoleChanged = "user.role_changed"
+	AuditUserDeactivated = "user.deactivated"
+	AuditUserReactivated = "user.reactivated"
+	AuditUserLoggedOut   = "user.force_logout"
+)
+
+type AuditModel struct {
+	DB *sql.DB
+}
+
+// / An entry of the audit trail: who did what to which account and from
+// / where. Actor and target are kept as null when the user is deleted.
+type AuditEntry struct {
+	ID           int64          `json:"id"`
+	CreatedAt    time.Time      `json:"created_at"`
+	ActorID      *int64         `json:"actor_id"`
+	Action       string         `json:"action"`
+	TargetUserID *int64         `json:"target_user_id"`
+	Details      map[string]any `json:"details"`
+	IP           string         `json:"ip"`
+}
+
+func (m AuditModel) Insert(e *AuditEntry) error {
+	if e.Details == nil {
+		e.Details = map[string]any{}
+	}
+	details, err := json.Marshal(e.Details)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO audit_log(actor_id, action, target_user_id, details, ip)
+              VALUES($1, $2, $3, $4, $5)
+              RETURNING id, created_at`
+
+	args := []any{e.ActorID, e.Action, e.TargetUserID, details, e.IP}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&e.ID, &e.CreatedAt)
+}
+
+// / List audit entries, newest first, optionally of one actor or target.
+// # Parameters
+// @ actorID, targetUserID(int64): 0 for any
+// # Return
+// - the page of entries and the total number of matching entries
+func (m AuditModel) GetAll(actorID, targetUserID int64, filters Filters) ([]*AuditEntry, int, error) {
+	query := `SELECT COUNT(*) OVER(), id, created_at, actor_id, action, target_user_id, details, ip
+              FROM audit_log
+              WHERE (actor_id = $1 OR $1 = 0) AND (target_user_id = $2 OR $2 = 0)
+              ORDER BY created_at DESC, id DESC
+              LIMIT $3 OFFSET $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, actorID, targetUserID, filters.Limit(), filters.Offset())
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	total := 0
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		var (
+			e       AuditEntry
+			details []byte
+		)
+		err := rows.Scan(&total, &e.ID, &e.CreatedAt, &e.ActorID, &e.Action, &e.TargetUserID, &details, &e.IP)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := json.Unmarshal(details, &e.Details); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, &e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
+
+// / Every audit entry where the user is the actor or the target, oldest
+// / first.
+func (m AuditModel) GetAllForUser(userID int64) ([]*AuditEntry, error) {
+	query := `SELECT id, created_at, actor_id, action, target_user_id, details, ip
+              FROM audit_log
+              WHERE actor_id = $1 OR target_user_id = $1
+              ORDER BY created_at ASC, id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		var (
+			e       AuditEntry
+			details []byte
+		)
+		err := rows.Scan(&e.ID, &e.CreatedAt, &e.ActorID, &e.Action, &e.TargetUserID, &details, &e.IP)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(details, &e.Details); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
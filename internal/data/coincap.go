@@ -0,0 +1,296 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/cache"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / CoinCapClient implements MarketDataProvider on the CoinCap REST API.
+// / CoinCap quotes assets in USD, other currencies are converted with its
+// / /rates endpoint. It uses the same slug ids as CoinGecko for the large
+// / coins (bitcoin, ethereum, ...).
+type CoinCapClient struct {
+	apiKey     string
+	baseURL    string
+	httpClient *http.Client
+	cache      *cache.Cache
+}
+
+func NewCoinCapClient(apiKey string, cache *cache.Cache) *CoinCapClient {
+	return &CoinCapClient{
+		apiKey:     apiKey,
+		baseURL:    "https://rest.coincap.io/v3",
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		cache:      cache,
+	}
+}
+
+// / CoinCap encodes numbers as strings and missing values as null.
+type coinCapNumber float64
+
+func (n *coinCapNumber) UnmarshalJSON(b []byte) error {
+	str := strings.Trim(string(b), `"`)
+	if str == "" || str == "null" {
+		*n = 0
+		return nil
+	}
+
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return err
+	}
+	*n = coinCapNumber(f)
+	return nil
+}
+
+type coinCapAsset struct {
+	ID                string        `json:"id"`
+	Rank              coinCapNumber `json:"rank"`
+	Symbol            string        `json:"symbol"`
+	Name              string        `json:"name"`
+	Supply            coinCapNumber `json:"supply"`
+	MaxSupply         coinCapNumber `json:"maxSupply"`
+	MarketCapUsd      coinCapNumber `json:"marketCapUsd"`
+	PriceUsd          coinCapNumber `json:"priceUsd"`
+	ChangePercent24Hr coinCapNumber `json:"changePercent24Hr"`
+}
+
+func (a coinCapAsset) marketData(updated string) CoinMarketData {
+	price := float64(a.PriceUsd)
+
+	// CoinCap reports the 24h change in percent, convert it to an absolute
+	// change so that it matches the CoinGecko field.
+	change := 0.0
+	if pct := float64(a.ChangePercent24Hr); pct > -100 {
+		change = price - price/(1+pct/100)
+	}
+
+	return CoinMarketData{
+		MarketCapRank:     int64(a.Rank),
+		Symbol:            strings.ToLower(a.Symbol),
+		ID:                a.ID,
+		Name:              a.Name,
+		CurrentPrice:      price,
+		MarketCap:         float64(a.MarketCapUsd),
+		PriceChange24h:    change,
+		CirculatingSupply: float64(a.Supply),
+		MaxSupply:         float64(a.MaxSupply),
+		LastUpdated:       updated,
+	}
+}
+
+// / Send a GET request to the CoinCap API and decode the "data" member of
+// / the response into dest.
+func (c *CoinCapClient) get(path string, query url.Values, dest any) (int, error) {
+	searchUrl := fmt.Sprintf("%s%s", c.baseURL, path)
+	if len(query) > 0 {
+		searchUrl = fmt.Sprintf("%s?%s", searchUrl, query.Encode())
+	}
+
+	req, err := http.NewRequest("GET", searchUrl, nil)
+	if err != nil {
+		return 0, fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Add("accept", "application/json")
+	if c.apiKey != "" {
+		req.Header.Add("Authorization", "Bearer "+c.apiKey)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("making request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, fmt.Errorf("API ERROR (status %d): %s", res.StatusCode, string(body))
+	}
+
+	envelope := struct {
+		Data any `json:"data"`
+	}{Data: dest}
+
+	if err := json.NewDecoder(res.Body).Decode(&envelope); err != nil {
+		return res.StatusCode, fmt.Errorf("decoding response %w", err)
+	}
+	return res.StatusCode, nil
+}
+
+func (c *CoinCapClient) GetCoinMarkets(
+	currency string,
+	filters Filters,
+) ([]CoinMarketData, error) {
+	rates, err := c.GetExchangeRates()
+	if err != nil {
+		return nil, err
+	}
+	rate, err := rates.Rate(currency)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+
+	if filters.Ids != "" {
+		query.Add("ids", filters.Ids)
+	}
+	if filters.PerPage > 0 {
+		query.Add("limit", strconv.Itoa(filters.PerPage))
+		if filters.Page > 0 {
+			query.Add("offset", strconv.Itoa((filters.Page-1)*filters.PerPage))
+		}
+	}
+
+	var assets []coinCapAsset
+	if _, err := c.get("/assets", query, &assets); err != nil {
+		return nil, err
+	}
+
+	updated := time.Now().UTC().Format(time.RFC3339)
+
+	coins := make([]CoinMarketData, 0, len(assets))
+	for _, a := range assets {
+		m := a.marketData(updated)
+		m.Convert(rate)
+		coins = append(coins, m)
+	}
+
+	// CoinCap always orders by rank, other orders apply to the fetched page
+	switch filters.Order {
+	case "market_cap_asc":
+		sort.SliceStable(coins, func(i, j int) bool { return coins[i].MarketCap < coins[j].MarketCap })
+	case "id_asc":
+		sort.SliceStable(coins, func(i, j int) bool { return coins[i].ID < coins[j].ID })
+	case "id_desc":
+		sort.SliceStable(coins, func(i, j int) bool { return coins[i].ID > coins[j].ID })
+	}
+
+	return coins, nil
+}
+
+// / Price and symbol of the coin from /assets/:id, cached for 5 minutes.
+func (c *CoinCapClient) GetCoinCurrentPriceAndSymbol(coinID string) (float64, string, error) {
+	ctx := context.Background()
+
+	if price, symbol, found := getCachedPrice(ctx, c.cache, coinID); found {
+		return price, symbol, nil
+	}
+
+	var asset coinCapAsset
+	status, err := c.get("/assets/"+url.PathEscape(coinID), nil, &asset)
+	if err != nil {
+		if status == http.StatusNotFound {
+			return 0, "", validator.ErrRecordNotFound
+		}
+		return 0, "", err
+	}
+
+	if asset.ID == "" {
+		return 0, "", validator.ErrRecordNotFound
+	}
+
+	price := float64(asset.PriceUsd)
+	symbol := strings.ToLower(asset.Symbol)
+
+	if err := setCachedPrice(ctx, c.cache, coinID, price, symbol); err != nil {
+		return 0, "", err
+	}
+
+	return price, symbol, nil
+}
+
+// / Search coins through the search parameter of /assets.
+func (c *CoinCapClient) LookupCoins(query string) ([]CoinInfo, error) {
+	var assets []coinCapAsset
+	_, err := c.get("/assets", url.Values{"search": {query}, "limit": {"25"}}, &assets)
+	if err != nil {
+		return nil, err
+	}
+
+	coins := make([]CoinInfo, 0, len(assets))
+	for _, a := range assets {
+		coins = append(coins, CoinInfo{ID: a.ID, Symbol: strings.ToLower(a.Symbol), Name: a.Name})
+	}
+	return coins, nil
+}
+
+// / Fiat rates from /rates. CoinCap reports USD per unit of the currency,
+// / the rates are inverted to units per USD.
+func (c *CoinCapClient) GetExchangeRates() (ExchangeRates, error) {
+	ctx := context.Background()
+
+	if rates, found := getCachedRates(ctx, c.cache); found {
+		return rates, nil
+	}
+
+	var assets []struct {
+		Symbol  string        `json:"symbol"`
+		Type    string        `json:"type"`
+		RateUsd coinCapNumber `json:"rateUsd"`
+	}
+	if _, err := c.get("/rates", nil, &assets); err != nil {
+		return nil, err
+	}
+
+	rates := ExchangeRates{BaseCurrency: 1}
+	for _, a := range assets {
+		if a.Type != "fiat" || a.RateUsd <= 0 {
+			continue
+		}
+		rates[strings.ToLower(a.Symbol)] = 1 / float64(a.RateUsd)
+	}
+
+	if err := setCachedRates(ctx, c.cache, rates); err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+// / Price history from /assets/:id/history. CoinCap has no volume in the
+// / history, samples are hourly up to 90 days and daily beyond.
+func (c *CoinCapClient) GetPriceHistory(coinID string, from, to time.Time) ([]PriceSample, error) {
+	interval := "h1"
+	if to.Sub(from) > hourlyHistoryLimit {
+		interval = "d1"
+	}
+
+	query := url.Values{
+		"interval": {interval},
+		"start":    {strconv.FormatInt(from.UnixMilli(), 10)},
+		"end":      {strconv.FormatInt(to.UnixMilli(), 10)},
+	}
+
+	var points []struct {
+		PriceUsd coinCapNumber `json:"priceUsd"`
+		Time     int64         `json:"time"`
+	}
+	status, err := c.get("/assets/"+url.PathEscape(coinID)+"/history", query, &points)
+	if err != nil {
+		if status == http.StatusNotFound {
+			return nil, validator.ErrRecordNotFound
+		}
+		return nil, err
+	}
+
+	samples := make([]PriceSample, 0, len(points))
+	for _, p := range points {
+		samples = append(samples, PriceSample{
+			Time:  time.UnixMilli(p.Time).UTC(),
+			Price: float64(p.PriceUsd),
+		})
+	}
+	return samples, nil
+}
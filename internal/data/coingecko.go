@@ -0,0 +1,272 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/cache"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / CoinGeckoClient implements MarketDataProvider on the CoinGecko v3 API.
+type CoinGeckoClient struct {
+	apiKey     string
+	baseURL    string
+	httpClient *http.Client
+	cache      *cache.Cache
+}
+
+func NewCoinGeckoClient(apiKey string, cache *cache.Cache) *CoinGeckoClient {
+	return &CoinGeckoClient{
+		apiKey:     apiKey,
+		baseURL:    "https://api.coingecko.com/api/v3",
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		cache:      cache,
+	}
+}
+
+// / Send a GET request to the CoinGecko API and return the response
+// / the caller has to close.
+func (c *CoinGeckoClient) get(path string, query url.Values) (*http.Response, error) {
+	searchUrl := fmt.Sprintf("%s%s", c.baseURL, path)
+	if len(query) > 0 {
+		searchUrl = fmt.Sprintf("%s?%s", searchUrl, query.Encode())
+	}
+
+	req, err := http.NewRequest("GET", searchUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Add("accept", "application/json")
+	req.Header.Add("x-cg-demo-api-key", c.apiKey)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("making request: %w", err)
+	}
+	return res, nil
+}
+
+func (c *CoinGeckoClient) GetCoinMarkets(
+	currency string,
+	filters Filters,
+) ([]CoinMarketData, error) {
+	query := url.Values{}
+
+	query.Add("vs_currency", currency)
+
+	if filters.Ids != "" {
+		query.Add("ids", filters.Ids)
+	}
+
+	if filters.Page > 0 {
+		query.Add("page", strconv.Itoa(filters.Page))
+	}
+	if filters.PerPage > 0 {
+		query.Add("per_page", strconv.Itoa(filters.PerPage))
+	}
+	if filters.Order != "" {
+		query.Add("order", filters.Order)
+	}
+
+	res, err := c.get("/coins/markets", query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		if strings.Contains(string(body), "invalid vs_currency") {
+			return nil, validator.ErrInvalidCurrency
+		}
+		return nil, fmt.Errorf("API ERROR (status %d): %s", res.StatusCode, string(body))
+	}
+
+	var coins []CoinMarketData
+	if err := json.NewDecoder(res.Body).Decode(&coins); err != nil {
+		return nil, fmt.Errorf("decoding response %w", err)
+	}
+	return coins, nil
+}
+
+// ////////////////////////////////////////////
+
+// / If a coin stored in the cache, we retrieve coin price and coin symbol.
+// / Otherwise retrieve a coin from the CoinGecko api. If user retrieve a coin
+// / from the api, the function put the values to the cache for a 5 minute.
+// # Parameters
+// - coinID (string)
+// # Return
+// - price (float64)
+// - symbol(string)
+// - error(record not found)
+
+func (c *CoinGeckoClient) GetCoinCurrentPriceAndSymbol(coinID string) (float64, string, error) {
+	ctx := context.Background()
+
+	if price, symbol, found := getCachedPrice(ctx, c.cache, coinID); found {
+		return price, symbol, nil
+	}
+
+	res, err := c.get("/coins/"+url.PathEscape(coinID), nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, "", validator.ErrRecordNotFound
+	}
+
+	var response struct {
+		Symbol     string `json:"symbol"`
+		MarketData struct {
+			CurrentPrice struct {
+				USD float64 `json:"usd"`
+			} `json:"current_price"`
+		} `json:"market_data"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return 0, "", err
+	}
+
+	price := response.MarketData.CurrentPrice.USD
+	symbol := response.Symbol
+
+	if err := setCachedPrice(ctx, c.cache, coinID, price, symbol); err != nil {
+		return 0, "", err
+	}
+
+	return price, symbol, nil
+}
+
+// / Search coins through the /search endpoint of CoinGecko.
+func (c *CoinGeckoClient) LookupCoins(query string) ([]CoinInfo, error) {
+	res, err := c.get("/search", url.Values{"query": {query}})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("API ERROR (status %d): %s", res.StatusCode, string(body))
+	}
+
+	var response struct {
+		Coins []CoinInfo `json:"coins"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("decoding response %w", err)
+	}
+
+	for i := range response.Coins {
+		response.Coins[i].Symbol = strings.ToLower(response.Coins[i].Symbol)
+	}
+	return response.Coins, nil
+}
+
+// / Exchange rates from /exchange_rates. CoinGecko quotes every currency
+// / against BTC, the rates are rebased on USD.
+func (c *CoinGeckoClient) GetExchangeRates() (ExchangeRates, error) {
+	ctx := context.Background()
+
+	if rates, found := getCachedRates(ctx, c.cache); found {
+		return rates, nil
+	}
+
+	res, err := c.get("/exchange_rates", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("API ERROR (status %d): %s", res.StatusCode, string(body))
+	}
+
+	var response struct {
+		Rates map[string]struct {
+			Value float64 `json:"value"`
+			Type  string  `json:"type"`
+		} `json:"rates"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("decoding response %w", err)
+	}
+
+	usd, ok := response.Rates[BaseCurrency]
+	if !ok || usd.Value <= 0 {
+		return nil, fmt.Errorf("exchange rates without %s", BaseCurrency)
+	}
+
+	rates := make(ExchangeRates, len(response.Rates))
+	for code, rate := range response.Rates {
+		rates[code] = rate.Value / usd.Value
+	}
+
+	if err := setCachedRates(ctx, c.cache, rates); err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+// / Price history from /coins/:id/market_chart/range. CoinGecko picks the
+// / granularity from the length of the range (hourly up to 90 days).
+func (c *CoinGeckoClient) GetPriceHistory(coinID string, from, to time.Time) ([]PriceSample, error) {
+	query := url.Values{
+		"vs_currency": {BaseCurrency},
+		"from":        {strconv.FormatInt(from.Unix(), 10)},
+		"to":          {strconv.FormatInt(to.Unix(), 10)},
+	}
+
+	res, err := c.get("/coins/"+url.PathEscape(coinID)+"/market_chart/range", query)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return nil, validator.ErrRecordNotFound
+	case res.StatusCode != http.StatusOK:
+		body, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("API ERROR (status %d): %s", res.StatusCode, string(body))
+	}
+
+	var response struct {
+		Prices       [][2]float64 `json:"prices"`
+		TotalVolumes [][2]float64 `json:"total_volumes"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("decoding response %w", err)
+	}
+
+	volumes := make(map[int64]float64, len(response.TotalVolumes))
+	for _, v := range response.TotalVolumes {
+		volumes[int64(v[0])] = v[1]
+	}
+
+	samples := make([]PriceSample, 0, len(response.Prices))
+	for _, p := range response.Prices {
+		samples = append(samples, PriceSample{
+			Time:   time.UnixMilli(int64(p[0])).UTC(),
+			Price:  p[1],
+			Volume: volumes[int64(p[0])],
+		})
+	}
+	return samples, nil
+}
@@ -3,6 +3,7 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
@@ -23,7 +24,9 @@ type CoinModel struct {
 }
 
 type Coin struct {
+	ID                   int64     `json:"id"`
 	CoinID               string    `json:"coin_id"`
+	PortfolioID          int64     `json:"portfolio_id,omitempty"`
 	UserID               int64     `json:"-"`
 	CreatedAt            time.Time `json:"-"`
 	Symbol               string    `json:"symbol"`
@@ -31,7 +34,20 @@ type Coin struct {
 	PurchasePriceAverage float64   `json:"purchase_price_average"`
 	TotalCost            float64   `json:"total_cost"`
 	PNL                  float64   `json:"pnl"`
+	RealizedPNL          float64   `json:"realized_pnl"`
+	Currency             string    `json:"currency,omitempty"`
 	Version              int       `json:"version"`
+	Lots                 []*Lot    `json:"lots,omitempty"`
+}
+
+// / Holdings are written with their unrealized PNL under both pnl, which
+// / existing clients read, and unrealized_pnl next to realized_pnl.
+func (c Coin) MarshalJSON() ([]byte, error) {
+	type coin Coin
+	return json.Marshal(struct {
+		coin
+		UnrealizedPNL float64 `json:"unrealized_pnl"`
+	}{coin(c), c.PNL})
 }
 
 func ValidateCoin(v *validator.Validator, coin *Coin) {
@@ -47,51 +63,35 @@ func ValidateCoinUpdate(v *validator.Validator, amount, purchasePrice float64) {
 	v.Check(purchasePrice > 0, "purchase_price", "must be greater than zero")
 }
 
-func (m CoinModel) InsertCoin(coin *Coin) error {
-	query := `INSERT INTO coins(coin_id, user_id, symbol, amount, purchase_price_average, total_cost, pnl)
-              VALUES($1, $2, $3, $4, $5 ,$6, $7)
-              RETURNING created_at, version`
-
-	args := []any{
-		coin.CoinID,
-		coin.UserID,
-		coin.Symbol,
-		coin.Amount,
-		coin.PurchasePriceAverage,
-		coin.TotalCost,
-		coin.PNL,
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&coin.CreatedAt, &coin.Version)
-}
-
 // / Get coin from the porfolio according to id of coin
 // / Coin id must be string
-func (m CoinModel) GetCoinForUser(coinId string, userID int64) (*Coin, error) {
+func (m CoinModel) GetCoinForUser(coinId string, portfolioID, userID int64) (*Coin, error) {
 	if coinId == "" {
 		return nil, validator.ErrRecordNotFound
 	}
 
-	query := `SELECT coin_id, user_id, symbol, amount, purchase_price_average, total_cost, pnl
+	query := `SELECT id, coin_id, portfolio_id, user_id, symbol, amount, purchase_price_average, total_cost, pnl,
+              realized_pnl, version
               FROM coins
-              WHERE coin_id = $1 AND user_id = $2`
+              WHERE coin_id = $1 AND portfolio_id = $2 AND user_id = $3`
 
 	var coin Coin
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, coinId, userID).Scan(
+	err := m.DB.QueryRowContext(ctx, query, coinId, portfolioID, userID).Scan(
+		&coin.ID,
 		&coin.CoinID,
+		&coin.PortfolioID,
 		&coin.UserID,
 		&coin.Symbol,
 		&coin.Amount,
 		&coin.PurchasePriceAverage,
 		&coin.TotalCost,
 		&coin.PNL,
+		&coin.RealizedPNL,
+		&coin.Version,
 	)
 	if err != nil {
 		switch {
@@ -105,17 +105,28 @@ func (m CoinModel) GetCoinForUser(coinId string, userID int64) (*Coin, error) {
 }
 
 // Delete  coin in the porfolio
-func (m CoinModel) DeleteCoin(coinID string, userID int64) error {
+func (m CoinModel) DeleteCoin(coinID string, portfolioID, userID int64) error {
 	if coinID == "" {
 		return validator.ErrRecordNotFound
 	}
 
-	query := `DELETE FROM coins WHERE coin_id = $1 AND user_id = $2`
+	query := `DELETE FROM coins WHERE coin_id = $1 AND portfolio_id = $2 AND user_id = $3`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query, coinID, userID)
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			m.Logger.Err(err).Msg("rollback error")
+		}
+	}()
+
+	result, err := tx.ExecContext(ctx, query, coinID, portfolioID, userID)
 	if err != nil {
 		return err
 	}
@@ -129,15 +140,37 @@ func (m CoinModel) DeleteCoin(coinID string, userID int64) error {
 		return validator.ErrRecordNotFound
 	}
 
+	// The holding is derived from the ledger, dropping it drops its history too
+	_, err = tx.ExecContext(
+		ctx,
+		`DELETE FROM transactions WHERE coin_id = $1 AND portfolio_id = $2 AND user_id = $3`,
+		coinID,
+		portfolioID,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	cacheKey := "user:coins:" + strconv.Itoa(int(userID)) + ":*"
+	if err := m.Cache.Invalidate(ctx, cacheKey); err != nil {
+		m.Logger.Err(err).Msg("failed to invalidate portfolio cache")
+	}
+
 	return nil
 }
 
 func (m CoinModel) GetAllCoinsForUser(
 	coinID string,
+	portfolioID int64,
 	userID int64,
 	filters Filters,
 ) ([]*Coin, error) {
-	cacheKey := "user:coins:" + strconv.Itoa(int(userID))
+	cacheKey := "user:coins:" + strconv.Itoa(int(userID)) + ":" + strconv.Itoa(int(portfolioID))
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -148,13 +181,13 @@ func (m CoinModel) GetAllCoinsForUser(
 		return cachedCoins, nil
 	}
 
-	query := fmt.Sprintf(`SELECT coin_id, symbol, amount, purchase_price_average, total_cost, pnl
+	query := fmt.Sprintf(`SELECT id, coin_id, symbol, amount, purchase_price_average, total_cost, pnl, realized_pnl, version
               FROM coins
-              WHERE (coin_id ILIKE $1 OR symbol ILIKE $1 or $1 = '') AND user_id = $2
+              WHERE (coin_id ILIKE $1 OR symbol ILIKE $1 or $1 = '') AND portfolio_id = $2 AND user_id = $3
               ORDER BY %s %s 
-              LIMIT $3 OFFSET $4`, filters.SortColumn(), filters.SortDirection())
+              LIMIT $4 OFFSET $5`, filters.SortColumn(), filters.SortDirection())
 
-	args := []any{coinID, userID, filters.Limit(), filters.Offset()}
+	args := []any{coinID, portfolioID, userID, filters.Limit(), filters.Offset()}
 
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -166,13 +199,18 @@ func (m CoinModel) GetAllCoinsForUser(
 
 	for rows.Next() {
 		var coin Coin
+		coin.PortfolioID = portfolioID
+		coin.UserID = userID
 		err := rows.Scan(
+			&coin.ID,
 			&coin.CoinID,
 			&coin.Symbol,
 			&coin.Amount,
 			&coin.PurchasePriceAverage,
 			&coin.TotalCost,
 			&coin.PNL,
+			&coin.RealizedPNL,
+			&coin.Version,
 		)
 		if err != nil {
 			return nil, err
@@ -185,59 +223,50 @@ func (m CoinModel) GetAllCoinsForUser(
 	return coins, nil
 }
 
-func (m CoinModel) UpdateCoinsForUser(coin *Coin) error {
-	query := `UPDATE coins 
-              SET amount = $1, purchase_price_average = $2, total_cost = $3, pnl = $4, version = version + 1 
-              WHERE coin_id = $5 AND user_id = $6 
-              RETURNING version`
-
-	args := []any{
-		coin.Amount,
-		coin.PurchasePriceAverage,
-		coin.TotalCost,
-		coin.PNL,
-		coin.CoinID,
-		coin.UserID,
-	}
+// / Sum the holdings of every non-archived portfolio of the user per coin.
+// / Average price is recalculated from the summed cost of the open lots.
+func (m CoinModel) GetAggregatedForUser(userID int64) ([]*Coin, error) {
+	query := `SELECT coins.coin_id, MIN(coins.symbol), SUM(coins.amount), SUM(coins.total_cost),
+              SUM(coins.pnl), SUM(coins.realized_pnl)
+              FROM coins
+              JOIN portfolios ON portfolios.id = coins.portfolio_id
+              WHERE coins.user_id = $1 AND NOT portfolios.archived
+              GROUP BY coins.coin_id
+              ORDER BY SUM(coins.total_cost) + SUM(coins.pnl) DESC`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	tx, err := m.DB.BeginTx(ctx, nil)
+	rows, err := m.DB.QueryContext(ctx, query, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	defer func() {
-		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
-			m.Logger.Err(err).Msg("rollback error")
-		}
-	}()
+	coins := []*Coin{}
 
-	err = tx.QueryRowContext(ctx, query, args...).Scan(&coin.Version)
-	if err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return validator.ErrEditConflict
-		default:
-			return err
+	for rows.Next() {
+		coin := Coin{UserID: userID}
+		err := rows.Scan(
+			&coin.CoinID,
+			&coin.Symbol,
+			&coin.Amount,
+			&coin.TotalCost,
+			&coin.PNL,
+			&coin.RealizedPNL,
+		)
+		if err != nil {
+			return nil, err
 		}
+		if coin.Amount > 0 {
+			coin.PurchasePriceAverage = coin.TotalCost / coin.Amount
+		}
+		coins = append(coins, &coin)
 	}
-
-	// COMMIT ensures that all changes in a transaction are permanently saved,
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
-
-	//  After succesfull update invaliditing relevant caches
-	cacheKey := "user:coins:" + strconv.Itoa(int(coin.UserID))
-	err = m.Cache.Delete(ctx, cacheKey)
-	if err != nil {
-		return err
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
-
-	return nil
+	return coins, nil
 }
 
 // / Fetching all distinct coins from database
@@ -269,41 +298,159 @@ func (m CoinModel) EnqueuePNLUpdates() error {
 	return rows.Err()
 }
 
-func (m CoinModel) UpdatePNLForCoin(coinID string, currentPrice float64) error {
-	ctx := context.Background()
+// / Call fn with every holding of the portfolio ordered by coin, one row at a
+// / time, so exports don't hold the portfolio in memory.
+// # Parameters
+// - fn: stops the iteration by returning an error, which is returned
+func (m CoinModel) Each(ctx context.Context, userID, portfolioID int64, fn func(*Coin) error) error {
+	query := `SELECT id, coin_id, symbol, amount, purchase_price_average, total_cost, pnl, realized_pnl, version
+              FROM coins
+              WHERE user_id = $1 AND portfolio_id = $2
+              ORDER BY coin_id ASC`
 
-	// Fetch all holdings for the given coin
-	query := `SELECT user_id, amount, purchase_price_average FROM coins WHERE coin_id = $1`
-	rows, err := m.DB.QueryContext(ctx, query, coinID)
+	rows, err := m.DB.QueryContext(ctx, query, userID, portfolioID)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
-	// Process each holding and update PNL
 	for rows.Next() {
-		var userID int64
-		var amount, purchasePriceAvg float64
-
-		if err := rows.Scan(&userID, &amount, &purchasePriceAvg); err != nil {
+		coin := Coin{UserID: userID, PortfolioID: portfolioID}
+		err := rows.Scan(
+			&coin.ID,
+			&coin.CoinID,
+			&coin.Symbol,
+			&coin.Amount,
+			&coin.PurchasePriceAverage,
+			&coin.TotalCost,
+			&coin.PNL,
+			&coin.RealizedPNL,
+			&coin.Version,
+		)
+		if err != nil {
+			return err
+		}
+		if err := fn(&coin); err != nil {
 			return err
 		}
+	}
+	return rows.Err()
+}
 
-		// Calculate PNL
-		pnl := amount * (currentPrice - purchasePriceAvg)
+// / Every holding of the user across all portfolios, archived ones included.
+func (m CoinModel) HoldingsForUser(userID int64) ([]*Coin, error) {
+	query := `SELECT id, portfolio_id, coin_id, symbol, amount, purchase_price_average, total_cost, pnl, realized_pnl,
+              version
+              FROM coins
+              WHERE user_id = $1
+              ORDER BY portfolio_id ASC, coin_id ASC`
 
-		// Update PNL directly in the database
-		updateQuery := `UPDATE coins SET pnl = $1 WHERE coin_id = $2 AND user_id = $3`
-		_, err = m.DB.ExecContext(ctx, updateQuery, pnl, coinID, userID)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	coins := []*Coin{}
+	for rows.Next() {
+		coin := Coin{UserID: userID}
+		err := rows.Scan(
+			&coin.ID,
+			&coin.PortfolioID,
+			&coin.CoinID,
+			&coin.Symbol,
+			&coin.Amount,
+			&coin.PurchasePriceAverage,
+			&coin.TotalCost,
+			&coin.PNL,
+			&coin.RealizedPNL,
+			&coin.Version,
+		)
 		if err != nil {
-			m.Logger.Error().
-				Msgf("failed to update PNL for user %d, coin %s: %v", userID, coinID, err)
-			continue
+			return nil, err
 		}
+		coins = append(coins, &coin)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return coins, nil
+}
+
+// / Coins held in the portfolio of the user.
+func (m CoinModel) CoinIDsForPortfolio(userID, portfolioID int64) ([]string, error) {
+	query := `SELECT coin_id FROM coins WHERE user_id = $1 AND portfolio_id = $2 ORDER BY coin_id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, portfolioID)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
+
+	coinIDs := []string{}
+	for rows.Next() {
+		var coinID string
+		if err := rows.Scan(&coinID); err != nil {
+			return nil, err
+		}
+		coinIDs = append(coinIDs, coinID)
+	}
+	return coinIDs, rows.Err()
+}
+
+// / Distinct coin ids held in any portfolio.
+func (m CoinModel) HeldCoinIDs() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT DISTINCT coin_id FROM coins`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	coinIDs := []string{}
+	for rows.Next() {
+		var coinID string
+		if err := rows.Scan(&coinID); err != nil {
+			return nil, err
+		}
+		coinIDs = append(coinIDs, coinID)
+	}
+	return coinIDs, rows.Err()
+}
+
+// / Recalculate PNL of every holding of the given coin in a single statement.
+// / Each user has their own row for a coin, so the price is applied to
+// / all of them at once instead of looping over the result set.
+
+func (m CoinModel) UpdatePNLForCoin(coinID string, currentPrice float64) error {
+	ctx := context.Background()
+
+	query := `UPDATE coins
+              SET pnl = amount * ($1 - purchase_price_average)
+              WHERE coin_id = $2`
+
+	result, err := m.DB.ExecContext(ctx, query, currentPrice, coinID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	m.Logger.Debug().Msgf("updated PNL of %d holdings for coin %s", rows, coinID)
+
 	if err := m.Cache.Invalidate(ctx, "user:coins:*"); err != nil {
 		m.Logger.Err(err).Msgf("failed to invalidate caches %v", err)
 	}
 
-	return rows.Err()
+	return nil
 }
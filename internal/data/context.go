@@ -21,3 +21,32 @@ func ContextGetUser(r *http.Request) *User {
 	}
 	return user
 }
+
+const tokenContextKey = contextKey("token")
+
+// / Store the hash of the token the request authenticated with, so handlers
+// / can end or mark the current session.
+func ContextSetTokenHash(r *http.Request, hash []byte) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, hash)
+	return r.WithContext(ctx)
+}
+
+// / Hash of the token of the request, nil for anonymous requests.
+func ContextGetTokenHash(r *http.Request) []byte {
+	hash, _ := r.Context().Value(tokenContextKey).([]byte)
+	return hash
+}
+
+const apiKeyContextKey = contextKey("api_key")
+
+// / Store the API key the request authenticated with.
+func ContextSetAPIKey(r *http.Request, key *APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// / API key of the request, nil for session and anonymous requests.
+func ContextGetAPIKey(r *http.Request) *APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*APIKey)
+	return key
+}
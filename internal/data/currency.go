@@ -0,0 +1,64 @@
+package data
+
+import (
+	"strings"
+
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / Holdings, lots and prices are kept in USD, the quote currency of every
+// / market data provider. Other currencies are converted on the way out.
+const BaseCurrency = "usd"
+
+// / ExchangeRates maps a lowercase currency code to units of that currency
+// / per USD, e.g. {"usd": 1, "eur": 0.92, "try": 34.1}.
+type ExchangeRates map[string]float64
+
+// / Units of the currency per USD.
+// # Return
+// - ErrInvalidCurrency if the provider has no rate for the currency
+func (r ExchangeRates) Rate(currency string) (float64, error) {
+	currency = strings.ToLower(currency)
+	if currency == BaseCurrency {
+		return 1, nil
+	}
+
+	rate, ok := r[currency]
+	if !ok || rate <= 0 {
+		return 0, validator.ErrInvalidCurrency
+	}
+	return rate, nil
+}
+
+func ValidateCurrency(v *validator.Validator, currency string) {
+	v.Check(currency != "", "currency", "must be provided")
+	v.Check(len(currency) >= 3 && len(currency) <= 5, "currency", "must be a valid currency code")
+	v.Check(currency == strings.ToLower(currency), "currency", "must be lowercase")
+}
+
+// / Convert the monetary fields of the holding and its lots from USD into
+// / the reporting currency.
+// # Parameters
+// - currency: reporting currency code
+// - rate: units of the currency per USD
+func (c *Coin) Convert(currency string, rate float64) {
+	c.Currency = currency
+	c.PurchasePriceAverage *= rate
+	c.TotalCost *= rate
+	c.PNL *= rate
+	c.RealizedPNL *= rate
+
+	for _, l := range c.Lots {
+		l.UnitCost *= rate
+		l.CostBasis *= rate
+		l.UnrealizedPNL *= rate
+	}
+}
+
+// / Convert the prices of a market listing from USD into the currency.
+func (m *CoinMarketData) Convert(rate float64) {
+	m.CurrentPrice *= rate
+	m.MarketCap *= rate
+	m.PriceChange24h *= rate
+	m.ATH *= rate
+}
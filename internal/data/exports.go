@@ -0,0 +1,314 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+const (
+	ExportPending    = "pending"
+	ExportReady      = "ready"
+	ExportFailed     = "failed"
+	ExportDownloaded = "downloaded"
+)
+
+// / Redis list the ids of requested exports are queued on.
+const ExportQueue = "export_queue"
+
+// / How long the download link of a finished export works.
+const ExportTTL = 24 * time.Hour
+
+type ExportModel struct {
+	DB  *sql.DB
+	RDB *redis.Client
+}
+
+// / A requested archive of everything stored about the user. The archive
+// / itself is only loaded to be downloaded.
+type Export struct {
+	ID          int64      `json:"id"`
+	UserID      int64      `json:"-"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Status      string     `json:"status"`
+	CompletedAt *time.Time `json:"completed_at"`
+	Expiry      *time.Time `json:"expiry"`
+	Size        int64      `json:"size"`
+	MailedAt    *time.Time `json:"-"`
+}
+
+// / Record a pending export and queue it for the export worker. An export
+// / whose push fails stays pending and is queued again by
+// / RequeueUnfinished.
+func (m ExportModel) Insert(e *Export) error {
+	query := `INSERT INTO exports(user_id)
+              VALUES($1)
+              RETURNING id, created_at, status`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, e.UserID).Scan(&e.ID, &e.CreatedAt, &e.Status)
+	if err != nil {
+		return err
+	}
+
+	return m.RDB.RPush(ctx, ExportQueue, strconv.FormatInt(e.ID, 10)).Err()
+}
+
+// / Retrieve an export by id, for the worker.
+func (m ExportModel) Get(id int64) (*Export, error) {
+	query := `SELECT id, user_id, created_at, status, completed_at, expiry, size, mailed_at
+              FROM exports
+              WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	e, err := scanExport(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, validator.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// / List the exports of the user, newest first.
+func (m ExportModel) GetAllForUser(userID int64) ([]*Export, error) {
+	query := `SELECT id, user_id, created_at, status, completed_at, expiry, size, mailed_at
+              FROM exports
+              WHERE user_id = $1
+              ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exports := []*Export{}
+	for rows.Next() {
+		e, err := scanExport(rows)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+// / Store the finished archive of a pending export.
+// # Return
+// - the plaintext download token, only the hash is stored
+func (m ExportModel) Complete(e *Export, archive []byte) (string, error) {
+	token, err := GenerateToken(e.UserID, ExportTTL, "")
+	if err != nil {
+		return "", err
+	}
+
+	query := `UPDATE exports
+              SET status = $2, completed_at = NOW(), expiry = $3, token_hash = $4, archive = $5, size = $6
+              WHERE id = $1 AND status = $7
+              RETURNING status, completed_at, expiry, size`
+
+	args := []any{e.ID, ExportReady, token.Expiry, token.Hash, archive, len(archive), ExportPending}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&e.Status, &e.CompletedAt, &e.Expiry, &e.Size)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", validator.ErrEditConflict
+		default:
+			return "", err
+		}
+	}
+	return token.Plaintext, nil
+}
+
+// / Issue a new download token for a ready export whose link was never
+// / mailed, so the link can be sent again. The old token stops working.
+// # Return
+// - the plaintext download token
+// - ErrRecordNotFound if the export was mailed, downloaded or purged
+func (m ExportModel) Reissue(e *Export) (string, error) {
+	token, err := GenerateToken(e.UserID, ExportTTL, "")
+	if err != nil {
+		return "", err
+	}
+
+	query := `UPDATE exports
+              SET expiry = $2, token_hash = $3
+              WHERE id = $1 AND status = $4 AND mailed_at IS NULL AND archive IS NOT NULL AND expiry > NOW()
+              RETURNING expiry`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, e.ID, token.Expiry, token.Hash, ExportReady).Scan(&e.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", validator.ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+	return token.Plaintext, nil
+}
+
+// / Record that the download link of the export was mailed.
+func (m ExportModel) MarkMailed(id int64) error {
+	query := `UPDATE exports SET mailed_at = NOW() WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// / Queue the exports that are still pending, or ready without a mailed
+// / link, again. Covers pushes that failed and exports interrupted by a
+// / restart, the worker skips exports that were finished meanwhile.
+// # Return
+// - the number of queued exports
+func (m ExportModel) RequeueUnfinished() (int, error) {
+	query := `SELECT id
+              FROM exports
+              WHERE status = $1
+              OR (status = $2 AND mailed_at IS NULL AND archive IS NOT NULL AND expiry > NOW())
+              ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, ExportPending, ExportReady)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var ids []any
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+		ids = append(ids, strconv.FormatInt(id, 10))
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	return len(ids), m.RDB.RPush(ctx, ExportQueue, ids...).Err()
+}
+
+// / Mark a pending export as failed.
+func (m ExportModel) Fail(id int64) error {
+	query := `UPDATE exports SET status = $2, completed_at = NOW() WHERE id = $1 AND status = $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, ExportFailed, ExportPending)
+	return err
+}
+
+// / Hand out the archive of the download token. The token works until the
+// / link expires rather than once, so a mail scanner opening the link
+// / doesn't use it up, the archive is dropped by PurgeExpired.
+// # Return
+// - the export, marked downloaded, and its archive
+// - ErrRecordNotFound if the token is unknown or expired
+func (m ExportModel) Download(tokenPlainText string) (*Export, []byte, error) {
+	query := `UPDATE exports
+              SET status = $2
+              WHERE token_hash = $1 AND status IN ($2, $3) AND archive IS NOT NULL AND expiry > NOW()
+              RETURNING id, user_id, created_at, status, completed_at, expiry, size, mailed_at, archive`
+
+	args := []any{HashToken(tokenPlainText), ExportDownloaded, ExportReady}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var (
+		e       Export
+		archive []byte
+	)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&e.ID,
+		&e.UserID,
+		&e.CreatedAt,
+		&e.Status,
+		&e.CompletedAt,
+		&e.Expiry,
+		&e.Size,
+		&e.MailedAt,
+		&archive,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, validator.ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	return &e, archive, nil
+}
+
+// / Drop the archives of exports whose download link expired.
+func (m ExportModel) PurgeExpired(now time.Time) (int64, error) {
+	query := `UPDATE exports
+              SET archive = NULL, token_hash = NULL
+              WHERE archive IS NOT NULL AND expiry <= $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func scanExport(row rowScanner) (*Export, error) {
+	var e Export
+	err := row.Scan(
+		&e.ID,
+		&e.UserID,
+		&e.CreatedAt,
+		&e.Status,
+		&e.CompletedAt,
+		&e.Expiry,
+		&e.Size,
+		&e.MailedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
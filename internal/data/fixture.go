@@ -0,0 +1,358 @@
+package data
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / FixtureProvider implements MarketDataProvider from files on disk so the
+// / API and the PNL worker can run without network access. The directory
+// / layout is:
+// /
+// /	markets.json      array of CoinMarketData (CoinGecko /coins/markets shape)
+// /	markets.csv       optional, id,symbol,name,current_price,market_cap,
+// /	                  market_cap_rank,price_change_24h,circulating_supply,
+// /	                  max_supply,ath
+// /	rates.json        optional, units of a currency per USD {"eur": 0.92}
+// /	paths/<id>.csv    optional scripted price path of a coin with the
+// /	                  header "after,price", after is a Go duration counted
+// /	                  from the start of the provider (0s, 10m, 1h30m)
+// /
+// / Prices are quoted in USD. When a coin has a path, the last point whose
+// / offset has elapsed replaces the fixture price. The price history replays
+// / the same path, before the start of the provider it is the fixture price.
+type FixtureProvider struct {
+	markets []CoinMarketData
+	rates   ExchangeRates
+	paths   map[string][]pricePoint
+	start   time.Time
+	now     func() time.Time
+}
+
+type pricePoint struct {
+	after time.Duration
+	price float64
+}
+
+// / Load the fixture directory, at least one of markets.json or markets.csv
+// / must exist.
+func NewFixtureProvider(dir string) (*FixtureProvider, error) {
+	p := &FixtureProvider{
+		rates: ExchangeRates{BaseCurrency: 1},
+		paths: make(map[string][]pricePoint),
+		start: time.Now(),
+		now:   time.Now,
+	}
+
+	found := false
+
+	jsonMarkets, err := loadFixtureMarketsJSON(filepath.Join(dir, "markets.json"))
+	switch {
+	case err == nil:
+		p.markets = append(p.markets, jsonMarkets...)
+		found = true
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	csvMarkets, err := loadFixtureMarketsCSV(filepath.Join(dir, "markets.csv"))
+	switch {
+	case err == nil:
+		p.markets = append(p.markets, csvMarkets...)
+		found = true
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	if !found {
+		return nil, fmt.Errorf("fixture directory %s has no markets.json or markets.csv", dir)
+	}
+
+	err = loadFixtureRates(filepath.Join(dir, "rates.json"), p.rates)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "paths", "*.csv"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		points, err := loadFixturePath(file)
+		if err != nil {
+			return nil, err
+		}
+		coinID := strings.TrimSuffix(filepath.Base(file), ".csv")
+		p.paths[coinID] = points
+	}
+
+	return p, nil
+}
+
+func (p *FixtureProvider) GetCoinMarkets(currency string, filters Filters) ([]CoinMarketData, error) {
+	rate, err := p.rates.Rate(currency)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids map[string]bool
+	if filters.Ids != "" {
+		ids = make(map[string]bool)
+		for _, id := range strings.Split(filters.Ids, ",") {
+			ids[strings.TrimSpace(id)] = true
+		}
+	}
+
+	coins := []CoinMarketData{}
+	for _, m := range p.markets {
+		if ids != nil && !ids[m.ID] {
+			continue
+		}
+		m = p.valued(m)
+		m.Convert(rate)
+		coins = append(coins, m)
+	}
+
+	switch filters.Order {
+	case "market_cap_asc":
+		sort.SliceStable(coins, func(i, j int) bool { return coins[i].MarketCap < coins[j].MarketCap })
+	case "id_asc":
+		sort.SliceStable(coins, func(i, j int) bool { return coins[i].ID < coins[j].ID })
+	case "id_desc":
+		sort.SliceStable(coins, func(i, j int) bool { return coins[i].ID > coins[j].ID })
+	default:
+		sort.SliceStable(coins, func(i, j int) bool { return coins[i].MarketCap > coins[j].MarketCap })
+	}
+
+	if filters.PerPage > 0 {
+		offset := max(filters.Page-1, 0) * filters.PerPage
+		if offset >= len(coins) {
+			return []CoinMarketData{}, nil
+		}
+		coins = coins[offset:min(offset+filters.PerPage, len(coins))]
+	}
+
+	return coins, nil
+}
+
+func (p *FixtureProvider) GetCoinCurrentPriceAndSymbol(coinID string) (float64, string, error) {
+	m, ok := p.market(coinID)
+	if !ok {
+		return 0, "", validator.ErrRecordNotFound
+	}
+	return p.price(m), m.Symbol, nil
+}
+
+func (p *FixtureProvider) GetPriceHistory(coinID string, from, to time.Time) ([]PriceSample, error) {
+	m, ok := p.market(coinID)
+	if !ok {
+		return nil, validator.ErrRecordNotFound
+	}
+
+	step := time.Hour
+	if to.Sub(from) > hourlyHistoryLimit {
+		step = 24 * time.Hour
+	}
+
+	samples := []PriceSample{}
+	for t := from.Truncate(step); !t.After(to); t = t.Add(step) {
+		if t.Before(from) {
+			continue
+		}
+		samples = append(samples, PriceSample{Time: t.UTC(), Price: p.priceAt(m, t)})
+	}
+	return samples, nil
+}
+
+// / Case-insensitive substring search on id, symbol and name.
+func (p *FixtureProvider) LookupCoins(query string) ([]CoinInfo, error) {
+	query = strings.ToLower(query)
+
+	coins := []CoinInfo{}
+	for _, m := range p.markets {
+		if strings.Contains(m.ID, query) ||
+			strings.Contains(strings.ToLower(m.Symbol), query) ||
+			strings.Contains(strings.ToLower(m.Name), query) {
+			coins = append(coins, CoinInfo{ID: m.ID, Symbol: m.Symbol, Name: m.Name})
+		}
+	}
+	return coins, nil
+}
+
+func (p *FixtureProvider) GetExchangeRates() (ExchangeRates, error) {
+	return p.rates, nil
+}
+
+func (p *FixtureProvider) market(coinID string) (CoinMarketData, bool) {
+	for _, m := range p.markets {
+		if m.ID == coinID {
+			return m, true
+		}
+	}
+	return CoinMarketData{}, false
+}
+
+// / Fixture price of the coin, or the scripted price at the current offset.
+func (p *FixtureProvider) price(m CoinMarketData) float64 {
+	return p.priceAt(m, p.now())
+}
+
+func (p *FixtureProvider) priceAt(m CoinMarketData, at time.Time) float64 {
+	points, ok := p.paths[m.ID]
+	if !ok {
+		return m.CurrentPrice
+	}
+
+	elapsed := at.Sub(p.start)
+	price := m.CurrentPrice
+	for _, point := range points {
+		if point.after > elapsed {
+			break
+		}
+		price = point.price
+	}
+	return price
+}
+
+func (p *FixtureProvider) valued(m CoinMarketData) CoinMarketData {
+	price := p.price(m)
+	if m.CurrentPrice > 0 && price != m.CurrentPrice {
+		m.MarketCap *= price / m.CurrentPrice
+	}
+	m.CurrentPrice = price
+	m.LastUpdated = p.now().UTC().Format(time.RFC3339)
+	return m
+}
+
+func loadFixtureMarketsJSON(file string) ([]CoinMarketData, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var markets []CoinMarketData
+	if err := json.NewDecoder(f).Decode(&markets); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", file, err)
+	}
+	return markets, nil
+}
+
+func loadFixtureRates(file string, rates ExchangeRates) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var loaded map[string]float64
+	if err := json.NewDecoder(f).Decode(&loaded); err != nil {
+		return fmt.Errorf("decoding %s: %w", file, err)
+	}
+	for code, rate := range loaded {
+		rates[strings.ToLower(code)] = rate
+	}
+	return nil
+}
+
+func loadFixtureMarketsCSV(file string) ([]CoinMarketData, error) {
+	records, err := readFixtureCSV(file)
+	if err != nil {
+		return nil, err
+	}
+
+	markets := []CoinMarketData{}
+	for i, rec := range records {
+		if len(rec) < 4 {
+			return nil, fmt.Errorf("%s line %d: expected at least id,symbol,name,current_price", file, i+2)
+		}
+
+		m := CoinMarketData{ID: rec[0], Symbol: strings.ToLower(rec[1]), Name: rec[2]}
+
+		numbers := []*float64{
+			&m.CurrentPrice,
+			&m.MarketCap,
+			nil,
+			&m.PriceChange24h,
+			&m.CirculatingSupply,
+			&m.MaxSupply,
+			&m.ATH,
+		}
+		for j, dest := range numbers {
+			col := 3 + j
+			if col >= len(rec) || rec[col] == "" {
+				continue
+			}
+			f, err := strconv.ParseFloat(rec[col], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d column %d: %w", file, i+2, col+1, err)
+			}
+			if dest == nil {
+				m.MarketCapRank = int64(f)
+				continue
+			}
+			*dest = f
+		}
+		markets = append(markets, m)
+	}
+	return markets, nil
+}
+
+func loadFixturePath(file string) ([]pricePoint, error) {
+	records, err := readFixtureCSV(file)
+	if err != nil {
+		return nil, err
+	}
+
+	points := make([]pricePoint, 0, len(records))
+	for i, rec := range records {
+		if len(rec) < 2 {
+			return nil, fmt.Errorf("%s line %d: expected after,price", file, i+2)
+		}
+		after, err := time.ParseDuration(rec[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", file, i+2, err)
+		}
+		price, err := strconv.ParseFloat(rec[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", file, i+2, err)
+		}
+		points = append(points, pricePoint{after: after, price: price})
+	}
+
+	sort.Slice(points, func(i, j int) bool { return points[i].after < points[j].after })
+	return points, nil
+}
+
+// / Read every record of a CSV file without its header line.
+func readFixtureCSV(file string) ([][]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	if _, err := r.Read(); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return r.ReadAll()
+}
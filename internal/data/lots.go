@@ -0,0 +1,252 @@
+package data
+
+import (
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+const (
+	CostBasisFIFO    = "fifo"
+	CostBasisLIFO    = "lifo"
+	CostBasisHIFO    = "hifo"
+	CostBasisAverage = "average"
+)
+
+var CostBasisMethods = []string{
+	CostBasisFIFO,
+	CostBasisLIFO,
+	CostBasisHIFO,
+	CostBasisAverage,
+}
+
+func ValidateCostBasisMethod(v *validator.Validator, method string) {
+	v.Check(
+		validator.PermittedValues(method, CostBasisMethods...),
+		"cost_basis_method",
+		"must be one of fifo, lifo, hifo, average",
+	)
+}
+
+// / A tax lot is the open remainder of a single acquisition
+// / (buy, transfer_in or airdrop).
+type Lot struct {
+	TransactionID    int64     `json:"transaction_id"`
+	AcquiredAt       time.Time `json:"acquired_at"`
+	OriginalQuantity float64   `json:"original_quantity"`
+	Quantity         float64   `json:"quantity"`
+	UnitCost         float64   `json:"unit_cost"`
+	CostBasis        float64   `json:"cost_basis"`
+	UnrealizedPNL    float64   `json:"unrealized_pnl"`
+}
+
+// / A disposal is the part of a sell (or coin fee) matched against one lot.
+type Disposal struct {
+	TransactionID    int64     `json:"transaction_id"`
+	LotTransactionID int64     `json:"lot_transaction_id"`
+	CoinID           string    `json:"coin_id"`
+	Type             string    `json:"type"`
+	AcquiredAt       time.Time `json:"acquired_at"`
+	DisposedAt       time.Time `json:"disposed_at"`
+	Quantity         float64   `json:"quantity"`
+	Proceeds         float64   `json:"proceeds"`
+	CostBasis        float64   `json:"cost_basis"`
+	Gain             float64   `json:"gain"`
+}
+
+// / OversellError is the ErrInsufficientHoldings of BuildLots, naming the
+// / entry that disposes more than is held at its execution.
+type OversellError struct {
+	Transaction *Transaction
+}
+
+func (e *OversellError) Error() string {
+	return validator.ErrInsufficientHoldings.Error()
+}
+
+func (e *OversellError) Unwrap() error {
+	return validator.ErrInsufficientHoldings
+}
+
+// / LotBook is the result of replaying a coin ledger with a cost-basis method.
+type LotBook struct {
+	Method      string
+	Lots        []*Lot
+	Disposals   []*Disposal
+	RealizedPNL float64
+
+	// Parts of the transfers out matched against lots, the basis they move
+	// out of the portfolio. They realize nothing.
+	Transfers []*Disposal
+}
+
+// / BuildLots replays the ledger of a single coin in execution order.
+// / Acquisitions open lots costing quantity * price + fee, converted to USD
+// / with the FX rate stored on the transaction. Disposals consume
+// / open lots in the order given by the method:
+// / - fifo: oldest lot first
+// / - lifo: newest lot first
+// / - hifo: highest unit cost first
+// / - average: every open lot pro rata, which keeps the average cost unchanged
+// /
+// / Sells realize proceeds (quantity * price - fee) minus the consumed basis.
+// / Coin fees are disposals without proceeds. Transfers out move the basis
+// / out of the portfolio without realizing anything, except their fee, the
+// / lots they take are recorded in Transfers.
+// # Return
+// - an OversellError, which is ErrInsufficientHoldings, if the ledger
+// disposes more than it holds
+func BuildLots(txs []*Transaction, method string) (*LotBook, error) {
+	book := &LotBook{Method: method, Lots: []*Lot{}, Disposals: []*Disposal{}, Transfers: []*Disposal{}}
+
+	for _, t := range txs {
+		if t.Increases() {
+			cost := t.Quantity*t.PriceUSD() + t.FeeUSD()
+			book.Lots = append(book.Lots, &Lot{
+				TransactionID:    t.ID,
+				AcquiredAt:       t.ExecutedAt,
+				OriginalQuantity: t.Quantity,
+				Quantity:         t.Quantity,
+				UnitCost:         cost / t.Quantity,
+				CostBasis:        cost,
+			})
+			continue
+		}
+
+		if t.Quantity > book.amount()+quantityEpsilon {
+			return nil, &OversellError{Transaction: t}
+		}
+
+		proceeds := 0.0
+		if t.Type == TransactionSell {
+			proceeds = t.Quantity*t.PriceUSD() - t.FeeUSD()
+		}
+
+		for _, c := range book.consume(t.Quantity) {
+			share := c.quantity / t.Quantity
+			d := &Disposal{
+				TransactionID:    t.ID,
+				LotTransactionID: c.lot.TransactionID,
+				CoinID:           t.CoinID,
+				Type:             t.Type,
+				AcquiredAt:       c.lot.AcquiredAt,
+				DisposedAt:       t.ExecutedAt,
+				Quantity:         c.quantity,
+				Proceeds:         proceeds * share,
+				CostBasis:        c.cost,
+			}
+			if t.Type == TransactionTransferOut {
+				book.Transfers = append(book.Transfers, d)
+				continue
+			}
+			if t.Type == TransactionFee {
+				d.CostBasis += t.FeeUSD() * share
+			}
+			d.Gain = d.Proceeds - d.CostBasis
+			book.Disposals = append(book.Disposals, d)
+			book.RealizedPNL += d.Gain
+		}
+
+		if t.Type == TransactionTransferOut {
+			book.RealizedPNL -= t.FeeUSD()
+		}
+	}
+
+	return book, nil
+}
+
+type consumption struct {
+	lot      *Lot
+	quantity float64
+	cost     float64
+}
+
+func (b *LotBook) amount() float64 {
+	var amount float64
+	for _, l := range b.Lots {
+		amount += l.Quantity
+	}
+	return amount
+}
+
+func (b *LotBook) costBasis() float64 {
+	var cost float64
+	for _, l := range b.Lots {
+		cost += l.CostBasis
+	}
+	return cost
+}
+
+// / Take quantity out of the open lots according to the method and drop lots
+// / that are used up.
+func (b *LotBook) consume(quantity float64) []consumption {
+	var taken []consumption
+
+	if b.Method == CostBasisAverage {
+		total := b.amount()
+		for _, l := range b.Lots {
+			q := quantity * (l.Quantity / total)
+			taken = append(taken, b.take(l, q))
+		}
+	} else {
+		remaining := quantity
+		for remaining > quantityEpsilon {
+			l := b.next()
+			if l == nil {
+				break
+			}
+			q := min(remaining, l.Quantity)
+			taken = append(taken, b.take(l, q))
+			remaining -= q
+		}
+	}
+
+	open := b.Lots[:0]
+	for _, l := range b.Lots {
+		if l.Quantity > quantityEpsilon {
+			open = append(open, l)
+		}
+	}
+	b.Lots = open
+
+	return taken
+}
+
+func (b *LotBook) take(l *Lot, quantity float64) consumption {
+	quantity = min(quantity, l.Quantity)
+	cost := l.CostBasis * (quantity / l.Quantity)
+
+	l.Quantity -= quantity
+	l.CostBasis -= cost
+	if l.Quantity <= quantityEpsilon {
+		l.Quantity, l.CostBasis = 0, 0
+	}
+
+	return consumption{lot: l, quantity: quantity, cost: cost}
+}
+
+// / The next open lot to consume for fifo, lifo and hifo.
+func (b *LotBook) next() *Lot {
+	var pick *Lot
+	for _, l := range b.Lots {
+		if l.Quantity <= quantityEpsilon {
+			continue
+		}
+		switch {
+		case pick == nil:
+			pick = l
+		case b.Method == CostBasisLIFO:
+			pick = l
+		case b.Method == CostBasisHIFO && l.UnitCost > pick.UnitCost:
+			pick = l
+		}
+	}
+	return pick
+}
+
+// / Set unrealized PNL of every open lot at the given price.
+func (b *LotBook) Value(currentPrice float64) {
+	for _, l := range b.Lots {
+		l.UnrealizedPNL = l.Quantity*currentPrice - l.CostBasis
+	}
+}
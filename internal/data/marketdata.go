@@ -2,29 +2,62 @@ package data
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
-	"net/url"
-	"strconv"
 	"time"
 
 	"github.com/aalperen0/portfolio-tracker/internal/cache"
-	"github.com/aalperen0/portfolio-tracker/internal/validator"
 )
 
-type Client struct {
-	apiKey     string
-	baseURL    string
-	httpClient *http.Client
-	cache      *cache.Cache
+const (
+	ProviderCoinGecko = "coingecko"
+	ProviderCoinCap   = "coincap"
+	ProviderFixture   = "fixture"
+)
+
+// / MarketDataProvider is the source of prices and market listings. Handlers
+// / and workers depend on this interface so the provider can be switched
+// / through config when one of them rate-limits us.
+type MarketDataProvider interface {
+	// / Market listing in the given quote currency, ordered and paginated
+	// / by filters. Returns ErrInvalidCurrency for unsupported currencies.
+	GetCoinMarkets(currency string, filters Filters) ([]CoinMarketData, error)
+
+	// / Current USD price and ticker symbol of the coin.
+	// / Returns ErrRecordNotFound if the provider doesn't know the coin.
+	GetCoinCurrentPriceAndSymbol(coinID string) (float64, string, error)
+
+	// / Search coins by id, symbol or name.
+	LookupCoins(query string) ([]CoinInfo, error)
+
+	// / Units of each supported currency per USD, cached for an hour.
+	GetExchangeRates() (ExchangeRates, error)
+
+	// / USD price samples of the coin between from and to, hourly for
+	// / ranges up to 90 days and daily beyond. Returns ErrRecordNotFound if
+	// / the provider doesn't know the coin.
+	GetPriceHistory(coinID string, from, to time.Time) ([]PriceSample, error)
 }
 
+// / A price observation of the history endpoints. Volume is the trailing
+// / 24h volume in USD when the provider reports it.
+type PriceSample struct {
+	Time   time.Time
+	Price  float64
+	Volume float64
+}
+
+// / Ranges longer than this are sampled daily by the providers.
+const hourlyHistoryLimit = 90 * 24 * time.Hour
+
+// / Oldest history the providers serve on their free plans, backfills don't
+// / reach further back than this.
+const PriceHistoryLimit = 365 * 24 * time.Hour
+
 type CoinMarketData struct {
 	MarketCapRank     int64   `json:"market_cap_rank"`
 	Symbol            string  `json:"symbol"`
 	ID                string  `json:"id"`
+	Name              string  `json:"name"`
 	CurrentPrice      float64 `json:"current_price"`
 	MarketCap         float64 `json:"market_cap"`
 	PriceChange24h    float64 `json:"price_change_24h"`
@@ -34,152 +67,80 @@ type CoinMarketData struct {
 	LastUpdated       string  `json:"last_updated"`
 }
 
-func NewCoinClient(apiKey string, cache *cache.Cache) *Client {
-	return &Client{
-		apiKey:     apiKey,
-		baseURL:    "https://api.coingecko.com/api/v3",
-		httpClient: &http.Client{},
-		cache:      cache,
-	}
-}
-
-func (c *Client) GetCoinMarkets(
-	currency string,
-	filters Filters,
-) ([]CoinMarketData, error) {
-	query := url.Values{}
-
-	query.Add("vs_currency", currency)
-
-	if filters.Ids != "" {
-		query.Add("ids", filters.Ids)
-	}
-
-	if filters.Page > 0 {
-		query.Add("page", strconv.Itoa(filters.Page))
-	}
-	if filters.PerPage > 0 {
-		query.Add("per_page", strconv.Itoa(filters.PerPage))
-	}
-	if filters.Order != "" {
-		query.Add("order", filters.Order)
-	}
-
-	searchUrl := fmt.Sprintf("%s/coins/markets?%s", c.baseURL, query.Encode())
-
-	if len(query) > 0 {
-		searchUrl = fmt.Sprintf("%s&%s", searchUrl, query.Encode())
-	}
-
-	req, err := http.NewRequest("GET", searchUrl, nil)
-	if err != nil {
-		return nil, fmt.Errorf("creating request: %w", err)
-	}
-
-	req.Header.Add("accept", "application/json")
-	req.Header.Add("x-cg-demo-api-key", c.apiKey)
-
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("making request: %w", err)
-	}
-
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(res.Body)
-		return nil, fmt.Errorf("API ERROR (status %d): %s", res.StatusCode, string(body))
-	}
-
-	var coins []CoinMarketData
-	if err := json.NewDecoder(res.Body).Decode(&coins); err != nil {
-		return nil, fmt.Errorf("decoding response %w", err)
-	}
-	return coins, nil
+type CoinInfo struct {
+	ID     string `json:"id"`
+	Symbol string `json:"symbol"`
+	Name   string `json:"name"`
 }
 
-// ////////////////////////////////////////////
-
-// / If a coin stored in the cache, we retrieve coin price and coin symbol.
-// / Otherwise retrieve a coin from the CoinGecko api. If user retrieve a coin
-// / from the api, the function put the values to the cache for a 5 minute.
+// / Create the market data provider selected in config.
 // # Parameters
-// - coinID (string)
-// # Return
-// - price (float64)
-// - symbol(string)
-// - error(record not found)
-
-func (c *Client) GetCoinCurrentPriceAndSymbol(coinID string) (float64, string, error) {
-	ctx := context.Background()
-
-	if c.cache != nil {
-		cacheKey := "coin:price:" + coinID
-
-		type CachedData struct {
-			Price  float64 `json:"price"`
-			Symbol string  `json:"symbol"`
-		}
-
-		var cachedData CachedData
-		found, err := c.cache.Get(ctx, cacheKey, &cachedData)
-		if err == nil && found {
-			return cachedData.Price, cachedData.Symbol, nil
-		}
-
+// - provider: coingecko, coincap or fixture
+// - apiKey: key of the selected provider
+// - fixtureDir: directory of the fixture provider, unused by the others
+// - cache: price cache shared by the network providers
+func NewMarketDataProvider(
+	provider string,
+	apiKey string,
+	fixtureDir string,
+	cache *cache.Cache,
+) (MarketDataProvider, error) {
+	switch provider {
+	case ProviderCoinGecko, "":
+		return NewCoinGeckoClient(apiKey, cache), nil
+	case ProviderCoinCap:
+		return NewCoinCapClient(apiKey, cache), nil
+	case ProviderFixture:
+		return NewFixtureProvider(fixtureDir)
+	default:
+		return nil, fmt.Errorf("unknown market data provider %q", provider)
 	}
+}
 
-	url := fmt.Sprintf("%s/coins/%s", c.baseURL, coinID)
+type cachedPrice struct {
+	Price  float64 `json:"price"`
+	Symbol string  `json:"symbol"`
+}
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return 0, "", err
+// / Prices are cached for 5 minutes under coin:price:<id>, regardless of the
+// / provider that fetched them.
+func getCachedPrice(ctx context.Context, c *cache.Cache, coinID string) (float64, string, bool) {
+	if c == nil {
+		return 0, "", false
 	}
 
-	req.Header.Add("accept", "application/json")
-	req.Header.Add("x-cg-demo-api-key", c.apiKey)
-
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return 0, "", err
+	var cached cachedPrice
+	found, err := c.Get(ctx, "coin:price:"+coinID, &cached)
+	if err != nil || !found {
+		return 0, "", false
 	}
-	defer res.Body.Close()
+	return cached.Price, cached.Symbol, true
+}
 
-	if res.StatusCode != http.StatusOK {
-		// return 0, "", fmt.Errorf("failed to get coin data: status %d", res.StatusCode)
-		return 0, "", validator.ErrRecordNotFound
+func setCachedPrice(ctx context.Context, c *cache.Cache, coinID string, price float64, symbol string) error {
+	if c == nil {
+		return nil
 	}
+	return c.Set(ctx, "coin:price:"+coinID, cachedPrice{Price: price, Symbol: symbol}, 5*time.Minute)
+}
 
-	var response struct {
-		Symbol     string `json:"symbol"`
-		MarketData struct {
-			CurrentPrice struct {
-				USD float64 `json:"usd"`
-			} `json:"current_price"`
-		} `json:"market_data"`
+// / FX rates are cached for an hour under fx:rates.
+func getCachedRates(ctx context.Context, c *cache.Cache) (ExchangeRates, bool) {
+	if c == nil {
+		return nil, false
 	}
 
-	err = json.NewDecoder(res.Body).Decode(&response)
-	if err != nil {
-		return 0, "", err
+	var rates ExchangeRates
+	found, err := c.Get(ctx, "fx:rates", &rates)
+	if err != nil || !found {
+		return nil, false
 	}
+	return rates, true
+}
 
-	price := response.MarketData.CurrentPrice.USD
-	symbol := response.Symbol
-
-	if c.cache != nil {
-		cachedData := struct {
-			Price  float64 `json:"price"`
-			Symbol string  `json:"symbol"`
-		}{
-			Price:  price,
-			Symbol: symbol,
-		}
-		err := c.cache.Set(ctx, "coin:price:"+coinID, cachedData, 5*time.Minute)
-		if err != nil {
-			return 0, "", err
-		}
+func setCachedRates(ctx context.Context, c *cache.Cache, rates ExchangeRates) error {
+	if c == nil {
+		return nil
 	}
-
-	return price, symbol, nil
+	return c.Set(ctx, "fx:rates", rates, time.Hour)
 }
@@ -0,0 +1,221 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / Name of the portfolio every user gets. The unscoped /v1/users/coins
+// / endpoints work against it.
+const DefaultPortfolioName = "Default"
+
+// / Names tried for the default portfolio before giving up.
+const maxDefaultPortfolioAttempts = 10
+
+type PortfolioModel struct {
+	DB *sql.DB
+}
+
+type Portfolio struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+	IsDefault bool      `json:"is_default"`
+	Archived  bool      `json:"archived"`
+	Version   int       `json:"version"`
+}
+
+func ValidatePortfolio(v *validator.Validator, p *Portfolio) {
+	v.Check(p.Name != "", "name", "must be provided")
+	v.Check(len(p.Name) <= 100, "name", "must not be more than 100 bytes")
+	v.Check(!(p.IsDefault && p.Archived), "archived", "the default portfolio can't be archived")
+}
+
+func (m PortfolioModel) Insert(p *Portfolio) error {
+	query := `INSERT INTO portfolios(user_id, name, is_default)
+              VALUES($1, $2, $3)
+              RETURNING id, created_at, archived, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, p.UserID, p.Name, p.IsDefault).
+		Scan(&p.ID, &p.CreatedAt, &p.Archived, &p.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "portfolios_user_id_name_key"`:
+			return validator.ErrDuplicatePortfolio
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// / Retrieve a portfolio of the user by id.
+func (m PortfolioModel) Get(id, userID int64) (*Portfolio, error) {
+	if id < 1 {
+		return nil, validator.ErrRecordNotFound
+	}
+
+	query := `SELECT id, user_id, created_at, name, is_default, archived, version
+              FROM portfolios
+              WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanPortfolio(m.DB.QueryRowContext(ctx, query, id, userID))
+}
+
+// / Retrieve the default portfolio of the user, creating it for users that
+// / don't have one yet. Concurrent first requests race on the insert, the
+// / loser reads the portfolio of the winner. If the user already named a
+// / portfolio "Default" the new one is called "Default 2" and so on.
+func (m PortfolioModel) GetDefault(userID int64) (*Portfolio, error) {
+	query := `SELECT id, user_id, created_at, name, is_default, archived, version
+              FROM portfolios
+              WHERE user_id = $1 AND is_default`
+
+	insert := `INSERT INTO portfolios(user_id, name, is_default)
+               VALUES($1, $2, true)
+               ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	for i := 1; ; i++ {
+		p, err := scanPortfolio(m.DB.QueryRowContext(ctx, query, userID))
+		if err == nil || !errors.Is(err, validator.ErrRecordNotFound) {
+			return p, err
+		}
+		if i > maxDefaultPortfolioAttempts {
+			return nil, fmt.Errorf("no free name for the default portfolio of user %d", userID)
+		}
+
+		name := DefaultPortfolioName
+		if i > 1 {
+			name = fmt.Sprintf("%s %d", DefaultPortfolioName, i)
+		}
+		if _, err := m.DB.ExecContext(ctx, insert, userID, name); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// / List the portfolios of the user, the default portfolio first.
+func (m PortfolioModel) GetAllForUser(userID int64, includeArchived bool) ([]*Portfolio, error) {
+	query := `SELECT id, user_id, created_at, name, is_default, archived, version
+              FROM portfolios
+              WHERE user_id = $1 AND (NOT archived OR $2)
+              ORDER BY is_default DESC, name ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, includeArchived)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	portfolios := []*Portfolio{}
+	for rows.Next() {
+		p, err := scanPortfolio(rows)
+		if err != nil {
+			return nil, err
+		}
+		portfolios = append(portfolios, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return portfolios, nil
+}
+
+// / Rename or (un)archive a portfolio with optimistic locking on version.
+func (m PortfolioModel) Update(p *Portfolio) error {
+	query := `UPDATE portfolios
+              SET name = $1, archived = $2, version = version + 1
+              WHERE id = $3 AND user_id = $4 AND version = $5
+              RETURNING version`
+
+	args := []any{p.Name, p.Archived, p.ID, p.UserID, p.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&p.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "portfolios_user_id_name_key"`:
+			return validator.ErrDuplicatePortfolio
+		case errors.Is(err, sql.ErrNoRows):
+			return validator.ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// / Delete a portfolio together with its holdings and ledger. The default
+// / portfolio can't be deleted.
+func (m PortfolioModel) Delete(id, userID int64) error {
+	if id < 1 {
+		return validator.ErrRecordNotFound
+	}
+
+	query := `DELETE FROM portfolios WHERE id = $1 AND user_id = $2 AND NOT is_default`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return validator.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPortfolio(row rowScanner) (*Portfolio, error) {
+	var p Portfolio
+	err := row.Scan(
+		&p.ID,
+		&p.UserID,
+		&p.CreatedAt,
+		&p.Name,
+		&p.IsDefault,
+		&p.Archived,
+		&p.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, validator.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &p, nil
+}
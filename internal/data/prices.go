@@ -0,0 +1,277 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / Candle intervals of the price history and their length.
+var CandleIntervals = map[string]time.Duration{
+	"1h": time.Hour,
+	"1d": 24 * time.Hour,
+}
+
+type PriceHistoryModel struct {
+	DB *sql.DB
+}
+
+// / OHLC candle of a coin in USD. Bucket is the open time of the interval,
+// / volume the trailing 24h volume at the close when the provider has it.
+type Candle struct {
+	Bucket time.Time `json:"time"`
+	Open   float64   `json:"open"`
+	High   float64   `json:"high"`
+	Low    float64   `json:"low"`
+	Close  float64   `json:"close"`
+	Volume float64   `json:"volume"`
+}
+
+func (c *Candle) Convert(rate float64) {
+	c.Open *= rate
+	c.High *= rate
+	c.Low *= rate
+	c.Close *= rate
+	c.Volume *= rate
+}
+
+func ValidateCandleInterval(v *validator.Validator, interval string) {
+	_, ok := CandleIntervals[interval]
+	v.Check(ok, "interval", "must be one of 1h, 1d")
+}
+
+// / BuildCandles groups price samples into OHLC candles of the interval.
+// # Parameters
+// - samples: price samples in ascending time
+// - interval: 1h or 1d
+// # Return
+// - candles in ascending time, UTC aligned
+func BuildCandles(samples []PriceSample, interval string) []*Candle {
+	length := CandleIntervals[interval]
+	candles := []*Candle{}
+
+	var current *Candle
+	for _, s := range samples {
+		bucket := s.Time.UTC().Truncate(length)
+		if current == nil || !current.Bucket.Equal(bucket) {
+			current = &Candle{Bucket: bucket, Open: s.Price, High: s.Price, Low: s.Price}
+			candles = append(candles, current)
+		}
+		current.High = max(current.High, s.Price)
+		current.Low = min(current.Low, s.Price)
+		current.Close = s.Price
+		current.Volume = s.Volume
+	}
+	return candles
+}
+
+// / Insert or replace the candles of the coin in a single statement.
+func (m PriceHistoryModel) Upsert(coinID, interval string, candles []*Candle) error {
+	if len(candles) == 0 {
+		return nil
+	}
+
+	buckets := make([]time.Time, len(candles))
+	opens := make([]float64, len(candles))
+	highs := make([]float64, len(candles))
+	lows := make([]float64, len(candles))
+	closes := make([]float64, len(candles))
+	volumes := make([]float64, len(candles))
+	for i, c := range candles {
+		buckets[i] = c.Bucket
+		opens[i] = c.Open
+		highs[i] = c.High
+		lows[i] = c.Low
+		closes[i] = c.Close
+		volumes[i] = c.Volume
+	}
+
+	query := `INSERT INTO price_history(coin_id, interval, bucket, open, high, low, close, volume)
+              SELECT $1, $2, *
+              FROM unnest($3::timestamptz[], $4::double precision[], $5::double precision[],
+                          $6::double precision[], $7::double precision[], $8::double precision[])
+              ON CONFLICT (coin_id, interval, bucket) DO UPDATE
+              SET open = EXCLUDED.open,
+                  high = EXCLUDED.high,
+                  low = EXCLUDED.low,
+                  close = EXCLUDED.close,
+                  volume = EXCLUDED.volume`
+
+	args := []any{
+		coinID,
+		interval,
+		pq.Array(buckets),
+		pq.Array(opens),
+		pq.Array(highs),
+		pq.Array(lows),
+		pq.Array(closes),
+		pq.Array(volumes),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// / Merge a live price into the current candle of every interval: the first
+// / price of a bucket opens it, later ones move high, low and close.
+func (m PriceHistoryModel) Record(coinID string, price float64, at time.Time) error {
+	query := `INSERT INTO price_history(coin_id, interval, bucket, open, high, low, close)
+              VALUES($1, $2, $3, $4, $4, $4, $4)
+              ON CONFLICT (coin_id, interval, bucket) DO UPDATE
+              SET high = GREATEST(price_history.high, EXCLUDED.high),
+                  low = LEAST(price_history.low, EXCLUDED.low),
+                  close = EXCLUDED.close`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for interval, length := range CandleIntervals {
+		bucket := at.UTC().Truncate(length)
+		if _, err := m.DB.ExecContext(ctx, query, coinID, interval, bucket, price); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// / Candles of the coin with from <= bucket < to in ascending time.
+func (m PriceHistoryModel) GetForCoin(coinID, interval string, from, to time.Time) ([]*Candle, error) {
+	query := `SELECT bucket, open, high, low, close, volume
+              FROM price_history
+              WHERE coin_id = $1 AND interval = $2 AND bucket >= $3 AND bucket < $4
+              ORDER BY bucket ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, coinID, interval, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candles := []*Candle{}
+
+	for rows.Next() {
+		var c Candle
+		err := rows.Scan(&c.Bucket, &c.Open, &c.High, &c.Low, &c.Close, &c.Volume)
+		if err != nil {
+			return nil, err
+		}
+		candles = append(candles, &c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return candles, nil
+}
+
+// / Daily closes of the coins between from and to, keyed by coin id and the
+// / UTC day of the candle.
+func (m PriceHistoryModel) DailyCloses(
+	coinIDs []string,
+	from, to time.Time,
+) (map[string]map[time.Time]float64, error) {
+	query := `SELECT coin_id, bucket, close
+              FROM price_history
+              WHERE coin_id = ANY($1) AND interval = '1d' AND bucket >= $2 AND bucket < $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(coinIDs), from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	closes := make(map[string]map[time.Time]float64, len(coinIDs))
+
+	for rows.Next() {
+		var (
+			coinID string
+			bucket time.Time
+			price  float64
+		)
+		if err := rows.Scan(&coinID, &bucket, &price); err != nil {
+			return nil, err
+		}
+		if closes[coinID] == nil {
+			closes[coinID] = make(map[time.Time]float64)
+		}
+		closes[coinID][bucket.UTC()] = price
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return closes, nil
+}
+
+// / USD price of the coin at a past time: the close of the latest candle
+// / opened at or before it, hourly candles preferred over daily ones.
+// # Return
+// - ErrRecordNotFound if there is no candle in the two days before
+func (m PriceHistoryModel) PriceAt(coinID string, at time.Time) (float64, error) {
+	query := `SELECT close
+              FROM price_history
+              WHERE coin_id = $1 AND bucket <= $2 AND bucket > $2 - INTERVAL '2 days'
+              ORDER BY bucket DESC, interval = '1h' DESC
+              LIMIT 1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var price float64
+	err := m.DB.QueryRowContext(ctx, query, coinID, at).Scan(&price)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, validator.ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return price, nil
+}
+
+// / Backfill the price history of the coin from the market data provider:
+// / daily candles for the whole range and hourly candles for the most recent
+// / 90 days of it, the finest granularity the providers keep.
+// # Return
+// - ErrRecordNotFound if the provider doesn't know the coin
+func (m PriceHistoryModel) Backfill(client MarketDataProvider, coinID string, from, to time.Time) error {
+	samples, err := client.GetPriceHistory(coinID, from, to)
+	if err != nil {
+		return err
+	}
+	if to.Sub(from) <= hourlyHistoryLimit {
+		return m.backfillIntervals(coinID, samples, "1h", "1d")
+	}
+
+	if err := m.backfillIntervals(coinID, samples, "1d"); err != nil {
+		return err
+	}
+
+	hourly, err := client.GetPriceHistory(coinID, to.Add(-hourlyHistoryLimit), to)
+	if err != nil {
+		return err
+	}
+	return m.backfillIntervals(coinID, hourly, "1h")
+}
+
+func (m PriceHistoryModel) backfillIntervals(coinID string, samples []PriceSample, intervals ...string) error {
+	for _, interval := range intervals {
+		if err := m.Upsert(coinID, interval, BuildCandles(samples, interval)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+const (
+	RoleUser    = "user"
+	RoleAdmin   = "admin"
+	RoleSupport = "support"
+)
+
+var Roles = []string{RoleUser, RoleAdmin, RoleSupport}
+
+// / Permissions of the admin endpoints. Support staff can look, only admins
+// / can change accounts.
+const (
+	PermissionAdminRead  = "admin:read"
+	PermissionAdminWrite = "admin:write"
+)
+
+var rolePermissions = map[string][]string{
+	RoleUser:    {},
+	RoleSupport: {PermissionAdminRead},
+	RoleAdmin:   {PermissionAdminRead, PermissionAdminWrite},
+}
+
+func ValidateRole(v *validator.Validator, role string) {
+	v.Check(validator.PermittedValues(role, Roles...), "role", "must be one of user, admin, support")
+}
+
+// / Can reports whether the role of the user grants the permission.
+func (u *User) Can(permission string) bool {
+	for _, p := range rolePermissions[u.Role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// / Give the user with the email a role, used to bootstrap the first admin
+// / from config.
+// # Return
+// - ErrRecordNotFound if there is no user with the email
+func (m UserModel) SetRoleByEmail(email, role string) error {
+	query := `UPDATE users SET role = $1, version = version + 1 WHERE email = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, role, email)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return validator.ErrRecordNotFound
+	}
+	return nil
+}
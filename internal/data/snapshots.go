@@ -0,0 +1,221 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / Downsampling intervals of the value history and the matching
+// / date_trunc field.
+var SnapshotIntervals = map[string]string{
+	"1h": "hour",
+	"1d": "day",
+	"1w": "week",
+}
+
+type SnapshotModel struct {
+	DB *sql.DB
+}
+
+// / A point of the value history, money fields are in USD until converted.
+// / Amount and price are only set for the history of a single coin.
+type Snapshot struct {
+	TakenAt       time.Time `json:"taken_at"`
+	Amount        float64   `json:"amount,omitempty"`
+	Price         float64   `json:"price,omitempty"`
+	Value         float64   `json:"value"`
+	Cost          float64   `json:"cost"`
+	UnrealizedPNL float64   `json:"unrealized_pnl"`
+	RealizedPNL   float64   `json:"realized_pnl"`
+}
+
+// / Query of the value history endpoint.
+type SnapshotFilters struct {
+	From        time.Time
+	To          time.Time
+	Interval    string
+	PortfolioID int64
+	CoinID      string
+}
+
+func ValidateSnapshotFilters(v *validator.Validator, f SnapshotFilters) {
+	_, ok := SnapshotIntervals[f.Interval]
+	v.Check(ok, "interval", "must be one of 1h, 1d, 1w")
+	v.Check(f.From.Before(f.To), "from", "must be before to")
+	if f.Interval == "1h" {
+		v.Check(f.To.Sub(f.From) <= 90*24*time.Hour, "from", "hourly history is limited to 90 days")
+	}
+}
+
+func (s *Snapshot) Convert(rate float64) {
+	s.Price *= rate
+	s.Value *= rate
+	s.Cost *= rate
+	s.UnrealizedPNL *= rate
+	s.RealizedPNL *= rate
+}
+
+// / Record a snapshot of every holding in a non-archived portfolio and the
+// / per-user totals at takenAt in one statement. Holdings of coins missing
+// / from prices fall back to the price implied by their last PNL update.
+// / Writing the same takenAt again, after a restart or a retry, is a no-op.
+// # Parameters
+// - prices: current USD price per coin id
+// - takenAt: time of the snapshot
+func (m SnapshotModel) Insert(prices map[string]float64, takenAt time.Time) error {
+	coinIDs := make([]string, 0, len(prices))
+	values := make([]float64, 0, len(prices))
+	for coinID, price := range prices {
+		coinIDs = append(coinIDs, coinID)
+		values = append(values, price)
+	}
+
+	query := `WITH prices AS (
+                  SELECT * FROM unnest($1::text[], $2::double precision[]) AS p(coin_id, price)
+              ), valued AS (
+                  SELECT coins.user_id, coins.portfolio_id, coins.coin_id, coins.amount, coins.total_cost,
+                         coins.realized_pnl,
+                         COALESCE(
+                             prices.price,
+                             CASE WHEN coins.amount > 0 THEN (coins.pnl + coins.total_cost) / coins.amount
+                             ELSE 0 END
+                         ) AS price
+                  FROM coins
+                  JOIN portfolios ON portfolios.id = coins.portfolio_id
+                  LEFT JOIN prices ON prices.coin_id = coins.coin_id
+                  WHERE NOT portfolios.archived
+              ), holdings AS (
+                  INSERT INTO holding_snapshots(user_id, portfolio_id, coin_id, taken_at, amount, price, value,
+                              cost, unrealized_pnl, realized_pnl)
+                  SELECT user_id, portfolio_id, coin_id, $3, amount, price, amount * price,
+                         total_cost, amount * price - total_cost, realized_pnl
+                  FROM valued
+                  ON CONFLICT (portfolio_id, coin_id, taken_at) DO NOTHING
+                  RETURNING user_id, value, cost, unrealized_pnl, realized_pnl
+              )
+              INSERT INTO portfolio_snapshots(user_id, taken_at, value, cost, unrealized_pnl, realized_pnl)
+              SELECT user_id, $3, SUM(value), SUM(cost), SUM(unrealized_pnl), SUM(realized_pnl)
+              FROM holdings
+              GROUP BY user_id
+              ON CONFLICT (user_id, taken_at) DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, pq.Array(coinIDs), pq.Array(values), takenAt)
+	return err
+}
+
+// / Downsample the snapshots taken before the time to the last snapshot of
+// / each day, the finest interval the history serves for that range.
+// # Return
+// - number of deleted portfolio and holding snapshots
+func (m SnapshotModel) Downsample(before time.Time) (int64, error) {
+	queries := []string{
+		`DELETE FROM portfolio_snapshots s
+         WHERE s.taken_at < $1 AND EXISTS (
+             SELECT 1 FROM portfolio_snapshots later
+             WHERE later.user_id = s.user_id
+             AND date_trunc('day', later.taken_at) = date_trunc('day', s.taken_at)
+             AND later.taken_at > s.taken_at
+         )`,
+		`DELETE FROM holding_snapshots s
+         WHERE s.taken_at < $1 AND EXISTS (
+             SELECT 1 FROM holding_snapshots later
+             WHERE later.user_id = s.user_id
+             AND date_trunc('day', later.taken_at) = date_trunc('day', s.taken_at)
+             AND later.taken_at > s.taken_at
+         )`,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	var deleted int64
+	for _, query := range queries {
+		result, err := m.DB.ExecContext(ctx, query, before)
+		if err != nil {
+			return deleted, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// / Value history of the user between from and to, downsampled to the last
+// / snapshot of every interval. Filtering by portfolio or coin sums the
+// / matching holding snapshots, otherwise the per-user totals are used.
+// # Return
+// - points in ascending time, stamped with the start of their interval
+func (m SnapshotModel) GetHistory(userID int64, filters SnapshotFilters) ([]*Snapshot, error) {
+	field := SnapshotIntervals[filters.Interval]
+
+	query := `SELECT DISTINCT ON (date_trunc($1, taken_at)) date_trunc($1, taken_at), 0, 0, value, cost,
+              unrealized_pnl, realized_pnl
+              FROM portfolio_snapshots
+              WHERE user_id = $2 AND taken_at >= $3 AND taken_at < $4
+              ORDER BY date_trunc($1, taken_at), taken_at DESC`
+	args := []any{field, userID, filters.From, filters.To}
+
+	if filters.PortfolioID != 0 || filters.CoinID != "" {
+		query = `SELECT DISTINCT ON (date_trunc($1, taken_at)) date_trunc($1, taken_at), amount, price, value,
+                 cost, unrealized_pnl, realized_pnl
+                 FROM (
+                     SELECT taken_at, SUM(amount) AS amount,
+                            CASE WHEN $6 = '' THEN 0 ELSE MAX(price) END AS price,
+                            SUM(value) AS value, SUM(cost) AS cost,
+                            SUM(unrealized_pnl) AS unrealized_pnl, SUM(realized_pnl) AS realized_pnl
+                     FROM holding_snapshots
+                     WHERE user_id = $2 AND taken_at >= $3 AND taken_at < $4
+                     AND (portfolio_id = $5 OR $5 = 0)
+                     AND (coin_id = $6 OR $6 = '')
+                     GROUP BY taken_at
+                 ) AS totals
+                 ORDER BY date_trunc($1, taken_at), taken_at DESC`
+		args = append(args, filters.PortfolioID, filters.CoinID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshots := []*Snapshot{}
+
+	for rows.Next() {
+		var s Snapshot
+		err := rows.Scan(
+			&s.TakenAt,
+			&s.Amount,
+			&s.Price,
+			&s.Value,
+			&s.Cost,
+			&s.UnrealizedPNL,
+			&s.RealizedPNL,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if filters.CoinID == "" {
+			s.Amount = 0
+		}
+		snapshots = append(snapshots, &s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
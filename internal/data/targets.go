@@ -0,0 +1,103 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / Coins a portfolio can have targets for, enough for one batched market
+// / data call.
+const MaxAllocationTargets = 100
+
+type TargetModel struct {
+	DB *sql.DB
+}
+
+// / Target weight of a coin in a portfolio, in percent.
+type AllocationTarget struct {
+	CoinID string  `json:"coin_id"`
+	Weight float64 `json:"weight"`
+}
+
+// / Targets of a portfolio name each coin once and add up to 100%. An empty
+// / list clears the targets.
+func ValidateAllocationTargets(v *validator.Validator, targets []*AllocationTarget) {
+	v.Check(len(targets) <= MaxAllocationTargets, "targets", "must not contain more than 100 coins")
+
+	total := 0.0
+	seen := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		v.Check(t.CoinID != "", "targets", "must not contain empty coin ids")
+		v.Check(len(t.CoinID) <= 100, "targets", "must not contain coin ids longer than 100 bytes")
+		v.Check(!seen[t.CoinID], "targets", "must not contain a coin twice")
+		v.Check(t.Weight > 0 && t.Weight <= 100, "targets", "weights must be between 0 and 100")
+		seen[t.CoinID] = true
+		total += t.Weight
+	}
+
+	if len(targets) > 0 {
+		v.Check(math.Abs(total-100) < 0.01, "targets", "weights must add up to 100")
+	}
+}
+
+// / Targets of the portfolio, largest weight first.
+func (m TargetModel) GetForPortfolio(portfolioID int64) ([]*AllocationTarget, error) {
+	query := `SELECT coin_id, weight
+              FROM allocation_targets
+              WHERE portfolio_id = $1
+              ORDER BY weight DESC, coin_id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, portfolioID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	targets := []*AllocationTarget{}
+	for rows.Next() {
+		var t AllocationTarget
+		if err := rows.Scan(&t.CoinID, &t.Weight); err != nil {
+			return nil, err
+		}
+		targets = append(targets, &t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// / Replace the targets of the portfolio in one database transaction.
+func (m TargetModel) Replace(portfolioID int64, targets []*AllocationTarget) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM allocation_targets WHERE portfolio_id = $1`, portfolioID)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO allocation_targets(portfolio_id, coin_id, weight)
+              VALUES($1, $2, $3)`
+
+	for _, t := range targets {
+		if _, err := tx.ExecContext(ctx, query, portfolioID, t.CoinID, t.Weight); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
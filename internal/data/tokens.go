@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"github.com/aalperen0/portfolio-tracker/internal/validator"
@@ -14,6 +15,16 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeEmailChange    = "email-change"
+)
+
+// / Lifetimes of the tokens of a session. Access tokens authenticate
+// / requests, refresh tokens are exchanged for a new pair before they expire.
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
 )
 
 type Token struct {
@@ -22,6 +33,23 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	UserAgent string    `json:"-"`
+	IP        string    `json:"-"`
+	Family    string    `json:"-"`
+}
+
+// / Session is a login as listed to its owner: the family of access and
+// / refresh tokens issued from one authentication. Its id is the id of the
+// / first token of the family, it stays the same across refreshes. The
+// / tokens themselves are never shown again, only their metadata.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Expiry     time.Time  `json:"expiry"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	Current    bool       `json:"current"`
 }
 
 type TokenModel struct {
@@ -41,13 +69,17 @@ func GenerateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	}
 
 	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
-
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	token.Hash = hash[:]
+	token.Hash = HashToken(token.Plaintext)
 
 	return token, nil
 }
 
+// / SHA-256 hash of a plaintext token, the form tokens are stored in.
+func HashToken(tokenPlaintext string) []byte {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return hash[:]
+}
+
 func ValidateToken(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
@@ -63,22 +95,199 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 }
 
 func (m TokenModel) Insert(token *Token) error {
-	query := `INSERT INTO tokens(hash, user_id, expiry, scope)
-              VALUES ($1, $2, $3, $4)`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, insertTokenQuery, tokenArgs(token)...)
+
+	return err
+}
+
+const insertTokenQuery = `INSERT INTO tokens(hash, user_id, expiry, scope, user_agent, ip, family)
+              VALUES ($1, $2, $3, $4, $5, $6, $7)`
 
-	args := []any{
+func tokenArgs(token *Token) []any {
+	return []any{
 		token.Hash,
 		token.UserID,
 		token.Expiry,
 		token.Scope,
+		token.UserAgent,
+		token.IP,
+		token.Family,
+	}
+}
+
+// / Open a session: an access token and a refresh token of a new family.
+// # Parameters
+// @ userID(int64): owner of the session
+// @ userAgent, ip(string): client the session is opened from
+// # Return
+// - the access and refresh token
+func (m TokenModel) NewSession(userID int64, userAgent, ip string) (*Token, *Token, error) {
+	family, err := generateFamily()
+	if err != nil {
+		return nil, nil, err
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	access, refresh, err := insertSessionTokens(ctx, tx, userID, family, userAgent, ip)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	return err
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+// / Exchange a refresh token for a new access and refresh token of the same
+// / family. The presented token is marked as rotated and the older access
+// / tokens of the family are revoked. Presenting a rotated token again means
+// / it leaked, so the whole family is revoked.
+// # Parameters
+// @ tokenPlainText(string): the refresh token
+// @ userAgent, ip(string): client refreshing the session
+// # Return
+// - the new access and refresh token
+// - ErrRecordNotFound if the token is unknown or expired
+// - ErrTokenReused if the token was already rotated
+func (m TokenModel) Rotate(tokenPlainText, userAgent, ip string) (*Token, *Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		userID    int64
+		family    string
+		rotatedAt *time.Time
+	)
+
+	query := `SELECT user_id, family, rotated_at
+              FROM tokens
+              WHERE hash = $1 AND scope = $2 AND expiry > NOW()
+              FOR UPDATE`
+
+	err = tx.QueryRowContext(ctx, query, HashToken(tokenPlainText), ScopeRefresh).
+		Scan(&userID, &family, &rotatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, validator.ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	if rotatedAt != nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, family)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, validator.ErrTokenReused
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`UPDATE tokens SET rotated_at = NOW() WHERE hash = $1`,
+		HashToken(tokenPlainText),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`DELETE FROM tokens WHERE family = $1 AND scope = $2`,
+		family,
+		ScopeAuthentication,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	access, refresh, err := insertSessionTokens(ctx, tx, userID, family, userAgent, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+func insertSessionTokens(
+	ctx context.Context,
+	tx *sql.Tx,
+	userID int64,
+	family, userAgent, ip string,
+) (*Token, *Token, error) {
+	access, err := GenerateToken(userID, AccessTokenTTL, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh, err := GenerateToken(userID, RefreshTokenTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, token := range []*Token{access, refresh} {
+		token.Family = family
+		token.UserAgent = userAgent
+		token.IP = ip
+
+		if _, err := tx.ExecContext(ctx, insertTokenQuery, tokenArgs(token)...); err != nil {
+			return nil, nil, err
+		}
+	}
+	return access, refresh, nil
+}
+
+func generateFamily() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+// / Report whether the token exists in the scope but has expired, so an
+// / expired access token can be told apart from an invalid one.
+func (m TokenModel) Expired(hash []byte, scope string) (bool, error) {
+	query := `SELECT expiry <= NOW() FROM tokens WHERE hash = $1 AND scope = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var expired bool
+	err := m.DB.QueryRowContext(ctx, query, hash, scope).Scan(&expired)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return expired, nil
 }
 
 func (m TokenModel) DeleteTokens(scope string, userID int64) error {
@@ -93,3 +302,141 @@ func (m TokenModel) DeleteTokens(scope string, userID int64) error {
 
 	return err
 }
+
+// / End the session of a token: delete the token and every token of its
+// / family, so its refresh token can't open the session again.
+func (m TokenModel) DeleteSessionByHash(hash []byte) error {
+	query := `DELETE FROM tokens
+              WHERE hash = $1
+              OR family = (SELECT family FROM tokens WHERE hash = $1 AND family <> '')`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, hash)
+	return err
+}
+
+// / End every session of the user except the one of currentHash, e.g. after
+// / a password change.
+func (m TokenModel) DeleteOtherSessions(userID int64, currentHash []byte) error {
+	query := `DELETE FROM tokens
+              WHERE user_id = $1 AND scope IN ($2, $3)
+              AND family IS DISTINCT FROM (SELECT family FROM tokens WHERE hash = $4 AND family <> '')
+              AND hash <> $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, ScopeAuthentication, ScopeRefresh, currentHash)
+	return err
+}
+
+// / Record that the token was used at now. Writes are throttled to one a
+// / minute per token so busy clients don't update the row on every request.
+func (m TokenModel) Touch(hash []byte, now time.Time) error {
+	query := `UPDATE tokens
+              SET last_used_at = $2
+              WHERE hash = $1 AND (last_used_at IS NULL OR last_used_at < $2 - INTERVAL '1 minute')`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, hash, now)
+	return err
+}
+
+// / List the live sessions of the user, most recently used first. A session
+// / is live while its refresh token or its access token is unexpired.
+// # Parameters
+// @ userID(int64): owner of the sessions
+// @ currentHash([]byte): hash of the requesting token, its session is marked as current
+func (m TokenModel) GetSessions(userID int64, currentHash []byte) ([]*Session, error) {
+	query := `SELECT MIN(id), MIN(created_at), MAX(expiry) FILTER (WHERE rotated_at IS NULL), MAX(last_used_at),
+              (array_agg(user_agent ORDER BY id DESC))[1], (array_agg(ip ORDER BY id DESC))[1],
+              COALESCE(bool_or(hash = $3), false)
+              FROM tokens
+              WHERE user_id = $1 AND scope IN ($2, $4) AND family <> ''
+              GROUP BY family
+              HAVING bool_or(expiry > NOW() AND rotated_at IS NULL)
+              ORDER BY MAX(COALESCE(last_used_at, created_at)) DESC, MIN(id) DESC`
+
+	args := []any{userID, ScopeAuthentication, currentHash, ScopeRefresh}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var s Session
+		err := rows.Scan(&s.ID, &s.CreatedAt, &s.Expiry, &s.LastUsedAt, &s.UserAgent, &s.IP, &s.Current)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// / Revoke a session of the user by its id, deleting every token of it.
+// # Return
+// - ErrRecordNotFound if the user has no such session
+func (m TokenModel) DeleteSession(id, userID int64) error {
+	if id < 1 {
+		return validator.ErrRecordNotFound
+	}
+
+	query := `DELETE FROM tokens
+              WHERE user_id = $2 AND family <> ''
+              AND family = (SELECT family FROM tokens WHERE id = $1 AND user_id = $2 AND scope IN ($3, $4))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID, ScopeAuthentication, ScopeRefresh)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return validator.ErrRecordNotFound
+	}
+	return nil
+}
+
+// / Delete the tokens that expired before now. Tokens of a live session are
+// / kept while their family has an unexpired token: its first token holds
+// / the session id, and its expired access token tells the client to
+// / refresh instead of logging in again. Expired rotated refresh tokens of a
+// / live family are deleted, Rotate ignores them anyway.
+func (m TokenModel) PurgeExpired(now time.Time) (int64, error) {
+	query := `DELETE FROM tokens t
+              WHERE t.expiry <= $1
+              AND (t.family = ''
+                   OR NOT EXISTS (SELECT 1 FROM tokens l WHERE l.family = t.family AND l.expiry > $1)
+                   OR (t.rotated_at IS NOT NULL
+                       AND t.id > (SELECT MIN(f.id) FROM tokens f WHERE f.family = t.family)))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
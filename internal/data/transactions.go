@@ -0,0 +1,982 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+
+	"github.com/aalperen0/portfolio-tracker/internal/cache"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+const (
+	TransactionBuy         = "buy"
+	TransactionSell        = "sell"
+	TransactionTransferIn  = "transfer_in"
+	TransactionTransferOut = "transfer_out"
+	TransactionFee         = "fee"
+	TransactionAirdrop     = "airdrop"
+)
+
+var TransactionTypes = []string{
+	TransactionBuy,
+	TransactionSell,
+	TransactionTransferIn,
+	TransactionTransferOut,
+	TransactionFee,
+	TransactionAirdrop,
+}
+
+// / Quantities below this value are treated as zero when deriving positions
+// / so that float rounding doesn't leave dust or reject a full sell.
+const quantityEpsilon = 1e-9
+
+type TransactionModel struct {
+	DB     *sql.DB
+	Cache  *cache.Cache
+	Logger zerolog.Logger
+}
+
+type Transaction struct {
+	ID          int64     `json:"id"`
+	UserID      int64     `json:"-"`
+	PortfolioID int64     `json:"portfolio_id"`
+	CoinID      string    `json:"coin_id"`
+	Symbol      string    `json:"symbol"`
+	Type        string    `json:"type"`
+	Quantity    float64   `json:"quantity"`
+	Price       float64   `json:"price"`
+	Fee         float64   `json:"fee"`
+	Currency    string    `json:"currency"`
+	FXRate      float64   `json:"fx_rate"`
+	Note        string    `json:"note"`
+	ExecutedAt  time.Time `json:"executed_at"`
+	CreatedAt   time.Time `json:"created_at"`
+	Version     int       `json:"version"`
+
+	// Identity of an imported row, re-imports of the row are skipped.
+	ImportHash string `json:"-"`
+}
+
+func ValidateTransaction(v *validator.Validator, t *Transaction) {
+	v.Check(t.CoinID != "", "coin_id", "must be provided")
+	v.Check(len(t.CoinID) <= 100, "coin_id", "must be not longer than 100 bytes")
+	v.Check(
+		validator.PermittedValues(t.Type, TransactionTypes...),
+		"type",
+		"must be one of buy, sell, transfer_in, transfer_out, fee, airdrop",
+	)
+	v.Check(t.Quantity > 0, "quantity", "must be greater than zero")
+	v.Check(t.Price >= 0, "price", "must not be negative")
+	v.Check(t.Fee >= 0, "fee", "must not be negative")
+	ValidateCurrency(v, t.Currency)
+	v.Check(t.FXRate > 0, "fx_rate", "must be greater than zero")
+	v.Check(len(t.Note) <= 1000, "note", "must not be more than 1000 bytes")
+	v.Check(!t.ExecutedAt.IsZero(), "executed_at", "must be provided")
+	v.Check(!t.ExecutedAt.After(time.Now().Add(time.Minute)), "executed_at", "must not be in the future")
+
+	if t.Type == TransactionBuy || t.Type == TransactionSell {
+		v.Check(t.Price > 0, "price", "must be greater than zero")
+	}
+}
+
+// / Unit price in USD. Price and fee are stored in the currency of purchase
+// / together with the rate (units of that currency per USD) at execution,
+// / so the cost basis doesn't move with later FX rates.
+func (t *Transaction) PriceUSD() float64 {
+	return t.Price / t.FXRate
+}
+
+// / Fee in USD, see PriceUSD.
+func (t *Transaction) FeeUSD() float64 {
+	return t.Fee / t.FXRate
+}
+
+// / Increases reports whether the transaction adds units to the position.
+func (t *Transaction) Increases() bool {
+	switch t.Type {
+	case TransactionBuy, TransactionTransferIn, TransactionAirdrop:
+		return true
+	}
+	return false
+}
+
+// / DerivePosition replays the ledger of a single coin with the given
+// / cost-basis method and sets amount, average cost, total cost (basis of the
+// / open lots), realized PNL and unrealized PNL of the coin.
+// # Parameters
+// - coin: holding to fill, CoinID and UserID are left untouched
+// - txs: ledger entries sorted by execution time
+// - method: fifo, lifo, hifo or average
+// - currentPrice: price used for unrealized PNL
+// # Return
+// - ErrInsufficientHoldings if the ledger disposes more than it holds
+func DerivePosition(coin *Coin, txs []*Transaction, method string, currentPrice float64) error {
+	book, err := BuildLots(txs, method)
+	if err != nil {
+		return err
+	}
+
+	coin.Amount = book.amount()
+	coin.TotalCost = book.costBasis()
+	coin.RealizedPNL = book.RealizedPNL
+	coin.PurchasePriceAverage = 0
+	if coin.Amount > 0 {
+		coin.PurchasePriceAverage = coin.TotalCost / coin.Amount
+	}
+	calculatePNL(coin, currentPrice)
+
+	return nil
+}
+
+func calculatePNL(c *Coin, currentPrice float64) {
+	c.PNL = (c.Amount * currentPrice) - c.TotalCost
+}
+
+// / Insert a ledger entry and rebuild the matching holding inside the same
+// / database transaction.
+// # Parameters
+// - t: transaction to record, ID, CreatedAt and Version are filled on success
+// - currentPrice: price of the coin used for PNL of the rebuilt holding
+// # Return
+// - the rebuilt coin holding
+// - ErrInsufficientHoldings if the entry would sell more than is held
+func (m TransactionModel) Insert(t *Transaction, currentPrice float64) (*Coin, error) {
+	return m.insert(t, currentPrice, false)
+}
+
+// / Insert the first entry of a holding, as Insert does, unless the portfolio
+// / already holds the coin. Checked under the lock of the position, so two
+// / concurrent requests can't both open it.
+// # Return
+// - the new coin holding
+// - ErrDuplicateCoin if the portfolio holds an amount of the coin
+func (m TransactionModel) InsertFirst(t *Transaction, currentPrice float64) (*Coin, error) {
+	return m.insert(t, currentPrice, true)
+}
+
+func (m TransactionModel) insert(t *Transaction, currentPrice float64, first bool) (*Coin, error) {
+	query := `INSERT INTO transactions(user_id, portfolio_id, coin_id, symbol, type, quantity, price, fee, currency,
+              fx_rate, note, executed_at)
+              VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+              RETURNING id, created_at, version`
+
+	args := []any{
+		t.UserID,
+		t.PortfolioID,
+		t.CoinID,
+		t.Symbol,
+		t.Type,
+		t.Quantity,
+		t.Price,
+		t.Fee,
+		t.Currency,
+		t.FXRate,
+		t.Note,
+		t.ExecutedAt,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer m.rollback(tx)
+
+	if err = m.lockPosition(ctx, tx, t.PortfolioID, t.CoinID); err != nil {
+		return nil, err
+	}
+
+	if first {
+		var held bool
+		err = tx.QueryRowContext(
+			ctx,
+			`SELECT EXISTS(SELECT 1 FROM coins WHERE portfolio_id = $1 AND coin_id = $2 AND amount > 0)`,
+			t.PortfolioID,
+			t.CoinID,
+		).Scan(&held)
+		if err != nil {
+			return nil, err
+		}
+		if held {
+			return nil, validator.ErrDuplicateCoin
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&t.ID, &t.CreatedAt, &t.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	coin, err := m.syncPosition(ctx, tx, t.UserID, t.PortfolioID, t.CoinID, t.Symbol, currentPrice)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	m.invalidate(ctx, t.UserID)
+
+	return coin, nil
+}
+
+// / Insert imported ledger entries and rebuild every holding they touch in a
+// / single database transaction. Entries whose import hash the portfolio
+// / already has are skipped, so importing the same file twice into it
+// / doesn't duplicate them.
+// # Parameters
+// - txs: entries of the user, ID, CreatedAt and Version are filled for inserted ones
+// - prices: current price of every coin of txs, used for PNL of the rebuilt holdings
+// # Return
+// - the number of inserted entries
+// - ErrInsufficientHoldings, naming the coin, if the ledger of a coin would sell more than is held
+func (m TransactionModel) Import(userID int64, txs []*Transaction, prices map[string]float64) (int, error) {
+	query := `INSERT INTO transactions(user_id, portfolio_id, coin_id, symbol, type, quantity, price, fee, currency,
+              fx_rate, note, executed_at, import_hash)
+              VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+              ON CONFLICT (user_id, portfolio_id, import_hash) DO NOTHING
+              RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer m.rollback(tx)
+
+	type position struct {
+		portfolioID int64
+		coinID      string
+	}
+
+	// Locked in a fixed order, so two imports sharing positions can't
+	// deadlock.
+	var positions []position
+	seen := map[position]bool{}
+	for _, t := range txs {
+		p := position{t.PortfolioID, t.CoinID}
+		if !seen[p] {
+			seen[p] = true
+			positions = append(positions, p)
+		}
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		if positions[i].portfolioID != positions[j].portfolioID {
+			return positions[i].portfolioID < positions[j].portfolioID
+		}
+		return positions[i].coinID < positions[j].coinID
+	})
+	for _, p := range positions {
+		if err := m.lockPosition(ctx, tx, p.portfolioID, p.coinID); err != nil {
+			return 0, err
+		}
+	}
+
+	touched := map[position]string{}
+	inserted := 0
+
+	for _, t := range txs {
+		args := []any{
+			userID,
+			t.PortfolioID,
+			t.CoinID,
+			t.Symbol,
+			t.Type,
+			t.Quantity,
+			t.Price,
+			t.Fee,
+			t.Currency,
+			t.FXRate,
+			t.Note,
+			t.ExecutedAt,
+			t.ImportHash,
+		}
+
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&t.ID, &t.CreatedAt, &t.Version)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return 0, err
+		}
+		t.UserID = userID
+		touched[position{t.PortfolioID, t.CoinID}] = t.Symbol
+		inserted++
+	}
+
+	for p, symbol := range touched {
+		_, err := m.syncPosition(ctx, tx, userID, p.portfolioID, p.coinID, symbol, prices[p.coinID])
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", p.coinID, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	m.invalidate(ctx, userID)
+
+	return inserted, nil
+}
+
+// / Import hashes out of hashes the user already imported into the portfolio.
+func (m TransactionModel) ExistingImportHashes(
+	userID int64,
+	portfolioID int64,
+	hashes []string,
+) (map[string]bool, error) {
+	query := `SELECT import_hash
+              FROM transactions
+              WHERE user_id = $1 AND portfolio_id = $2 AND import_hash = ANY($3)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, portfolioID, pq.Array(hashes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := map[string]bool{}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		existing[hash] = true
+	}
+	return existing, rows.Err()
+}
+
+// / Retrieve a single ledger entry of the user.
+func (m TransactionModel) Get(id, userID int64) (*Transaction, error) {
+	if id < 1 {
+		return nil, validator.ErrRecordNotFound
+	}
+
+	query := `SELECT id, user_id, portfolio_id, coin_id, symbol, type, quantity, price, fee, currency, fx_rate, note,
+              executed_at,
+              created_at, version
+              FROM transactions
+              WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var t Transaction
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
+		&t.ID,
+		&t.UserID,
+		&t.PortfolioID,
+		&t.CoinID,
+		&t.Symbol,
+		&t.Type,
+		&t.Quantity,
+		&t.Price,
+		&t.Fee,
+		&t.Currency,
+		&t.FXRate,
+		&t.Note,
+		&t.ExecutedAt,
+		&t.CreatedAt,
+		&t.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, validator.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+// / List ledger entries of the user, optionally narrowed to a portfolio
+// / (zero means every portfolio), a coin and a type.
+func (m TransactionModel) GetAllForUser(
+	coinID string,
+	txType string,
+	portfolioID int64,
+	userID int64,
+	filters Filters,
+) ([]*Transaction, error) {
+	query := fmt.Sprintf(`SELECT id, user_id, portfolio_id, coin_id, symbol, type, quantity, price, fee, currency, fx_rate, note,
+              executed_at,
+              created_at, version
+              FROM transactions
+              WHERE (coin_id = $1 OR $1 = '') AND (type = $2 OR $2 = '')
+              AND (portfolio_id = $3 OR $3 = 0) AND user_id = $4
+              ORDER BY %s %s, id %s
+              LIMIT $5 OFFSET $6`, filters.SortColumn(), filters.SortDirection(), filters.SortDirection())
+
+	args := []any{coinID, txType, portfolioID, userID, filters.Limit(), filters.Offset()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanTransactions(rows)
+}
+
+// / The whole ledger of the user in execution order, either of a single
+// / portfolio or of every non-archived one (portfolioID zero).
+func (m TransactionModel) LedgerForUser(userID, portfolioID int64) ([]*Transaction, error) {
+	query := `SELECT transactions.id, transactions.user_id, transactions.portfolio_id, transactions.coin_id,
+              transactions.symbol, transactions.type, transactions.quantity, transactions.price,
+              transactions.fee, transactions.currency, transactions.fx_rate, transactions.note,
+              transactions.executed_at, transactions.created_at, transactions.version
+              FROM transactions
+              JOIN portfolios ON portfolios.id = transactions.portfolio_id
+              WHERE transactions.user_id = $1
+              AND (transactions.portfolio_id = $2 OR ($2 = 0 AND NOT portfolios.archived))
+              ORDER BY transactions.executed_at ASC, transactions.id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, portfolioID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanTransactions(rows)
+}
+
+// / The ledgers of the coins in the portfolio in execution order, by coin.
+func (m TransactionModel) LedgersForPortfolio(portfolioID int64, coinIDs []string) (map[string][]*Transaction, error) {
+	query := `SELECT id, user_id, portfolio_id, coin_id, symbol, type, quantity, price, fee, currency, fx_rate, note,
+              executed_at,
+              created_at, version
+              FROM transactions
+              WHERE portfolio_id = $1 AND coin_id = ANY($2)
+              ORDER BY executed_at ASC, id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, portfolioID, pq.Array(coinIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	txs, err := scanTransactions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	ledgers := make(map[string][]*Transaction, len(coinIDs))
+	for _, t := range txs {
+		ledgers[t.CoinID] = append(ledgers[t.CoinID], t)
+	}
+	return ledgers, nil
+}
+
+// / Call fn with every ledger entry of the user in execution order, one row
+// / at a time, so exports don't hold the whole ledger in memory.
+// # Parameters
+// - portfolioID: zero for every portfolio, archived ones included
+// - fn: stops the iteration by returning an error, which is returned
+func (m TransactionModel) Each(ctx context.Context, userID, portfolioID int64, fn func(*Transaction) error) error {
+	query := `SELECT id, user_id, portfolio_id, coin_id, symbol, type, quantity, price, fee, currency, fx_rate, note,
+              executed_at, created_at, version
+              FROM transactions
+              WHERE user_id = $1 AND (portfolio_id = $2 OR $2 = 0)
+              ORDER BY executed_at ASC, id ASC`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, portfolioID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// / Every ledger entry of the user in execution order, archived portfolios
+// / included.
+func (m TransactionModel) AllForUser(userID int64) ([]*Transaction, error) {
+	query := `SELECT id, user_id, portfolio_id, coin_id, symbol, type, quantity, price, fee, currency, fx_rate, note,
+              executed_at, created_at, version
+              FROM transactions
+              WHERE user_id = $1
+              ORDER BY executed_at ASC, id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanTransactions(rows)
+}
+
+// / Update a ledger entry with optimistic locking on version and rebuild the
+// / holding it belongs to.
+func (m TransactionModel) Update(t *Transaction, currentPrice float64) (*Coin, error) {
+	query := `UPDATE transactions
+              SET type = $1, quantity = $2, price = $3, fee = $4, currency = $5, fx_rate = $6, note = $7,
+              executed_at = $8, version = version + 1
+              WHERE id = $9 AND user_id = $10 AND version = $11
+              RETURNING version`
+
+	args := []any{
+		t.Type,
+		t.Quantity,
+		t.Price,
+		t.Fee,
+		t.Currency,
+		t.FXRate,
+		t.Note,
+		t.ExecutedAt,
+		t.ID,
+		t.UserID,
+		t.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer m.rollback(tx)
+
+	if err = m.lockPosition(ctx, tx, t.PortfolioID, t.CoinID); err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&t.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, validator.ErrEditConflict
+		default:
+			return nil, err
+		}
+	}
+
+	coin, err := m.syncPosition(ctx, tx, t.UserID, t.PortfolioID, t.CoinID, t.Symbol, currentPrice)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	m.invalidate(ctx, t.UserID)
+
+	return coin, nil
+}
+
+// / Delete a ledger entry and rebuild the holding. When the last entry of a
+// / coin is removed the holding is removed as well and nil is returned.
+func (m TransactionModel) Delete(t *Transaction, currentPrice float64) (*Coin, error) {
+	query := `DELETE FROM transactions WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer m.rollback(tx)
+
+	if err = m.lockPosition(ctx, tx, t.PortfolioID, t.CoinID); err != nil {
+		return nil, err
+	}
+
+	result, err := tx.ExecContext(ctx, query, t.ID, t.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, validator.ErrRecordNotFound
+	}
+
+	coin, err := m.syncPosition(ctx, tx, t.UserID, t.PortfolioID, t.CoinID, t.Symbol, currentPrice)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	m.invalidate(ctx, t.UserID)
+
+	return coin, nil
+}
+
+// / Attach the open tax lots to each holding. Lots are valued at the price of
+// / the last PNL refresh of the holding, so that their unrealized PNL adds up
+// / to the unrealized PNL of the coin.
+func (m TransactionModel) AttachLots(coins []*Coin, userID int64, method string) error {
+	if len(coins) == 0 {
+		return nil
+	}
+
+	coinIDs := make([]string, 0, len(coins))
+	for _, coin := range coins {
+		coinIDs = append(coinIDs, coin.CoinID)
+	}
+
+	query := `SELECT id, user_id, portfolio_id, coin_id, symbol, type, quantity, price, fee, currency, fx_rate, note,
+              executed_at,
+              created_at, version
+              FROM transactions
+              WHERE user_id = $1 AND coin_id = ANY($2)
+              ORDER BY executed_at ASC, id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, pq.Array(coinIDs))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	txs, err := scanTransactions(rows)
+	if err != nil {
+		return err
+	}
+
+	type holdingKey struct {
+		portfolioID int64
+		coinID      string
+	}
+
+	ledgers := make(map[holdingKey][]*Transaction)
+	for _, t := range txs {
+		key := holdingKey{t.PortfolioID, t.CoinID}
+		ledgers[key] = append(ledgers[key], t)
+	}
+
+	for _, coin := range coins {
+		book, err := BuildLots(ledgers[holdingKey{coin.PortfolioID, coin.CoinID}], method)
+		if err != nil {
+			return err
+		}
+		if coin.Amount > 0 {
+			book.Value((coin.PNL + coin.TotalCost) / coin.Amount)
+		}
+		coin.Lots = book.Lots
+	}
+
+	return nil
+}
+
+// / Save the cost-basis method of the user and rebuild every holding from
+// / the ledger with it, in one transaction so the method and the PNL of the
+// / holdings never disagree.
+// # Parameters
+// - user: with the new CostBasisMethod, its Version is updated
+// - prices: current price per coin id, used for unrealized PNL
+// # Return
+// - ErrEditConflict if the user changed in the meantime
+func (m TransactionModel) RebuildAll(user *User, prices map[string]float64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer m.rollback(tx)
+
+	err = tx.QueryRowContext(
+		ctx,
+		`UPDATE users SET cost_basis_method = $1, version = version + 1
+         WHERE id = $2 AND version = $3
+         RETURNING version`,
+		user.CostBasisMethod,
+		user.ID,
+		user.Version,
+	).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return validator.ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	userID := user.ID
+
+	rows, err := tx.QueryContext(
+		ctx,
+		`SELECT DISTINCT ON (portfolio_id, coin_id) portfolio_id, coin_id, symbol
+         FROM transactions
+         WHERE user_id = $1`,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	type holding struct {
+		portfolioID int64
+		coinID      string
+		symbol      string
+	}
+
+	var holdings []holding
+	for rows.Next() {
+		var h holding
+		if err := rows.Scan(&h.portfolioID, &h.coinID, &h.symbol); err != nil {
+			rows.Close()
+			return err
+		}
+		holdings = append(holdings, h)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	sort.Slice(holdings, func(i, j int) bool {
+		if holdings[i].portfolioID != holdings[j].portfolioID {
+			return holdings[i].portfolioID < holdings[j].portfolioID
+		}
+		return holdings[i].coinID < holdings[j].coinID
+	})
+	for _, h := range holdings {
+		if err := m.lockPosition(ctx, tx, h.portfolioID, h.coinID); err != nil {
+			return err
+		}
+	}
+
+	for _, h := range holdings {
+		_, err := m.syncPosition(ctx, tx, userID, h.portfolioID, h.coinID, h.symbol, prices[h.coinID])
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	m.invalidate(ctx, userID)
+
+	return nil
+}
+
+// / Distinct coins that appear in the ledger of the user.
+func (m TransactionModel) CoinIDsForUser(userID int64) ([]string, error) {
+	query := `SELECT DISTINCT coin_id FROM transactions WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	coinIDs := []string{}
+	for rows.Next() {
+		var coinID string
+		if err := rows.Scan(&coinID); err != nil {
+			return nil, err
+		}
+		coinIDs = append(coinIDs, coinID)
+	}
+	return coinIDs, rows.Err()
+}
+
+// / Replay the ledger of the coin inside tx and write the derived holding to
+// / the coins table. The holding is removed once the coin has no entries left.
+func (m TransactionModel) syncPosition(
+	ctx context.Context,
+	tx *sql.Tx,
+	userID int64,
+	portfolioID int64,
+	coinID string,
+	symbol string,
+	currentPrice float64,
+) (*Coin, error) {
+	query := `SELECT id, user_id, portfolio_id, coin_id, symbol, type, quantity, price, fee, currency, fx_rate, note,
+              executed_at,
+              created_at, version
+              FROM transactions
+              WHERE portfolio_id = $1 AND coin_id = $2
+              ORDER BY executed_at ASC, id ASC`
+
+	rows, err := tx.QueryContext(ctx, query, portfolioID, coinID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	txs, err := scanTransactions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(txs) == 0 {
+		_, err := tx.ExecContext(
+			ctx,
+			`DELETE FROM coins WHERE coin_id = $1 AND portfolio_id = $2`,
+			coinID,
+			portfolioID,
+		)
+		return nil, err
+	}
+
+	var method string
+	err = tx.QueryRowContext(ctx, `SELECT cost_basis_method FROM users WHERE id = $1`, userID).
+		Scan(&method)
+	if err != nil {
+		return nil, err
+	}
+
+	coin := &Coin{CoinID: coinID, PortfolioID: portfolioID, UserID: userID, Symbol: symbol}
+	if err := DerivePosition(coin, txs, method, currentPrice); err != nil {
+		return nil, err
+	}
+
+	upsert := `INSERT INTO coins(coin_id, portfolio_id, user_id, symbol, amount, purchase_price_average, total_cost,
+               pnl, realized_pnl)
+               VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)
+               ON CONFLICT (portfolio_id, coin_id) DO UPDATE
+               SET amount = EXCLUDED.amount,
+                   purchase_price_average = EXCLUDED.purchase_price_average,
+                   total_cost = EXCLUDED.total_cost,
+                   pnl = EXCLUDED.pnl,
+                   realized_pnl = EXCLUDED.realized_pnl,
+                   version = coins.version + 1
+               RETURNING id, created_at, version`
+
+	args := []any{
+		coin.CoinID,
+		coin.PortfolioID,
+		coin.UserID,
+		coin.Symbol,
+		coin.Amount,
+		coin.PurchasePriceAverage,
+		coin.TotalCost,
+		coin.PNL,
+		coin.RealizedPNL,
+	}
+
+	err = tx.QueryRowContext(ctx, upsert, args...).Scan(&coin.ID, &coin.CreatedAt, &coin.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	return coin, nil
+}
+
+// / Serialize writers of the ledger of a coin in a portfolio until tx ends,
+// / so two of them can't replay it from the same snapshot and overwrite the
+// / holding with a stale one. Callers locking several positions take them
+// / ordered by portfolio and coin.
+func (m TransactionModel) lockPosition(ctx context.Context, tx *sql.Tx, portfolioID int64, coinID string) error {
+	_, err := tx.ExecContext(
+		ctx,
+		`SELECT pg_advisory_xact_lock(hashtext($1::text || ':' || $2))`,
+		portfolioID,
+		coinID,
+	)
+	return err
+}
+
+func (m TransactionModel) rollback(tx *sql.Tx) {
+	if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+		m.Logger.Err(err).Msg("rollback error")
+	}
+}
+
+func (m TransactionModel) invalidate(ctx context.Context, userID int64) {
+	cacheKey := "user:coins:" + strconv.Itoa(int(userID)) + ":*"
+	if err := m.Cache.Invalidate(ctx, cacheKey); err != nil {
+		m.Logger.Err(err).Msg("failed to invalidate portfolio cache")
+	}
+}
+
+func scanTransactions(rows *sql.Rows) ([]*Transaction, error) {
+	txs := []*Transaction{}
+
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+func scanTransaction(row rowScanner) (*Transaction, error) {
+	var t Transaction
+	err := row.Scan(
+		&t.ID,
+		&t.UserID,
+		&t.PortfolioID,
+		&t.CoinID,
+		&t.Symbol,
+		&t.Type,
+		&t.Quantity,
+		&t.Price,
+		&t.Fee,
+		&t.Currency,
+		&t.FXRate,
+		&t.Note,
+		&t.ExecutedAt,
+		&t.CreatedAt,
+		&t.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,246 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/aalperen0/portfolio-tracker/internal/totp"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / Scope of the token a password login returns when the user has 2FA
+// / enabled. It is exchanged together with a code for a session.
+const ScopeTwoFactorPending = "2fa-pending"
+
+// / Number of recovery codes issued when 2FA is enabled.
+const RecoveryCodeCount = 10
+
+type TwoFactorModel struct {
+	DB *sql.DB
+}
+
+// / TOTP state of a user. Secret is set on enrollment and only used once
+// / Enabled after the first verified code.
+type TwoFactor struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) <= 32, "code", "must not be more than 32 bytes")
+}
+
+// / Generate recovery codes, 10 base32 characters split in two groups, e.g.
+// / ABCDE-FGHIJ.
+func GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes, nil
+}
+
+// / Recovery codes are compared case-insensitively and without the dash.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	return HashToken(code)
+}
+
+func (m TwoFactorModel) Get(userID int64) (*TwoFactor, error) {
+	query := `SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var tf TwoFactor
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&tf.Secret, &tf.Enabled, &tf.LastStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, validator.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &tf, nil
+}
+
+// / Store a new secret waiting for its first code. Users with 2FA enabled
+// / have to disable it first.
+// # Return
+// - ErrEditConflict if 2FA is already enabled
+func (m TwoFactorModel) Enroll(userID int64, secret string) error {
+	query := `UPDATE users
+              SET totp_secret = $1, totp_last_step = 0
+              WHERE id = $2 AND NOT totp_enabled`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, secret, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return validator.ErrEditConflict
+	}
+	return nil
+}
+
+// / Enable 2FA after a verified code and replace the recovery codes.
+func (m TwoFactorModel) Enable(userID int64, step int64, recoveryCodes []string) error {
+	hashes := make([][]byte, len(recoveryCodes))
+	for i, code := range recoveryCodes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
+		ctx,
+		`UPDATE users SET totp_enabled = true, totp_last_step = $1 WHERE id = $2`,
+		step,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO recovery_codes(user_id, hash) SELECT $1, unnest($2::bytea[])`,
+		userID,
+		pq.Array(hashes),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// / Turn 2FA off and drop the secret and recovery codes.
+func (m TwoFactorModel) Disable(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
+		ctx,
+		`UPDATE users SET totp_secret = '', totp_enabled = false, totp_last_step = 0 WHERE id = $1`,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// / Check a TOTP code or, failing that, a recovery code of a user with 2FA
+// / enabled. A TOTP step and a recovery code work once.
+// # Return
+// - false if the code is wrong, replayed or 2FA is not enabled
+func (m TwoFactorModel) Verify(userID int64, code string, now time.Time) (bool, error) {
+	tf, err := m.Get(userID)
+	if err != nil {
+		return false, err
+	}
+	if !tf.Enabled {
+		return false, nil
+	}
+
+	if step, ok := totp.Validate(tf.Secret, code, now); ok {
+		return m.useStep(userID, step)
+	}
+	return m.useRecoveryCode(userID, code)
+}
+
+// / Record the step of a used code. Fails when the step, or a later one,
+// / was used already.
+func (m TwoFactorModel) useStep(userID int64, step int64) (bool, error) {
+	query := `UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, step, userID)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+func (m TwoFactorModel) useRecoveryCode(userID int64, code string) (bool, error) {
+	query := `UPDATE recovery_codes
+              SET used_at = NOW()
+              WHERE id = (SELECT id FROM recovery_codes
+                          WHERE user_id = $1 AND hash = $2 AND used_at IS NULL
+                          LIMIT 1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// / Number of unused recovery codes of the user.
+func (m TwoFactorModel) RemainingRecoveryCodes(userID int64) (int, error) {
+	query := `SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&count)
+	return count, err
+}
@@ -2,7 +2,6 @@ package data
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -20,13 +19,17 @@ type UserModel struct {
 var AnonymousUser = &User{}
 
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID              int64     `json:"id"`
+	CreatedAt       time.Time `json:"created_at"`
+	Name            string    `json:"name"`
+	Email           string    `json:"email"`
+	Password        password  `json:"-"`
+	Activated       bool      `json:"activated"`
+	CostBasisMethod string    `json:"cost_basis_method"`
+	Currency        string    `json:"reporting_currency"`
+	Role            string    `json:"role"`
+	Disabled        bool      `json:"disabled"`
+	Version         int       `json:"version"`
 }
 
 func (u *User) IsAnonymous() bool {
@@ -111,13 +114,21 @@ func ValidateUser(v *validator.Validator, user *User) {
 func (m UserModel) Insert(user *User) error {
 	query := `INSERT INTO users(name, email, password_hash, activated)
 	VALUES($1, $2, $3, $4)
-	RETURNING id, created_at, version`
+	RETURNING id, created_at, version, cost_basis_method, reporting_currency, role, disabled`
 
 	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Version,
+		&user.CostBasisMethod,
+		&user.Currency,
+		&user.Role,
+		&user.Disabled,
+	)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -137,7 +148,8 @@ func (m UserModel) Insert(user *User) error {
 // # Return
 // - User
 func (m UserModel) GetByEmail(email string) (*User, error) {
-	query := `SELECT id, name, email, password_hash, activated, version
+	query := `SELECT id, created_at, name, email, password_hash, activated, version, cost_basis_method, reporting_currency,
+			  role, disabled
 			  FROM users
 			  WHERE email = $1`
 
@@ -148,11 +160,16 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
 		&user.ID,
+		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.CostBasisMethod,
+		&user.Currency,
+		&user.Role,
+		&user.Disabled,
 	)
 	if err != nil {
 		switch {
@@ -168,8 +185,9 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 
 func (m UserModel) UpdateUser(user *User) error {
 	query := `UPDATE users
-			  SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-			  WHERE id = $5 AND version = $6
+			  SET name = $1, email = $2, password_hash = $3, activated = $4, cost_basis_method = $5, reporting_currency = $6,
+			      role = $7, disabled = $8, version = version + 1
+			  WHERE id = $9 AND version = $10
 			  RETURNING version`
 
 	args := []any{
@@ -177,6 +195,10 @@ func (m UserModel) UpdateUser(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.CostBasisMethod,
+		user.Currency,
+		user.Role,
+		user.Disabled,
 		user.ID,
 		user.Version,
 	}
@@ -208,15 +230,16 @@ func (m UserModel) UpdateUser(user *User) error {
 // - return user associated with token or error in case of not found
 
 func (m UserModel) GetUserByToken(tokenScope, tokenPlainText string) (*User, error) {
-	tokenHash := sha256.Sum256([]byte(tokenPlainText))
+	tokenHash := HashToken(tokenPlainText)
 
-	query := `SELECT users.id, users.name, users.email, users.password_hash, users.activated, users.version
+	query := `SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated,
+              users.version, users.cost_basis_method, users.reporting_currency, users.role, users.disabled
               FROM users 
               JOIN tokens ON users.id = tokens.user_id
               WHERE tokens.hash = $1 AND tokens.scope = $2
-              AND tokens.expiry > $3`
+              AND tokens.expiry > $3 AND NOT users.disabled`
 
-	args := []any{tokenHash[:], tokenScope, time.Now()}
+	args := []any{tokenHash, tokenScope, time.Now()}
 
 	var user User
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -224,11 +247,16 @@ func (m UserModel) GetUserByToken(tokenScope, tokenPlainText string) (*User, err
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
 		&user.ID,
+		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.CostBasisMethod,
+		&user.Currency,
+		&user.Role,
+		&user.Disabled,
 	)
 	if err != nil {
 		switch {
@@ -241,3 +269,192 @@ func (m UserModel) GetUserByToken(tokenScope, tokenPlainText string) (*User, err
 
 	return &user, nil
 }
+
+// / Store the address the user asked to change their email to. It replaces
+// / the current email once confirmed with an email-change token.
+func (m UserModel) SetPendingEmail(userID int64, email string) error {
+	query := `UPDATE users SET pending_email = $1 WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email, userID)
+	return err
+}
+
+// / The address the user asked to change their email to, empty when no
+// / change is pending.
+func (m UserModel) PendingEmail(userID int64) (string, error) {
+	query := `SELECT pending_email FROM users WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var email string
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&email)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", validator.ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+	return email, nil
+}
+
+// / Replace the email of the user of the email-change token with their
+// / pending email.
+// # Return
+// - the updated user
+// - ErrRecordNotFound if the token is invalid, expired or nothing is pending
+// - ErrDuplicateEmail if the address was registered in the meantime
+func (m UserModel) ConfirmPendingEmail(tokenPlainText string) (*User, error) {
+	query := `UPDATE users
+			  SET email = pending_email, pending_email = '', version = version + 1
+			  FROM tokens
+			  WHERE tokens.user_id = users.id AND tokens.hash = $1 AND tokens.scope = $2
+			  AND tokens.expiry > $3 AND users.pending_email <> '' AND NOT users.disabled
+			  RETURNING users.id, users.created_at, users.name, users.email, users.password_hash, users.activated,
+			  users.version, users.cost_basis_method, users.reporting_currency, users.role, users.disabled`
+
+	args := []any{HashToken(tokenPlainText), ScopeEmailChange, time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := scanUser(m.DB.QueryRowContext(ctx, query, args...))
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return nil, validator.ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, validator.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// / Delete the user. Holdings, transactions, portfolios, tokens, API keys
+// / and alerts go with it through ON DELETE CASCADE.
+func (m UserModel) Delete(id int64) error {
+	query := `DELETE FROM users WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return validator.ErrRecordNotFound
+	}
+	return nil
+}
+
+// / Retrieve a user by id.
+// # Return
+// - ErrRecordNotFound if there is no such user
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, validator.ErrRecordNotFound
+	}
+
+	query := `SELECT id, created_at, name, email, password_hash, activated, version, cost_basis_method, reporting_currency,
+			  role, disabled
+			  FROM users
+			  WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := scanUser(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, validator.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// / List users for the admin endpoints, optionally filtered by a part of
+// / the email and by role.
+// # Return
+// - the page of users and the total number of matching users
+func (m UserModel) GetAll(email, role string, filters Filters) ([]*User, int, error) {
+	query := fmt.Sprintf(`SELECT COUNT(*) OVER(), id, created_at, name, email, password_hash, activated, version,
+			  cost_basis_method, reporting_currency, role, disabled
+			  FROM users
+			  WHERE (email ILIKE '%%' || $1 || '%%') AND (role = $2 OR $2 = '')
+			  ORDER BY %s %s, id ASC
+			  LIMIT $3 OFFSET $4`, filters.SortColumn(), filters.SortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, email, role, filters.Limit(), filters.Offset())
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	total := 0
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&total,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+			&user.CostBasisMethod,
+			&user.Currency,
+			&user.Role,
+			&user.Disabled,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, &user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	var user User
+	err := row.Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.CostBasisMethod,
+		&user.Currency,
+		&user.Role,
+		&user.Disabled,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
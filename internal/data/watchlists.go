@@ -0,0 +1,201 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / Coins a watchlist can hold, enough for one batched market data call.
+const MaxWatchlistCoins = 100
+
+type WatchlistModel struct {
+	DB *sql.DB
+}
+
+// / A named list of coins the user follows without holding them.
+type Watchlist struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+	CoinIDs   []string  `json:"coins"`
+	Version   int       `json:"version"`
+}
+
+// / Market data of a watched coin. ATHDistance is how far the price is below
+// / the all-time high in percent, nil when the provider has no ATH.
+type WatchlistCoin struct {
+	CoinMarketData
+	ATHDistance *float64 `json:"ath_distance_percentage"`
+}
+
+func NewWatchlistCoin(m CoinMarketData) *WatchlistCoin {
+	c := &WatchlistCoin{CoinMarketData: m}
+	if m.ATH > 0 {
+		distance := (m.CurrentPrice/m.ATH - 1) * 100
+		c.ATHDistance = &distance
+	}
+	return c
+}
+
+func ValidateWatchlist(v *validator.Validator, w *Watchlist) {
+	v.Check(w.Name != "", "name", "must be provided")
+	v.Check(len(w.Name) <= 100, "name", "must not be more than 100 bytes")
+
+	v.Check(len(w.CoinIDs) <= MaxWatchlistCoins, "coins", "must not contain more than 100 coins")
+	seen := make(map[string]bool, len(w.CoinIDs))
+	for _, coinID := range w.CoinIDs {
+		v.Check(coinID != "", "coins", "must not contain empty coin ids")
+		v.Check(len(coinID) <= 100, "coins", "must not contain coin ids longer than 100 bytes")
+		v.Check(!seen[coinID], "coins", "must not contain duplicate coin ids")
+		seen[coinID] = true
+	}
+}
+
+func (m WatchlistModel) Insert(w *Watchlist) error {
+	query := `INSERT INTO watchlists(user_id, name, coin_ids)
+              VALUES($1, $2, $3)
+              RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, w.UserID, w.Name, pq.Array(w.CoinIDs)).
+		Scan(&w.ID, &w.CreatedAt, &w.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "watchlists_user_id_name_key"`:
+			return validator.ErrDuplicateWatchlist
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// / Retrieve a watchlist of the user by id.
+func (m WatchlistModel) Get(id, userID int64) (*Watchlist, error) {
+	if id < 1 {
+		return nil, validator.ErrRecordNotFound
+	}
+
+	query := `SELECT id, user_id, created_at, name, coin_ids, version
+              FROM watchlists
+              WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanWatchlist(m.DB.QueryRowContext(ctx, query, id, userID))
+}
+
+// / List the watchlists of the user by name.
+func (m WatchlistModel) GetAllForUser(userID int64) ([]*Watchlist, error) {
+	query := `SELECT id, user_id, created_at, name, coin_ids, version
+              FROM watchlists
+              WHERE user_id = $1
+              ORDER BY name ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	watchlists := []*Watchlist{}
+	for rows.Next() {
+		w, err := scanWatchlist(rows)
+		if err != nil {
+			return nil, err
+		}
+		watchlists = append(watchlists, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return watchlists, nil
+}
+
+// / Rename a watchlist or replace its coins with optimistic locking on
+// / version.
+func (m WatchlistModel) Update(w *Watchlist) error {
+	query := `UPDATE watchlists
+              SET name = $1, coin_ids = $2, version = version + 1
+              WHERE id = $3 AND user_id = $4 AND version = $5
+              RETURNING version`
+
+	args := []any{w.Name, pq.Array(w.CoinIDs), w.ID, w.UserID, w.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&w.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "watchlists_user_id_name_key"`:
+			return validator.ErrDuplicateWatchlist
+		case errors.Is(err, sql.ErrNoRows):
+			return validator.ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m WatchlistModel) Delete(id, userID int64) error {
+	if id < 1 {
+		return validator.ErrRecordNotFound
+	}
+
+	query := `DELETE FROM watchlists WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return validator.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func scanWatchlist(row rowScanner) (*Watchlist, error) {
+	var w Watchlist
+	err := row.Scan(
+		&w.ID,
+		&w.UserID,
+		&w.CreatedAt,
+		&w.Name,
+		pq.Array(&w.CoinIDs),
+		&w.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, validator.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &w, nil
+}
@@ -0,0 +1,415 @@
+// / Package importer parses CSV exports of exchanges into ledger rows. It
+// / only reads files, mapping tickers to coins and storing the rows is left
+// / to the caller.
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+const (
+	FormatBinance  = "binance"
+	FormatCoinbase = "coinbase"
+	FormatKraken   = "kraken"
+	FormatGeneric  = "generic"
+)
+
+var Formats = []string{FormatBinance, FormatCoinbase, FormatKraken, FormatGeneric}
+
+// / Rows beyond this are rejected, larger histories are imported in parts.
+const MaxRows = 5000
+
+var (
+	ErrUnknownFormat = errors.New("unknown import format")
+	ErrNoHeader      = errors.New("no header row with the columns of the format was found")
+	ErrTooManyRows   = fmt.Errorf("the file has more than %d rows", MaxRows)
+)
+
+// / A ledger entry read from a file. Symbol is the ticker of the coin, or
+// / CoinID is set when the file names the coin directly. Price and fee are
+// / in Currency, which is empty when the file doesn't say.
+type Row struct {
+	Line       int
+	Time       time.Time
+	Type       string
+	Symbol     string
+	CoinID     string
+	Quantity   float64
+	Price      float64
+	Fee        float64
+	Currency   string
+	FXRate     float64
+	Note       string
+	ExternalID string
+
+	// Identity of the row across imports, see hashRow.
+	Hash string
+}
+
+// / A row that couldn't be read, reported back instead of failing the file.
+type RowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// / Columns of the generic format. Date, type, quantity and either symbol
+// / or coin_id are required, the values are the names of the columns.
+type Mapping struct {
+	Date     string `json:"date"`
+	Type     string `json:"type"`
+	Symbol   string `json:"symbol"`
+	CoinID   string `json:"coin_id"`
+	Quantity string `json:"quantity"`
+	Price    string `json:"price"`
+	Fee      string `json:"fee"`
+	Currency string `json:"currency"`
+	FXRate   string `json:"fx_rate"`
+	Note     string `json:"note"`
+	ID       string `json:"id"`
+}
+
+// / Parse reads a CSV file in the given format.
+// # Parameters
+// - mapping: columns of the generic format, ignored by the others
+// # Return
+// - the rows that were read and the errors of the rows that weren't
+// - an error if the file can't be read as the format at all
+func Parse(format string, r io.Reader, mapping Mapping) ([]*Row, []RowError, error) {
+	var parse rowParser
+
+	switch format {
+	case FormatBinance:
+		parse = parseBinance
+	case FormatCoinbase:
+		parse = parseCoinbase
+	case FormatKraken:
+		parse = parseKraken
+	case FormatGeneric:
+		if err := mapping.validate(); err != nil {
+			return nil, nil, err
+		}
+		parse = mapping.parse
+	default:
+		return nil, nil, ErrUnknownFormat
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.TrimLeadingSpace = true
+
+	var (
+		records [][]string
+		lines   []int
+	)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		line, _ := cr.FieldPos(0)
+		records = append(records, record)
+		lines = append(lines, line)
+	}
+
+	start, cols := -1, columns{}
+	for i, record := range records {
+		cols = newColumns(record)
+		if parse(cols, nil) == nil {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil, nil, ErrNoHeader
+	}
+
+	if len(records)-start-1 > MaxRows {
+		return nil, nil, ErrTooManyRows
+	}
+
+	rows := []*Row{}
+	rowErrors := []RowError{}
+	seen := map[string]int{}
+
+	for i, record := range records[start+1:] {
+		line := lines[start+1+i]
+		if blank(record) {
+			continue
+		}
+
+		row := &Row{Line: line}
+		if err := parse(cols, &fileRecord{record, row}); err != nil {
+			rowErrors = append(rowErrors, RowError{Line: line, Error: err.Error()})
+			continue
+		}
+
+		row.Symbol = strings.ToLower(row.Symbol)
+		row.Currency = normalizeCurrency(row.Currency)
+		row.Hash = hashRow(format, row, record, seen)
+		rows = append(rows, row)
+	}
+	return rows, rowErrors, nil
+}
+
+// / A parser of one layout. With a nil record it only checks that the
+// / header has the columns it needs.
+type rowParser func(cols columns, rec *fileRecord) error
+
+// / A record of the file and the row it's read into.
+type fileRecord struct {
+	fields []string
+	row    *Row
+}
+
+// / Identity of a row: the id the exchange gave it, or its content and how
+// / often the same content appeared before in the file. Identical fills in
+// / one file stay separate rows, the same file imported again maps to the
+// / same hashes.
+func hashRow(format string, row *Row, record []string, seen map[string]int) string {
+	key := format + "\x1f"
+	if row.ExternalID != "" {
+		key += "id\x1f" + row.ExternalID
+	} else {
+		content := strings.Join(record, "\x1f")
+		seen[content]++
+		key += content + "\x1f" + strconv.Itoa(seen[content])
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// / Column indexes of a header by lowercased name.
+type columns map[string]int
+
+func newColumns(header []string) columns {
+	cols := columns{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if _, ok := cols[name]; !ok {
+			cols[name] = i
+		}
+	}
+	return cols
+}
+
+// / Index of the first of the names present in the header, -1 if none is.
+func (c columns) find(names ...string) int {
+	for _, name := range names {
+		if i, ok := c[strings.ToLower(name)]; ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// / Check that each group of alternative names has a column in the header.
+func (c columns) require(groups ...[]string) error {
+	for _, names := range groups {
+		if c.find(names...) < 0 {
+			return fmt.Errorf("missing column %q", names[0])
+		}
+	}
+	return nil
+}
+
+// / Value of the column, empty if the header doesn't have it or the record
+// / is short.
+func (c columns) get(fields []string, names ...string) string {
+	i := c.find(names...)
+	if i < 0 || i >= len(fields) {
+		return ""
+	}
+	return strings.TrimSpace(fields[i])
+}
+
+func (m Mapping) validate() error {
+	switch {
+	case m.Date == "":
+		return errors.New("the mapping needs a date column")
+	case m.Type == "":
+		return errors.New("the mapping needs a type column")
+	case m.Quantity == "":
+		return errors.New("the mapping needs a quantity column")
+	case m.Symbol == "" && m.CoinID == "":
+		return errors.New("the mapping needs a symbol or coin_id column")
+	}
+	return nil
+}
+
+func (m Mapping) parse(cols columns, rec *fileRecord) error {
+	required := [][]string{{m.Date}, {m.Type}, {m.Quantity}}
+	for _, name := range []string{m.Symbol, m.CoinID, m.Price, m.Fee, m.Currency, m.FXRate, m.Note, m.ID} {
+		if name != "" {
+			required = append(required, []string{name})
+		}
+	}
+	if err := cols.require(required...); err != nil || rec == nil {
+		return err
+	}
+
+	f, row := rec.fields, rec.row
+	var err error
+
+	if row.Time, err = parseTime(cols.get(f, m.Date)); err != nil {
+		return err
+	}
+
+	row.Type = strings.ToLower(cols.get(f, m.Type))
+	if !validator.PermittedValues(row.Type, data.TransactionTypes...) {
+		return fmt.Errorf("unknown type %q", cols.get(f, m.Type))
+	}
+
+	if m.Symbol != "" {
+		row.Symbol = cols.get(f, m.Symbol)
+	}
+	if m.CoinID != "" {
+		row.CoinID = strings.ToLower(cols.get(f, m.CoinID))
+	}
+	if row.Symbol == "" && row.CoinID == "" {
+		return errors.New("symbol or coin_id must be provided")
+	}
+
+	if row.Quantity, err = parseNumber(cols.get(f, m.Quantity)); err != nil {
+		return fmt.Errorf("quantity: %w", err)
+	}
+	row.Quantity = abs(row.Quantity)
+
+	if m.Price != "" {
+		if row.Price, err = parseOptionalNumber(cols.get(f, m.Price)); err != nil {
+			return fmt.Errorf("price: %w", err)
+		}
+	}
+	if m.Fee != "" {
+		if row.Fee, err = parseOptionalNumber(cols.get(f, m.Fee)); err != nil {
+			return fmt.Errorf("fee: %w", err)
+		}
+	}
+	if m.Currency != "" {
+		row.Currency = cols.get(f, m.Currency)
+	}
+	if m.FXRate != "" {
+		if row.FXRate, err = parseOptionalNumber(cols.get(f, m.FXRate)); err != nil {
+			return fmt.Errorf("fx_rate: %w", err)
+		}
+		if row.FXRate < 0 {
+			return errors.New("fx_rate must not be negative")
+		}
+	}
+	if m.Note != "" {
+		row.Note = cols.get(f, m.Note)
+	}
+	if m.ID != "" {
+		row.ExternalID = cols.get(f, m.ID)
+	}
+	return nil
+}
+
+// / Layouts of the timestamps found in exchange exports, read as UTC when
+// / they carry no zone. Fractional seconds are accepted by every layout.
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"01/02/2006 15:04:05",
+	"01/02/2006 15:04",
+	"01/02/2006",
+}
+
+func parseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date %q", s)
+}
+
+// / Parse a number as exchanges write them: thousands separators, currency
+// / signs and surrounding spaces are dropped.
+func parseNumber(s string) (float64, error) {
+	cleaned := strings.Map(func(r rune) rune {
+		switch r {
+		case ',', '$', '€', '£', ' ':
+			return -1
+		}
+		return r
+	}, s)
+
+	n, err := strconv.ParseFloat(cleaned, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return n, nil
+}
+
+// / parseNumber that reads an empty value as zero.
+func parseOptionalNumber(s string) (float64, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+	return parseNumber(s)
+}
+
+// / Split an amount with its asset appended, e.g. 0.015BTC, into the number
+// / and the lowercased asset.
+func parseAmount(s string) (float64, string, error) {
+	s = strings.TrimSpace(s)
+	i := len(s)
+	for i > 0 && (s[i-1] < '0' || s[i-1] > '9') && s[i-1] != '.' {
+		i--
+	}
+
+	n, err := parseNumber(s[:i])
+	if err != nil {
+		return 0, "", err
+	}
+	return n, strings.ToLower(strings.TrimSpace(s[i:])), nil
+}
+
+// / Stablecoins are priced as the dollar they track.
+var stablecoins = map[string]bool{"usdt": true, "usdc": true, "busd": true, "tusd": true, "fdusd": true, "dai": true}
+
+func normalizeCurrency(c string) string {
+	c = strings.ToLower(strings.TrimSpace(c))
+	if stablecoins[c] {
+		return data.BaseCurrency
+	}
+	return c
+}
+
+func blank(record []string) bool {
+	for _, field := range record {
+		if strings.TrimSpace(field) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(f float64) float64 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
@@ -0,0 +1,239 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+)
+
+// / Binance spot trade history, both the classic layout
+// / (Date(UTC),Pair,Side,Price,Executed,Amount,Fee) with the asset appended
+// / to the amounts and the newer one with Base Asset, Quote Asset and
+// / Fee Coin columns.
+func parseBinance(cols columns, rec *fileRecord) error {
+	err := cols.require(
+		[]string{"Date(UTC)", "Date"},
+		[]string{"Pair", "Market"},
+		[]string{"Side", "Type"},
+		[]string{"Price"},
+		[]string{"Executed", "Amount"},
+	)
+	if err != nil || rec == nil {
+		return err
+	}
+
+	f, row := rec.fields, rec.row
+
+	if row.Time, err = parseTime(cols.get(f, "Date(UTC)", "Date")); err != nil {
+		return err
+	}
+
+	switch side := strings.ToLower(cols.get(f, "Side", "Type")); side {
+	case "buy":
+		row.Type = data.TransactionBuy
+	case "sell":
+		row.Type = data.TransactionSell
+	default:
+		return fmt.Errorf("unknown side %q", side)
+	}
+
+	base := strings.ToLower(cols.get(f, "Base Asset"))
+	quote := strings.ToLower(cols.get(f, "Quote Asset"))
+	if base == "" || quote == "" {
+		base, quote = splitPair(cols.get(f, "Pair", "Market"), binanceQuotes)
+		if base == "" {
+			return fmt.Errorf("unrecognized pair %q", cols.get(f, "Pair", "Market"))
+		}
+	}
+	row.Symbol = base
+	row.Currency = quote
+
+	if row.Price, err = parseNumber(cols.get(f, "Price")); err != nil {
+		return fmt.Errorf("price: %w", err)
+	}
+
+	executed := cols.get(f, "Executed")
+	if executed == "" {
+		executed = cols.get(f, "Amount")
+	}
+	if row.Quantity, _, err = parseAmount(executed); err != nil {
+		return fmt.Errorf("quantity: %w", err)
+	}
+
+	fee, feeAsset, err := parseAmount(cols.get(f, "Fee"))
+	if err != nil && cols.get(f, "Fee") != "" {
+		return fmt.Errorf("fee: %w", err)
+	}
+	if asset := cols.get(f, "Fee Coin", "Fee Asset"); asset != "" {
+		feeAsset = strings.ToLower(asset)
+	}
+
+	switch feeAsset {
+	case "", quote:
+		row.Fee = fee
+	case base:
+		row.Fee = fee * row.Price
+	default:
+		if fee > 0 {
+			row.Note = fmt.Sprintf("fee of %g %s not included", fee, feeAsset)
+		}
+	}
+	return nil
+}
+
+// / Quote assets of Binance pairs, longest first so USDT wins over USD.
+var binanceQuotes = []string{
+	"fdusd", "usdt", "busd", "usdc", "tusd", "dai", "usd", "eur", "gbp", "try", "brl", "btc", "eth", "bnb",
+}
+
+// / Coinbase transaction history. Older exports put a few lines of account
+// / details above the header, the header row is found by its columns.
+func parseCoinbase(cols columns, rec *fileRecord) error {
+	err := cols.require(
+		[]string{"Timestamp"},
+		[]string{"Transaction Type"},
+		[]string{"Asset"},
+		[]string{"Quantity Transacted"},
+	)
+	if err != nil || rec == nil {
+		return err
+	}
+
+	f, row := rec.fields, rec.row
+
+	if row.Time, err = parseTime(cols.get(f, "Timestamp")); err != nil {
+		return err
+	}
+
+	kind := cols.get(f, "Transaction Type")
+	switch strings.ToLower(kind) {
+	case "buy", "advanced trade buy":
+		row.Type = data.TransactionBuy
+	case "sell", "advanced trade sell":
+		row.Type = data.TransactionSell
+	case "receive", "deposit":
+		row.Type = data.TransactionTransferIn
+	case "send", "withdrawal":
+		row.Type = data.TransactionTransferOut
+	case "rewards income", "coinbase earn", "learning reward", "staking income", "inflation reward":
+		row.Type = data.TransactionAirdrop
+	case "convert":
+		return errors.New("convert transactions aren't supported, record them as a sell and a buy")
+	default:
+		return fmt.Errorf("unknown transaction type %q", kind)
+	}
+
+	row.Symbol = cols.get(f, "Asset")
+
+	if row.Quantity, err = parseNumber(cols.get(f, "Quantity Transacted")); err != nil {
+		return fmt.Errorf("quantity: %w", err)
+	}
+	row.Quantity = abs(row.Quantity)
+
+	price := cols.get(f, "Spot Price at Transaction", "Price at Transaction")
+	if row.Price, err = parseOptionalNumber(price); err != nil {
+		return fmt.Errorf("price: %w", err)
+	}
+
+	fee := cols.get(f, "Fees and/or Spread", "Fees")
+	if row.Fee, err = parseOptionalNumber(fee); err != nil {
+		return fmt.Errorf("fee: %w", err)
+	}
+	row.Fee = abs(row.Fee)
+
+	row.Currency = cols.get(f, "Spot Price Currency", "Price Currency")
+	row.Note = cols.get(f, "Notes")
+	row.ExternalID = cols.get(f, "ID")
+	return nil
+}
+
+// / Kraken trades export (txid,ordertxid,pair,time,type,ordertype,price,
+// / cost,fee,vol,...). Price and fee are in the quote currency of the pair.
+func parseKraken(cols columns, rec *fileRecord) error {
+	err := cols.require(
+		[]string{"txid"},
+		[]string{"pair"},
+		[]string{"time"},
+		[]string{"type"},
+		[]string{"price"},
+		[]string{"fee"},
+		[]string{"vol"},
+	)
+	if err != nil || rec == nil {
+		return err
+	}
+
+	f, row := rec.fields, rec.row
+
+	if row.Time, err = parseTime(cols.get(f, "time")); err != nil {
+		return err
+	}
+
+	switch side := strings.ToLower(cols.get(f, "type")); side {
+	case "buy":
+		row.Type = data.TransactionBuy
+	case "sell":
+		row.Type = data.TransactionSell
+	default:
+		return fmt.Errorf("unknown type %q", side)
+	}
+
+	pair := cols.get(f, "pair")
+	base, quote := splitPair(pair, krakenQuotes)
+	if base == "" {
+		return fmt.Errorf("unrecognized pair %q", pair)
+	}
+	row.Symbol = krakenAsset(base)
+	row.Currency = krakenAsset(quote)
+
+	if row.Price, err = parseNumber(cols.get(f, "price")); err != nil {
+		return fmt.Errorf("price: %w", err)
+	}
+	if row.Fee, err = parseOptionalNumber(cols.get(f, "fee")); err != nil {
+		return fmt.Errorf("fee: %w", err)
+	}
+	if row.Quantity, err = parseNumber(cols.get(f, "vol")); err != nil {
+		return fmt.Errorf("quantity: %w", err)
+	}
+
+	row.ExternalID = cols.get(f, "txid")
+	return nil
+}
+
+// / Quote assets of Kraken pairs, with and without their legacy X and Z
+// / prefixes.
+var krakenQuotes = []string{
+	"zusd", "zeur", "zgbp", "zcad", "zjpy", "zaud", "usdt", "usdc", "usd", "eur", "gbp", "cad", "jpy", "aud",
+	"xxbt", "xbt", "xeth", "eth",
+}
+
+// / Translate a Kraken asset code to the usual ticker: legacy four letter
+// / codes lose their X or Z prefix and XBT and XDG become BTC and DOGE.
+func krakenAsset(code string) string {
+	code = strings.ToLower(code)
+	if len(code) == 4 && (code[0] == 'x' || code[0] == 'z') {
+		code = code[1:]
+	}
+
+	switch code {
+	case "xbt":
+		return "btc"
+	case "xdg":
+		return "doge"
+	}
+	return code
+}
+
+// / Split a pair like BTCUSDT into base and quote with the first quote it
+// / ends with. Both are empty if none matches.
+func splitPair(pair string, quotes []string) (string, string) {
+	pair = strings.ToLower(strings.NewReplacer("/", "", "-", "", "_", "").Replace(strings.TrimSpace(pair)))
+	for _, quote := range quotes {
+		if base, ok := strings.CutSuffix(pair, quote); ok && base != "" {
+			return base, quote
+		}
+	}
+	return "", ""
+}
@@ -12,11 +12,22 @@ import (
 )
 
 type Models struct {
-	User  data.UserModel
-	Token data.TokenModel
-	Coin  data.CoinModel
-	RDB   *redis.Client
-	Cache *cache.Cache
+	User        data.UserModel
+	Token       data.TokenModel
+	Coin        data.CoinModel
+	Transaction data.TransactionModel
+	Portfolio   data.PortfolioModel
+	Snapshot    data.SnapshotModel
+	Price       data.PriceHistoryModel
+	Alert       data.AlertModel
+	APIKey      data.APIKeyModel
+	TwoFactor   data.TwoFactorModel
+	Audit       data.AuditModel
+	Export      data.ExportModel
+	Watchlist   data.WatchlistModel
+	Target      data.TargetModel
+	RDB         *redis.Client
+	Cache       *cache.Cache
 }
 
 func NewModels(
@@ -26,10 +37,21 @@ func NewModels(
 	logger zerolog.Logger,
 ) (Models, error) {
 	return Models{
-		User:  data.UserModel{DB: db},
-		Token: data.TokenModel{DB: db},
-		Coin:  data.CoinModel{DB: db, Cache: cache, Logger: logger},
-		RDB:   rdb,
-		Cache: cache,
+		User:        data.UserModel{DB: db},
+		Token:       data.TokenModel{DB: db},
+		Coin:        data.CoinModel{DB: db, RDB: rdb, Cache: cache, Logger: logger},
+		Transaction: data.TransactionModel{DB: db, Cache: cache, Logger: logger},
+		Portfolio:   data.PortfolioModel{DB: db},
+		Snapshot:    data.SnapshotModel{DB: db},
+		Price:       data.PriceHistoryModel{DB: db},
+		Alert:       data.AlertModel{DB: db},
+		APIKey:      data.APIKeyModel{DB: db},
+		TwoFactor:   data.TwoFactorModel{DB: db},
+		Audit:       data.AuditModel{DB: db},
+		Export:      data.ExportModel{DB: db, RDB: rdb},
+		Watchlist:   data.WatchlistModel{DB: db},
+		Target:      data.TargetModel{DB: db},
+		RDB:         rdb,
+		Cache:       cache,
 	}, nil
 }
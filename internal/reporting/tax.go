@@ -0,0 +1,467 @@
+// / Package reporting builds reports over the ledger of a user. It only
+// / computes, loading the ledger and prices is left to the caller.
+package reporting
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+const (
+	TermShort = "short"
+	TermLong  = "long"
+)
+
+// / TaxRules are the jurisdiction dependent parts of a capital gains report.
+type TaxRules struct {
+	// / First day of the fiscal year, e.g. April 6 in the UK.
+	YearStartMonth time.Month
+	YearStartDay   int
+
+	// / Disposals of units held longer than this many days are long-term.
+	LongTermDays int
+}
+
+// / Parse a fiscal year start written as MM-DD.
+func ParseYearStart(s string) (time.Month, int, error) {
+	t, err := time.Parse("01-02", s)
+	if err != nil || (t.Month() == time.February && t.Day() == 29) {
+		return 0, 0, fmt.Errorf("invalid fiscal year start %q, expected MM-DD", s)
+	}
+	return t.Month(), t.Day(), nil
+}
+
+// / Bounds of the fiscal year that starts in the given calendar year, the
+// / end is exclusive. With a January 1 start it's the calendar year.
+func (r TaxRules) FiscalYear(year int) (time.Time, time.Time) {
+	from := time.Date(year, r.YearStartMonth, r.YearStartDay, 0, 0, 0, 0, time.UTC)
+	return from, from.AddDate(1, 0, 0)
+}
+
+// / Term of a disposal of units held between the two times.
+func (r TaxRules) Term(acquiredAt, disposedAt time.Time) string {
+	if holdingDays(acquiredAt, disposedAt) > r.LongTermDays {
+		return TermLong
+	}
+	return TermShort
+}
+
+func holdingDays(acquiredAt, disposedAt time.Time) int {
+	return int(disposedAt.Sub(acquiredAt).Hours() / 24)
+}
+
+// / A disposal of the report: the part of a sell or coin fee matched against
+// / one acquisition. Money fields are in USD until converted.
+type TaxDisposal struct {
+	TransactionID    int64     `json:"transaction_id"`
+	LotTransactionID int64     `json:"lot_transaction_id"`
+	PortfolioID      int64     `json:"portfolio_id"`
+	CoinID           string    `json:"coin_id"`
+	Symbol           string    `json:"symbol"`
+	Type             string    `json:"type"`
+	Quantity         float64   `json:"quantity"`
+	AcquiredAt       time.Time `json:"acquired_at"`
+	DisposedAt       time.Time `json:"disposed_at"`
+	HoldingDays      int       `json:"holding_days"`
+	Term             string    `json:"term"`
+	Proceeds         float64   `json:"proceeds"`
+	CostBasis        float64   `json:"cost_basis"`
+	Gain             float64   `json:"gain"`
+
+	// Proceeds or cost basis use the market price of the day because the
+	// ledger entry was recorded without a price.
+	Estimated bool `json:"estimated"`
+
+	// Proceeds or cost basis were converted at the current exchange rate,
+	// no rate of their day is known. See TaxReport.Convert.
+	FXEstimated bool `json:"fx_estimated"`
+}
+
+type TaxTotals struct {
+	Disposals int     `json:"disposals"`
+	Proceeds  float64 `json:"proceeds"`
+	CostBasis float64 `json:"cost_basis"`
+	Gain      float64 `json:"gain"`
+}
+
+func (t *TaxTotals) add(d *TaxDisposal) {
+	t.Disposals++
+	t.Proceeds += d.Proceeds
+	t.CostBasis += d.CostBasis
+	t.Gain += d.Gain
+}
+
+// / Capital gains of a fiscal year, disposals in execution order.
+type TaxReport struct {
+	Year            int            `json:"year"`
+	From            time.Time      `json:"from"`
+	To              time.Time      `json:"to"`
+	CostBasisMethod string         `json:"cost_basis_method"`
+	LongTermDays    int            `json:"long_term_days"`
+	Currency        string         `json:"currency"`
+	ShortTerm       TaxTotals      `json:"short_term"`
+	LongTerm        TaxTotals      `json:"long_term"`
+	Total           TaxTotals      `json:"total"`
+	Disposals       []*TaxDisposal `json:"disposals"`
+
+	// Ledger entries up to the end of the year, the source of the exchange
+	// rates of Convert.
+	ledger []*data.Transaction
+}
+
+// / PriceFunc returns the USD price of a coin at a past time, or
+// / ErrRecordNotFound when there is none.
+type PriceFunc func(coinID string, at time.Time) (float64, error)
+
+// / BuildTaxReport replays the ledger of every holding with the cost-basis
+// / method and reports the disposals of the fiscal year. Acquisitions and
+// / sells recorded without a price, like airdrops, are priced at the market
+// / price of their time, ledger entries after the year are ignored. A
+// / transfer in without a price that a transfer out of another portfolio
+// / sent is a move between the portfolios of the user, not an acquisition:
+// / it receives the lots the transfer out took, with their basis and the
+// / time they were acquired.
+// # Parameters
+// - txs: the whole ledger of the user in execution order, transfers are
+// paired across its portfolios
+// - portfolioID: report the disposals of this portfolio only, zero for all
+// - price: historical prices, only asked for entries without a price
+// # Return
+// - the report in USD with Currency set to usd
+func BuildTaxReport(
+	txs []*data.Transaction,
+	portfolioID int64,
+	method string,
+	rules TaxRules,
+	year int,
+	price PriceFunc,
+) (*TaxReport, error) {
+	from, to := rules.FiscalYear(year)
+
+	report := &TaxReport{
+		Year:            year,
+		From:            from,
+		To:              to,
+		CostBasisMethod: method,
+		LongTermDays:    rules.LongTermDays,
+		Currency:        data.BaseCurrency,
+		Disposals:       []*TaxDisposal{},
+	}
+
+	var keys []holdingKey
+	disposing := make(map[holdingKey]bool)
+
+	r := &replay{
+		method:    method,
+		price:     price,
+		ledgers:   make(map[holdingKey][]*data.Transaction),
+		index:     make(map[int64]int),
+		priced:    make(map[int64]*data.Transaction),
+		moved:     make(map[int64][]*data.Disposal),
+		estimated: make(map[int64]bool),
+	}
+
+	for _, t := range txs {
+		if !t.ExecutedAt.Before(to) {
+			continue
+		}
+
+		report.ledger = append(report.ledger, t)
+
+		key := holdingKey{t.PortfolioID, t.CoinID}
+		if _, ok := r.ledgers[key]; !ok {
+			keys = append(keys, key)
+		}
+		r.index[t.ID] = len(r.ledgers[key])
+		r.ledgers[key] = append(r.ledgers[key], t)
+
+		if portfolioID != 0 && t.PortfolioID != portfolioID {
+			continue
+		}
+		if !t.Increases() && t.Type != data.TransactionTransferOut && !t.ExecutedAt.Before(from) {
+			disposing[key] = true
+		}
+	}
+
+	r.pairs = pairTransfers(report.ledger)
+
+	for _, key := range keys {
+		if !disposing[key] {
+			continue
+		}
+
+		ledger, err := r.ledger(key, len(r.ledgers[key]))
+		if err != nil {
+			return nil, err
+		}
+
+		book, err := data.BuildLots(ledger, method)
+		if err != nil {
+			return nil, err
+		}
+
+		symbol := r.ledgers[key][0].Symbol
+		for _, d := range book.Disposals {
+			if d.DisposedAt.Before(from) {
+				continue
+			}
+
+			td := &TaxDisposal{
+				TransactionID:    d.TransactionID,
+				LotTransactionID: d.LotTransactionID,
+				PortfolioID:      key.portfolioID,
+				CoinID:           d.CoinID,
+				Symbol:           symbol,
+				Type:             d.Type,
+				Quantity:         d.Quantity,
+				AcquiredAt:       d.AcquiredAt,
+				DisposedAt:       d.DisposedAt,
+				HoldingDays:      holdingDays(d.AcquiredAt, d.DisposedAt),
+				Term:             rules.Term(d.AcquiredAt, d.DisposedAt),
+				Proceeds:         d.Proceeds,
+				CostBasis:        d.CostBasis,
+				Gain:             d.Gain,
+				Estimated:        r.estimated[d.TransactionID] || r.estimated[d.LotTransactionID],
+			}
+			report.Disposals = append(report.Disposals, td)
+		}
+	}
+
+	sortDisposals(report.Disposals)
+	report.sum()
+
+	return report, nil
+}
+
+// / Add the disposals up into the totals.
+func (r *TaxReport) sum() {
+	r.ShortTerm, r.LongTerm, r.Total = TaxTotals{}, TaxTotals{}, TaxTotals{}
+
+	for _, d := range r.Disposals {
+		if d.Term == TermLong {
+			r.LongTerm.add(d)
+		} else {
+			r.ShortTerm.add(d)
+		}
+		r.Total.add(d)
+	}
+}
+
+type holdingKey struct {
+	portfolioID int64
+	coinID      string
+}
+
+// / replay prepares the ledgers of the holdings for BuildLots. Transfers in
+// / paired with a transfer out depend on the ledger of the other portfolio
+// / up to the transfer out, which always executes earlier.
+type replay struct {
+	method string
+	price  PriceFunc
+
+	// Ledger of each holding and the position of every entry in it.
+	ledgers map[holdingKey][]*data.Transaction
+	index   map[int64]int
+
+	// Transfer out sending each paired transfer in.
+	pairs map[int64]*data.Transaction
+
+	// Entries priced so far, lots taken by each replayed transfer out and
+	// the ids of the entries priced at the market.
+	priced    map[int64]*data.Transaction
+	moved     map[int64][]*data.Disposal
+	estimated map[int64]bool
+}
+
+// / The first n entries of the ledger of the holding, acquisitions and sells
+// / without a price priced at the market and paired transfers in replaced by
+// / the lots they receive. Coins the price source doesn't know keep a zero
+// / price.
+func (r *replay) ledger(key holdingKey, n int) ([]*data.Transaction, error) {
+	ledger := make([]*data.Transaction, 0, n)
+
+	for _, t := range r.ledgers[key][:n] {
+		if source, ok := r.pairs[t.ID]; ok {
+			lots, err := r.received(t, source)
+			if err != nil {
+				return nil, err
+			}
+			ledger = append(ledger, lots...)
+			continue
+		}
+
+		priced, err := r.priceEntry(t)
+		if err != nil {
+			return nil, err
+		}
+		ledger = append(ledger, priced)
+	}
+	return ledger, nil
+}
+
+func (r *replay) priceEntry(t *data.Transaction) (*data.Transaction, error) {
+	if t.Price > 0 || !(t.Increases() || t.Type == data.TransactionSell) {
+		return t, nil
+	}
+	if priced, ok := r.priced[t.ID]; ok {
+		return priced, nil
+	}
+
+	usd, err := r.price(t.CoinID, t.ExecutedAt)
+	switch {
+	case errors.Is(err, validator.ErrRecordNotFound):
+		r.priced[t.ID] = t
+		return t, nil
+	case err != nil:
+		return nil, err
+	}
+
+	c := *t
+	c.Price = usd * c.FXRate
+	r.priced[t.ID] = &c
+	r.estimated[t.ID] = true
+	return &c, nil
+}
+
+// / The lots a paired transfer in receives, as acquisitions in USD that keep
+// / the id and time of the acquisition they come from. A transfer in of less
+// / than was sent receives the same share of every lot, its fee adds to the
+// / basis.
+func (r *replay) received(in, out *data.Transaction) ([]*data.Transaction, error) {
+	parts, ok := r.moved[out.ID]
+	if !ok {
+		key := holdingKey{out.PortfolioID, out.CoinID}
+		ledger, err := r.ledger(key, r.index[out.ID]+1)
+		if err != nil {
+			return nil, err
+		}
+
+		book, err := data.BuildLots(ledger, r.method)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, d := range book.Transfers {
+			if d.TransactionID == out.ID && d.Quantity > 0 {
+				parts = append(parts, d)
+			}
+		}
+		r.moved[out.ID] = parts
+	}
+
+	share := in.Quantity / out.Quantity
+	lots := make([]*data.Transaction, 0, len(parts))
+
+	for i, d := range parts {
+		c := *in
+		c.ID = d.LotTransactionID
+		c.Quantity = d.Quantity * share
+		c.Price = d.CostBasis / d.Quantity
+		c.Currency = data.BaseCurrency
+		c.FXRate = 1
+		c.Fee = 0
+		if i == 0 {
+			c.Fee = in.FeeUSD()
+		}
+		c.ExecutedAt = d.AcquiredAt
+		lots = append(lots, &c)
+	}
+	return lots, nil
+}
+
+// / Pair every transfer in without a price with the latest earlier transfer
+// / out of the coin from another portfolio that sent at least as much and
+// / isn't paired yet.
+// # Parameters
+// - ledger: entries of every portfolio in execution order
+// # Return
+// - the transfer out of each paired transfer in by its id
+func pairTransfers(ledger []*data.Transaction) map[int64]*data.Transaction {
+	pairs := make(map[int64]*data.Transaction)
+	var sent []*data.Transaction
+
+	for _, t := range ledger {
+		switch {
+		case t.Type == data.TransactionTransferOut:
+			sent = append(sent, t)
+		case t.Type == data.TransactionTransferIn && t.Price == 0:
+			for i := len(sent) - 1; i >= 0; i-- {
+				out := sent[i]
+				if out.CoinID != t.CoinID || out.PortfolioID == t.PortfolioID || t.Quantity > out.Quantity {
+					continue
+				}
+				pairs[t.ID] = out
+				sent = slices.Delete(sent, i, i+1)
+				break
+			}
+		}
+	}
+	return pairs
+}
+
+// / Order disposals by time and transaction, so disposals of different
+// / holdings interleave as they happened. The lots of a transaction stay in
+// / the order they were consumed.
+func sortDisposals(disposals []*TaxDisposal) {
+	slices.SortStableFunc(disposals, func(a, b *TaxDisposal) int {
+		if c := a.DisposedAt.Compare(b.DisposedAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.TransactionID, b.TransactionID)
+	})
+}
+
+// / Convert the money fields of the report from USD into the currency. The
+// / proceeds are converted at the rate of the day of the disposal and the
+// / cost basis at the rate of the day of the acquisition: the rate stored
+// / on the ledger entry when it was recorded in the currency, else the rate
+// / of another entry recorded in the currency that day. Disposals with a
+// / leg of neither use the current rate and are flagged FXEstimated.
+// # Parameters
+// - rate: current rate of the currency, units per USD
+func (r *TaxReport) Convert(currency string, rate float64) {
+	r.Currency = currency
+	if currency == data.BaseCurrency {
+		return
+	}
+
+	entries := make(map[int64]*data.Transaction, len(r.ledger))
+	dayRates := make(map[string]float64)
+	for _, t := range r.ledger {
+		entries[t.ID] = t
+		if t.Currency != currency {
+			continue
+		}
+		day := t.ExecutedAt.UTC().Format(time.DateOnly)
+		if _, ok := dayRates[day]; !ok {
+			dayRates[day] = t.FXRate
+		}
+	}
+
+	rateOf := func(id int64, at time.Time) (float64, bool) {
+		if t, ok := entries[id]; ok && t.Currency == currency {
+			return t.FXRate, true
+		}
+		if fx, ok := dayRates[at.UTC().Format(time.DateOnly)]; ok {
+			return fx, true
+		}
+		return rate, false
+	}
+
+	for _, d := range r.Disposals {
+		proceedsRate, proceedsKnown := rateOf(d.TransactionID, d.DisposedAt)
+		costRate, costKnown := rateOf(d.LotTransactionID, d.AcquiredAt)
+
+		d.Proceeds *= proceedsRate
+		d.CostBasis *= costRate
+		d.Gain = d.Proceeds - d.CostBasis
+		d.FXEstimated = !proceedsKnown || !costKnown
+	}
+	r.sum()
+}
@@ -10,12 +10,20 @@ var EmailRx = regexp.MustCompile(
 )
 
 var (
-	ErrRecordNotFound  = errors.New("record not found")
-	ErrDuplicateEmail  = errors.New("duplicate email")
-	ErrEditConflict    = errors.New("edit conflict")
+	ErrRecordNotFound       = errors.New("record not found")
+	ErrDuplicateEmail       = errors.New("duplicate email")
+	ErrEditConflict         = errors.New("edit conflict")
+	ErrDuplicateCoin        = errors.New("duplicate coin")
+	ErrDuplicatePortfolio   = errors.New("duplicate portfolio")
+	ErrDuplicateWatchlist   = errors.New("duplicate watchlist")
+	ErrPortfolioArchived    = errors.New("portfolio is archived, unarchive it to change its holdings")
+	ErrInsufficientHoldings = errors.New(
+		"insufficient holdings, the transaction disposes more than the portfolio holds",
+	)
 	ErrInvalidCurrency = errors.New(
 		"invalid currency, please use valid currencies like 'usd', 'gbp', 'try'",
 	)
+	ErrTokenReused = errors.New("refresh token was already used, the session has been revoked")
 )
 
 // / It contains map of validation errors
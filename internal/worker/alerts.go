@@ -0,0 +1,239 @@
+package worker
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/mail"
+)
+
+// / Coins per market listing request, the page limit of the providers.
+const alertBatchSize = 250
+
+// / AlertEvaluator periodically checks the active alerts against fresh
+// / market data and emails the users whose alerts crossed their threshold.
+type AlertEvaluator struct {
+	alertModel *data.AlertModel
+	client     data.MarketDataProvider
+	mailer     mail.Mailer
+	interval   time.Duration
+	logger     zerolog.Logger
+}
+
+func NewAlertEvaluator(
+	alertModel *data.AlertModel,
+	client data.MarketDataProvider,
+	mailer mail.Mailer,
+	interval time.Duration,
+	logger zerolog.Logger,
+) *AlertEvaluator {
+	return &AlertEvaluator{
+		alertModel: alertModel,
+		client:     client,
+		mailer:     mailer,
+		interval:   interval,
+		logger:     logger,
+	}
+}
+
+func (e *AlertEvaluator) Start() {
+	e.logger.Info().Msgf("Starting alert evaluator every %s", e.interval)
+	register("alerts", e.interval)
+	go e.schedule()
+}
+
+func (e *AlertEvaluator) schedule() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := e.evaluate(time.Now())
+		if err != nil {
+			e.logger.Err(err).Msgf("Failed to evaluate alerts %v", err)
+		}
+		report("alerts", err)
+	}
+}
+
+// / USD price and 24h change in percent of a coin.
+type quote struct {
+	price  float64
+	change float64
+}
+
+func (e *AlertEvaluator) evaluate(now time.Time) error {
+	alerts, err := e.alertModel.GetActive()
+	if err != nil {
+		return err
+	}
+	if len(alerts) == 0 {
+		return nil
+	}
+
+	var (
+		coinIDs []string
+		userIDs []int64
+	)
+	seenCoins := make(map[string]bool)
+	seenUsers := make(map[int64]bool)
+	for _, a := range alerts {
+		switch {
+		case a.IsPNL() && !seenUsers[a.UserID]:
+			seenUsers[a.UserID] = true
+			userIDs = append(userIDs, a.UserID)
+		case !a.IsPNL() && !seenCoins[a.CoinID]:
+			seenCoins[a.CoinID] = true
+			coinIDs = append(coinIDs, a.CoinID)
+		}
+	}
+
+	quotes := e.quotes(coinIDs)
+
+	pnls := map[int64]float64{}
+	if len(userIDs) > 0 {
+		pnls, err = e.alertModel.TotalPNL(userIDs)
+		if err != nil {
+			return err
+		}
+	}
+
+	rates, err := e.client.GetExchangeRates()
+	if err != nil {
+		return err
+	}
+
+	e.logger.Info().Msgf("Evaluating %d alerts", len(alerts))
+
+	for _, a := range alerts {
+		rate, err := rates.Rate(a.Currency)
+		if err != nil {
+			e.logger.Err(err).Msgf("Unsupported currency %s of alert %d", a.Currency, a.ID)
+			continue
+		}
+
+		var value float64
+		switch {
+		case a.IsPNL():
+			// Users without holdings have no PNL to compare.
+			pnl, ok := pnls[a.UserID]
+			if !ok {
+				continue
+			}
+			value = pnl * rate
+		case a.IsChange():
+			q, ok := quotes[a.CoinID]
+			if !ok {
+				continue
+			}
+			value = q.change
+		default:
+			q, ok := quotes[a.CoinID]
+			if !ok {
+				continue
+			}
+			value = q.price * rate
+		}
+
+		if !a.Crossed(value) {
+			if met := a.Met(value); a.ConditionMet == nil || *a.ConditionMet != met {
+				if err := e.alertModel.SetConditionMet(a, met); err != nil {
+					e.logger.Err(err).Msgf("Failed to record the state of alert %d", a.ID)
+				}
+			}
+			continue
+		}
+
+		// A crossing within the cooldown is picked up once it has passed,
+		// as long as the value is still past the threshold.
+		if !a.Due(now) {
+			continue
+		}
+
+		e.trigger(a, value, now)
+	}
+	return nil
+}
+
+// / Mark the alert as triggered and email it. When the email can't be sent
+// / the trigger is reverted, so the alert is delivered on a later round
+// / instead of being lost.
+func (e *AlertEvaluator) trigger(a *data.Alert, value float64, now time.Time) {
+	lastTriggeredAt := a.LastTriggeredAt
+
+	ok, err := e.alertModel.MarkTriggered(a, now)
+	if err != nil {
+		e.logger.Err(err).Msgf("Failed to mark alert %d as triggered", a.ID)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	if err := e.deliver(a, value); err != nil {
+		e.logger.Err(err).Msgf("Failed to deliver alert %d, retrying next round: %v", a.ID, err)
+
+		if err := e.alertModel.RevertTrigger(a, lastTriggeredAt, now); err != nil {
+			e.logger.Err(err).Msgf("Failed to revert the trigger of alert %d", a.ID)
+		}
+	}
+}
+
+// / Fetch the market data of the coins in batches. Coins missing from the
+// / listing are skipped for this round.
+func (e *AlertEvaluator) quotes(coinIDs []string) map[string]quote {
+	quotes := make(map[string]quote, len(coinIDs))
+
+	for start := 0; start < len(coinIDs); start += alertBatchSize {
+		batch := coinIDs[start:min(start+alertBatchSize, len(coinIDs))]
+
+		filters := data.Filters{
+			Ids:     strings.Join(batch, ","),
+			Page:    1,
+			PerPage: len(batch),
+			Order:   "market_cap_desc",
+		}
+
+		markets, err := e.client.GetCoinMarkets(data.BaseCurrency, filters)
+		if err != nil {
+			e.logger.Err(err).Msgf("Error getting market data of %d coins: %v", len(batch), err)
+			continue
+		}
+
+		for _, m := range markets {
+			var change float64
+			if open := m.CurrentPrice - m.PriceChange24h; open > 0 {
+				change = m.PriceChange24h / open * 100
+			}
+			quotes[m.ID] = quote{price: m.CurrentPrice, change: change}
+		}
+	}
+	return quotes
+}
+
+// / Email the triggered alert to its owner.
+func (e *AlertEvaluator) deliver(a *data.Alert, value float64) error {
+	template := "alert_price.tmpl"
+	switch {
+	case a.IsChange():
+		template = "alert_change.tmpl"
+		value = math.Abs(value)
+	case a.IsPNL():
+		template = "alert_pnl.tmpl"
+	}
+
+	mailData := map[string]any{
+		"Name":      a.UserName,
+		"Alert":     a,
+		"Value":     value,
+		"Currency":  strings.ToUpper(a.Currency),
+		"Above":     a.Kind == data.AlertPriceAbove || a.Kind == data.AlertPNLAbove,
+		"Up":        a.Kind == data.AlertChangeUp,
+		"Recurring": a.Active,
+	}
+
+	return e.mailer.Send(a.UserEmail, template, mailData)
+}
@@ -0,0 +1,454 @@
+package worker
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+
+	"github.com/aalperen0/portfolio-tracker/internal/csvutil"
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+	"github.com/aalperen0/portfolio-tracker/internal/mail"
+	"github.com/aalperen0/portfolio-tracker/internal/model"
+	"github.com/aalperen0/portfolio-tracker/internal/validator"
+)
+
+// / ExportWriter builds the requested data exports off the request path and
+// / mails their owner a download link. Every hour expired archives
+// / are purged and unfinished exports are queued again, as they are at
+// / startup.
+type ExportWriter struct {
+	models  *model.Models
+	mailer  mail.Mailer
+	baseURL string
+	logger  zerolog.Logger
+}
+
+func NewExportWriter(
+	models *model.Models,
+	mailer mail.Mailer,
+	baseURL string,
+	logger zerolog.Logger,
+) *ExportWriter {
+	return &ExportWriter{
+		models:  models,
+		mailer:  mailer,
+		baseURL: baseURL,
+		logger:  logger,
+	}
+}
+
+func (e *ExportWriter) Start() {
+	e.logger.Info().Msg("Starting export writer")
+	register("exports", time.Hour)
+	e.requeue()
+	go e.processQueue()
+	go e.schedulePurge()
+}
+
+func (e *ExportWriter) schedulePurge() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purged, err := e.models.Export.PurgeExpired(time.Now())
+		if err != nil {
+			e.logger.Err(err).Msgf("Failed to purge expired exports %v", err)
+		} else if purged > 0 {
+			e.logger.Info().Msgf("Purged %d expired exports", purged)
+		}
+		report("exports", err)
+
+		e.requeue()
+	}
+}
+
+// / Queue the pending exports and the ready ones whose link wasn't mailed.
+func (e *ExportWriter) requeue() {
+	queued, err := e.models.Export.RequeueUnfinished()
+	if err != nil {
+		e.logger.Err(err).Msgf("Failed to queue unfinished exports %v", err)
+		return
+	}
+	if queued > 0 {
+		e.logger.Info().Msgf("Queued %d unfinished exports", queued)
+	}
+}
+
+// / Pop export ids from the queue and build them one at a time.
+func (e *ExportWriter) processQueue() {
+	ctx := context.Background()
+
+	for {
+		result, err := e.models.RDB.BLPop(ctx, 5*time.Second, data.ExportQueue).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			e.logger.Err(err).Msgf("Error popping export from queue: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		if len(result) < 2 {
+			e.logger.Info().Msg("Invalid result from queue")
+			continue
+		}
+
+		id, err := strconv.ParseInt(result[1], 10, 64)
+		if err != nil {
+			e.logger.Err(err).Msgf("Invalid export id %q in queue", result[1])
+			continue
+		}
+
+		if err := e.process(id); err != nil {
+			e.logger.Err(err).Msgf("Failed to process export %d: %v", id, err)
+			if err := e.models.Export.Fail(id); err != nil {
+				e.logger.Err(err).Msgf("Failed to mark export %d as failed", id)
+			}
+		}
+	}
+}
+
+// / Build a pending export and mail its link. A ready export whose link
+// / couldn't be mailed gets a new token and is mailed again.
+func (e *ExportWriter) process(id int64) error {
+	export, err := e.models.Export.Get(id)
+	if err != nil {
+		if errors.Is(err, validator.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	user, err := e.models.User.Get(export.UserID)
+	if err != nil {
+		return err
+	}
+
+	var token string
+	switch {
+	case export.Status == data.ExportPending:
+		archive, err := e.build(user)
+		if err != nil {
+			return err
+		}
+
+		token, err = e.models.Export.Complete(export, archive)
+		if err != nil {
+			return err
+		}
+	case export.Status == data.ExportReady && export.MailedAt == nil:
+		token, err = e.models.Export.Reissue(export)
+		if err != nil {
+			if errors.Is(err, validator.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+	default:
+		return nil
+	}
+
+	mailData := map[string]any{
+		"Name":         user.Name,
+		"downloadLink": e.baseURL + "/v1/exports/download?token=" + token,
+		"expiry":       export.Expiry.UTC().Format(time.RFC1123),
+	}
+
+	// The export stays unmailed on failure, the hourly requeue sends a new link.
+	if err := e.mailer.Send(user.Email, "export_ready.tmpl", mailData); err != nil {
+		return err
+	}
+	return e.models.Export.MarkMailed(export.ID)
+}
+
+// / Everything stored about a user, the content of export.json.
+type userExport struct {
+	ExportedAt   time.Time           `json:"exported_at"`
+	Profile      exportProfile       `json:"profile"`
+	Portfolios   []*data.Portfolio   `json:"portfolios"`
+	Targets      []exportTargets     `json:"allocation_targets"`
+	Watchlists   []*data.Watchlist   `json:"watchlists"`
+	Holdings     []*data.Coin        `json:"holdings"`
+	Transactions []*data.Transaction `json:"transactions"`
+	Alerts       []*data.Alert       `json:"alerts"`
+	Sessions     []*data.Session     `json:"sessions"`
+	APIKeys      []*data.APIKey      `json:"api_keys"`
+	AuditLog     []*data.AuditEntry  `json:"audit_log"`
+}
+
+// / The user with the account state kept outside of it.
+type exportProfile struct {
+	*data.User
+	PendingEmail     string `json:"pending_email"`
+	TwoFactorEnabled bool   `json:"two_factor_enabled"`
+}
+
+// / Allocation targets of a portfolio.
+type exportTargets struct {
+	PortfolioID int64                    `json:"portfolio_id"`
+	Targets     []*data.AllocationTarget `json:"targets"`
+}
+
+func (e *ExportWriter) collect(user *data.User) (*userExport, error) {
+	var (
+		out = &userExport{ExportedAt: time.Now().UTC(), Profile: exportProfile{User: user}}
+		err error
+	)
+
+	if out.Profile.PendingEmail, err = e.models.User.PendingEmail(user.ID); err != nil {
+		return nil, err
+	}
+	tf, err := e.models.TwoFactor.Get(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	out.Profile.TwoFactorEnabled = tf.Enabled
+
+	if out.Portfolios, err = e.models.Portfolio.GetAllForUser(user.ID, true); err != nil {
+		return nil, err
+	}
+	for _, p := range out.Portfolios {
+		targets, err := e.models.Target.GetForPortfolio(p.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(targets) > 0 {
+			out.Targets = append(out.Targets, exportTargets{PortfolioID: p.ID, Targets: targets})
+		}
+	}
+	if out.Watchlists, err = e.models.Watchlist.GetAllForUser(user.ID); err != nil {
+		return nil, err
+	}
+	if out.Holdings, err = e.models.Coin.HoldingsForUser(user.ID); err != nil {
+		return nil, err
+	}
+	if out.Transactions, err = e.models.Transaction.AllForUser(user.ID); err != nil {
+		return nil, err
+	}
+	if out.Alerts, err = e.models.Alert.GetAllForUser(user.ID, false); err != nil {
+		return nil, err
+	}
+	if out.Sessions, err = e.models.Token.GetSessions(user.ID, nil); err != nil {
+		return nil, err
+	}
+	if out.APIKeys, err = e.models.APIKey.GetAllForUser(user.ID); err != nil {
+		return nil, err
+	}
+	if out.AuditLog, err = e.models.Audit.GetAllForUser(user.ID); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// / Zip the export as export.json plus a CSV file per section.
+func (e *ExportWriter) build(user *data.User) ([]byte, error) {
+	out, err := e.collect(user)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+
+	js, err := json.MarshalIndent(out, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := zw.Create("export.json")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(js); err != nil {
+		return nil, err
+	}
+
+	for _, table := range exportTables(out) {
+		w, err := zw.Create(table.name + ".csv")
+		if err != nil {
+			return nil, err
+		}
+
+		cw := csv.NewWriter(w)
+		if err := cw.Write(table.header); err != nil {
+			return nil, err
+		}
+		if err := cw.WriteAll(table.rows); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type exportTable struct {
+	name   string
+	header []string
+	rows   [][]string
+}
+
+func exportTables(out *userExport) []exportTable {
+	u := out.Profile
+	profile := exportTable{
+		name: "profile",
+		header: []string{
+			"id", "created_at", "name", "email", "activated", "cost_basis_method", "reporting_currency", "role",
+			"pending_email", "two_factor_enabled",
+		},
+		rows: [][]string{{
+			formatInt(u.ID), formatTime(&u.CreatedAt), csvutil.EscapeFormula(u.Name),
+			csvutil.EscapeFormula(u.Email), strconv.FormatBool(u.Activated), u.CostBasisMethod, u.Currency, u.Role,
+			csvutil.EscapeFormula(u.PendingEmail), strconv.FormatBool(u.TwoFactorEnabled),
+		}},
+	}
+
+	portfolios := exportTable{
+		name:   "portfolios",
+		header: []string{"id", "created_at", "name", "is_default", "archived"},
+	}
+	for _, p := range out.Portfolios {
+		portfolios.rows = append(portfolios.rows, []string{
+			formatInt(p.ID), formatTime(&p.CreatedAt), csvutil.EscapeFormula(p.Name), strconv.FormatBool(p.IsDefault),
+			strconv.FormatBool(p.Archived),
+		})
+	}
+
+	targets := exportTable{
+		name:   "allocation_targets",
+		header: []string{"portfolio_id", "coin_id", "weight"},
+	}
+	for _, pt := range out.Targets {
+		for _, t := range pt.Targets {
+			targets.rows = append(targets.rows, []string{formatInt(pt.PortfolioID), t.CoinID, formatFloat(t.Weight)})
+		}
+	}
+
+	watchlists := exportTable{
+		name:   "watchlists",
+		header: []string{"id", "created_at", "name", "coins"},
+	}
+	for _, wl := range out.Watchlists {
+		coins, _ := json.Marshal(wl.CoinIDs)
+		watchlists.rows = append(watchlists.rows, []string{
+			formatInt(wl.ID), formatTime(&wl.CreatedAt), csvutil.EscapeFormula(wl.Name), string(coins),
+		})
+	}
+
+	holdings := exportTable{
+		name: "holdings",
+		header: []string{
+			"id", "portfolio_id", "coin_id", "symbol", "amount", "purchase_price_average", "total_cost",
+			"unrealized_pnl", "realized_pnl",
+		},
+	}
+	for _, c := range out.Holdings {
+		holdings.rows = append(holdings.rows, []string{
+			formatInt(c.ID), formatInt(c.PortfolioID), c.CoinID, c.Symbol, formatFloat(c.Amount),
+			formatFloat(c.PurchasePriceAverage), formatFloat(c.TotalCost), formatFloat(c.PNL),
+			formatFloat(c.RealizedPNL),
+		})
+	}
+
+	transactions := exportTable{
+		name: "transactions",
+		header: []string{
+			"id", "portfolio_id", "coin_id", "symbol", "type", "quantity", "price", "fee", "currency", "fx_rate",
+			"note", "executed_at", "created_at",
+		},
+	}
+	for _, t := range out.Transactions {
+		transactions.rows = append(transactions.rows, []string{
+			formatInt(t.ID), formatInt(t.PortfolioID), t.CoinID, t.Symbol, t.Type, formatFloat(t.Quantity),
+			formatFloat(t.Price), formatFloat(t.Fee), t.Currency, formatFloat(t.FXRate), csvutil.EscapeFormula(t.Note),
+			formatTime(&t.ExecutedAt), formatTime(&t.CreatedAt),
+		})
+	}
+
+	alerts := exportTable{
+		name: "alerts",
+		header: []string{
+			"id", "created_at", "kind", "coin_id", "threshold", "currency", "recurring", "cooldown_minutes",
+			"active", "last_triggered_at", "trigger_count",
+		},
+	}
+	for _, a := range out.Alerts {
+		alerts.rows = append(alerts.rows, []string{
+			formatInt(a.ID), formatTime(&a.CreatedAt), a.Kind, a.CoinID, formatFloat(a.Threshold), a.Currency,
+			strconv.FormatBool(a.Recurring), strconv.Itoa(a.CooldownMinutes), strconv.FormatBool(a.Active),
+			formatTime(a.LastTriggeredAt), strconv.Itoa(a.TriggerCount),
+		})
+	}
+
+	sessions := exportTable{
+		name:   "sessions",
+		header: []string{"id", "created_at", "expiry", "last_used_at", "user_agent", "ip"},
+	}
+	for _, s := range out.Sessions {
+		sessions.rows = append(sessions.rows, []string{
+			formatInt(s.ID), formatTime(&s.CreatedAt), formatTime(&s.Expiry), formatTime(s.LastUsedAt),
+			csvutil.EscapeFormula(s.UserAgent), csvutil.EscapeFormula(s.IP),
+		})
+	}
+
+	apiKeys := exportTable{
+		name:   "api_keys",
+		header: []string{"id", "created_at", "name", "prefix", "scopes", "expiry", "last_used_at"},
+	}
+	for _, k := range out.APIKeys {
+		scopes, _ := json.Marshal(k.Scopes)
+		apiKeys.rows = append(apiKeys.rows, []string{
+			formatInt(k.ID), formatTime(&k.CreatedAt), csvutil.EscapeFormula(k.Name), k.Prefix, string(scopes),
+			formatTime(k.Expiry), formatTime(k.LastUsedAt),
+		})
+	}
+
+	auditLog := exportTable{
+		name:   "audit_log",
+		header: []string{"id", "created_at", "actor_id", "action", "target_user_id", "details", "ip"},
+	}
+	for _, a := range out.AuditLog {
+		details, _ := json.Marshal(a.Details)
+		auditLog.rows = append(auditLog.rows, []string{
+			formatInt(a.ID), formatTime(&a.CreatedAt), formatIntPtr(a.ActorID), a.Action,
+			formatIntPtr(a.TargetUserID), string(details), csvutil.EscapeFormula(a.IP),
+		})
+	}
+
+	return []exportTable{
+		profile, portfolios, targets, watchlists, holdings, transactions, alerts, sessions, apiKeys, auditLog,
+	}
+}
+
+func formatInt(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+func formatIntPtr(n *int64) string {
+	if n == nil {
+		return ""
+	}
+	return formatInt(*n)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,104 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+)
+
+// / PriceHistoryWriter backfills the OHLC price history of every held coin
+// / at startup and keeps the current candles up to date with live prices.
+type PriceHistoryWriter struct {
+	coinModel    *data.CoinModel
+	priceModel   *data.PriceHistoryModel
+	client       data.MarketDataProvider
+	interval     time.Duration
+	backfillDays int
+	logger       zerolog.Logger
+}
+
+func NewPriceHistoryWriter(
+	coinModel *data.CoinModel,
+	priceModel *data.PriceHistoryModel,
+	client data.MarketDataProvider,
+	interval time.Duration,
+	backfillDays int,
+	logger zerolog.Logger,
+) *PriceHistoryWriter {
+	return &PriceHistoryWriter{
+		coinModel:    coinModel,
+		priceModel:   priceModel,
+		client:       client,
+		interval:     interval,
+		backfillDays: backfillDays,
+		logger:       logger,
+	}
+}
+
+func (p *PriceHistoryWriter) Start() {
+	p.logger.Info().Msgf("Starting price history writer every %s", p.interval)
+	register("price_history", p.interval)
+	go func() {
+		p.backfill()
+		p.schedule()
+	}()
+}
+
+// / Backfill the configured number of days for every held coin. Errors of
+// / a coin are logged and don't stop the others.
+func (p *PriceHistoryWriter) backfill() {
+	if p.backfillDays <= 0 {
+		return
+	}
+
+	coinIDs, err := p.coinModel.HeldCoinIDs()
+	if err != nil {
+		p.logger.Err(err).Msgf("Failed to list coins for price backfill %v", err)
+		return
+	}
+
+	to := time.Now()
+	from := to.AddDate(0, 0, -p.backfillDays)
+
+	for _, coinID := range coinIDs {
+		p.logger.Info().Msgf("Backfilling price history of %s", coinID)
+		if err := p.priceModel.Backfill(p.client, coinID, from, to); err != nil {
+			p.logger.Err(err).Msgf("Error backfilling price history of %s: %v", coinID, err)
+		}
+	}
+}
+
+func (p *PriceHistoryWriter) schedule() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := p.record(time.Now())
+		if err != nil {
+			p.logger.Err(err).Msgf("Failed to record price history %v", err)
+		}
+		report("price_history", err)
+	}
+}
+
+// / Merge the current price of every held coin into its open candles.
+func (p *PriceHistoryWriter) record(at time.Time) error {
+	coinIDs, err := p.coinModel.HeldCoinIDs()
+	if err != nil {
+		return err
+	}
+
+	for _, coinID := range coinIDs {
+		price, _, err := p.client.GetCoinCurrentPriceAndSymbol(coinID)
+		if err != nil {
+			p.logger.Err(err).Msgf("Error getting current price for %s: %v", coinID, err)
+			continue
+		}
+		if err := p.priceModel.Record(coinID, price, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
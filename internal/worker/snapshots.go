@@ -0,0 +1,106 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+)
+
+// / SnapshotWriter periodically records the value of every holding and the
+// / totals of every user, the source of the value history endpoint. Once a
+// / day snapshots older than the hourly retention are downsampled to one
+// / per day.
+type SnapshotWriter struct {
+	coinModel       *data.CoinModel
+	snapshotModel   *data.SnapshotModel
+	priceModel      *data.PriceHistoryModel
+	client          data.MarketDataProvider
+	interval        time.Duration
+	hourlyRetention time.Duration
+	downsampledAt   time.Time
+	logger          zerolog.Logger
+}
+
+func NewSnapshotWriter(
+	coinModel *data.CoinModel,
+	snapshotModel *data.SnapshotModel,
+	priceModel *data.PriceHistoryModel,
+	client data.MarketDataProvider,
+	interval time.Duration,
+	hourlyRetention time.Duration,
+	logger zerolog.Logger,
+) *SnapshotWriter {
+	return &SnapshotWriter{
+		coinModel:       coinModel,
+		snapshotModel:   snapshotModel,
+		priceModel:      priceModel,
+		client:          client,
+		interval:        interval,
+		hourlyRetention: hourlyRetention,
+		logger:          logger,
+	}
+}
+
+func (s *SnapshotWriter) Start() {
+	s.logger.Info().Msgf("Starting snapshot writer every %s", s.interval)
+	register("snapshots", s.interval)
+	go s.schedule()
+}
+
+func (s *SnapshotWriter) schedule() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+
+		err := s.write(now.Truncate(time.Minute))
+		if err != nil {
+			s.logger.Err(err).Msgf("Failed to write portfolio snapshots %v", err)
+		}
+		report("snapshots", err)
+
+		if now.Sub(s.downsampledAt) >= 24*time.Hour {
+			s.downsample(now)
+		}
+	}
+}
+
+func (s *SnapshotWriter) downsample(now time.Time) {
+	deleted, err := s.snapshotModel.Downsample(now.Add(-s.hourlyRetention))
+	if err != nil {
+		s.logger.Err(err).Msgf("Failed to downsample portfolio snapshots %v", err)
+		return
+	}
+	s.downsampledAt = now
+	s.logger.Info().Msgf("Downsampled portfolio snapshots, %d deleted", deleted)
+}
+
+// / Fetch the current price of every held coin and record the snapshots.
+// / A coin whose price can't be fetched is valued from the price history,
+// / or at its last PNL price when the history has no recent candle.
+func (s *SnapshotWriter) write(takenAt time.Time) error {
+	coinIDs, err := s.coinModel.HeldCoinIDs()
+	if err != nil {
+		return err
+	}
+
+	prices := make(map[string]float64, len(coinIDs))
+	for _, coinID := range coinIDs {
+		price, _, err := s.client.GetCoinCurrentPriceAndSymbol(coinID)
+		if err != nil {
+			s.logger.Err(err).Msgf("Error getting current price for %s: %v", coinID, err)
+
+			price, err = s.priceModel.PriceAt(coinID, takenAt)
+			if err != nil {
+				continue
+			}
+		}
+		prices[coinID] = price
+	}
+
+	s.logger.Info().Msgf("Writing portfolio snapshots of %d coins", len(coinIDs))
+	return s.snapshotModel.Insert(prices, takenAt)
+}
@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// / Status of a background worker as shown on the admin endpoints.
+type Status struct {
+	Name      string     `json:"name"`
+	Interval  string     `json:"interval"`
+	Runs      int        `json:"runs"`
+	Failures  int        `json:"failures"`
+	LastRun   *time.Time `json:"last_run"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+var (
+	statusMu sync.Mutex
+	statuses = map[string]*Status{}
+)
+
+// / Register a worker when it starts, so it is listed before its first run.
+func register(name string, interval time.Duration) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	statuses[name] = &Status{Name: name, Interval: interval.String()}
+}
+
+// / Record the outcome of a run of the worker.
+func report(name string, err error) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	s, ok := statuses[name]
+	if !ok {
+		s = &Status{Name: name}
+		statuses[name] = s
+	}
+
+	now := time.Now()
+	s.Runs++
+	s.LastRun = &now
+	s.LastError = ""
+	if err != nil {
+		s.Failures++
+		s.LastError = err.Error()
+	}
+}
+
+// / Statuses returns a copy of the status of every started worker by name.
+func Statuses() []Status {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	list := make([]Status, 0, len(statuses))
+	for _, s := range statuses {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
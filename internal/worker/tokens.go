@@ -0,0 +1,50 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/aalperen0/portfolio-tracker/internal/data"
+)
+
+// / TokenPurger periodically deletes the expired tokens, so rotated refresh
+// / tokens and unused activation and reset tokens don't pile up.
+type TokenPurger struct {
+	tokenModel *data.TokenModel
+	interval   time.Duration
+	logger     zerolog.Logger
+}
+
+func NewTokenPurger(
+	tokenModel *data.TokenModel,
+	interval time.Duration,
+	logger zerolog.Logger,
+) *TokenPurger {
+	return &TokenPurger{
+		tokenModel: tokenModel,
+		interval:   interval,
+		logger:     logger,
+	}
+}
+
+func (p *TokenPurger) Start() {
+	p.logger.Info().Msgf("Starting token purger every %s", p.interval)
+	register("tokens", p.interval)
+	go p.schedule()
+}
+
+func (p *TokenPurger) schedule() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purged, err := p.tokenModel.PurgeExpired(time.Now())
+		if err != nil {
+			p.logger.Err(err).Msgf("Failed to purge expired tokens %v", err)
+		} else if purged > 0 {
+			p.logger.Info().Msgf("Purged %d expired tokens", purged)
+		}
+		report("tokens", err)
+	}
+}
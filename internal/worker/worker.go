@@ -12,14 +12,14 @@ import (
 
 type PNLUpdater struct {
 	coinModel *data.CoinModel
-	client    *data.Client
+	client    data.MarketDataProvider
 	interval  time.Duration
 	logger    zerolog.Logger
 }
 
 func NewPNLUpdater(
 	coinModel *data.CoinModel,
-	client *data.Client,
+	client data.MarketDataProvider,
 	interval time.Duration,
 	logger zerolog.Logger,
 ) *PNLUpdater {
@@ -33,6 +33,7 @@ func NewPNLUpdater(
 
 func (p *PNLUpdater) Start() {
 	p.logger.Info().Msg("Starting worker...")
+	register("pnl_updates", p.interval)
 	go p.processQueue()
 
 	go p.scheduleUpdates()
@@ -47,9 +48,11 @@ func (p *PNLUpdater) scheduleUpdates() {
 
 	for range ticker.C {
 		p.logger.Info().Msg("Enqueuing PNL updates for all coins")
-		if err := p.coinModel.EnqueuePNLUpdates(); err != nil {
+		err := p.coinModel.EnqueuePNLUpdates()
+		if err != nil {
 			p.logger.Err(err).Msgf("Failed to enqueue pnl updates %v", err)
 		}
+		report("pnl_updates", err)
 	}
 }
 
@@ -57,7 +60,7 @@ func (p *PNLUpdater) scheduleUpdates() {
 // / Otherwise block until any element is available.
 // / If queue is empty or result is invalid, it's skipping.
 // / Get the first coin with related to.
-// / Search coin price from CoinGecko API.
+// / Search coin price from the market data provider.
 // / Send to the update.
 
 func (p *PNLUpdater) processQueue() {
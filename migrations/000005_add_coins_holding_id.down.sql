@@ -0,0 +1,5 @@
+ALTER TABLE coins DROP CONSTRAINT IF EXISTS coins_user_id_coin_id_key;
+ALTER TABLE coins DROP COLUMN IF EXISTS id;
+-- A coin_id primary key can't hold the same coin for two users, keying on
+-- both keeps every holding on the way down.
+ALTER TABLE coins ADD PRIMARY KEY (coin_id, user_id);
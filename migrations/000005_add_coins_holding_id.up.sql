@@ -0,0 +1,3 @@
+ALTER TABLE coins DROP CONSTRAINT IF EXISTS coins_pkey;
+ALTER TABLE coins ADD COLUMN IF NOT EXISTS id bigserial PRIMARY KEY;
+ALTER TABLE coins ADD CONSTRAINT coins_user_id_coin_id_key UNIQUE (user_id, coin_id);
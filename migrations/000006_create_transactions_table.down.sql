@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_transactions_user_coin;
+DROP TABLE IF EXISTS transactions;
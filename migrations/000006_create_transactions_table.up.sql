@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS transactions(
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    coin_id TEXT NOT NULL,
+    symbol TEXT NOT NULL,
+    type TEXT NOT NULL,
+    quantity DOUBLE PRECISION NOT NULL,
+    price DOUBLE PRECISION NOT NULL DEFAULT 0,
+    fee DOUBLE PRECISION NOT NULL DEFAULT 0,
+    note TEXT NOT NULL DEFAULT '',
+    executed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    version INTEGER NOT NULL DEFAULT 1,
+    CONSTRAINT transactions_type_check
+        CHECK (type IN ('buy', 'sell', 'transfer_in', 'transfer_out', 'fee', 'airdrop')),
+    CONSTRAINT transactions_quantity_check CHECK (quantity > 0),
+    CONSTRAINT transactions_price_check CHECK (price >= 0),
+    CONSTRAINT transactions_fee_check CHECK (fee >= 0)
+);
+
+CREATE INDEX IF NOT EXISTS idx_transactions_user_coin ON transactions(user_id, coin_id, executed_at);
+
+-- Existing holdings become an opening buy so the ledger reproduces them.
+INSERT INTO transactions(user_id, coin_id, symbol, type, quantity, price, note, executed_at)
+SELECT user_id, coin_id, symbol, 'buy', amount, purchase_price_average, 'opening balance', created_at
+FROM coins
+WHERE amount > 0;
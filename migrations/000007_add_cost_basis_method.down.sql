@@ -0,0 +1,4 @@
+ALTER TABLE coins DROP COLUMN IF EXISTS realized_pnl;
+
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_cost_basis_method_check;
+ALTER TABLE users DROP COLUMN IF EXISTS cost_basis_method;
@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS cost_basis_method TEXT NOT NULL DEFAULT 'average';
+ALTER TABLE users ADD CONSTRAINT users_cost_basis_method_check
+    CHECK (cost_basis_method IN ('fifo', 'lifo', 'hifo', 'average'));
+
+ALTER TABLE coins ADD COLUMN IF NOT EXISTS realized_pnl DOUBLE PRECISION NOT NULL DEFAULT 0;
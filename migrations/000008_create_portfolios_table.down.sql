@@ -0,0 +1,33 @@
+DROP INDEX IF EXISTS idx_transactions_user_id;
+DROP INDEX IF EXISTS idx_transactions_portfolio_coin;
+CREATE INDEX IF NOT EXISTS idx_transactions_user_coin ON transactions(user_id, coin_id, executed_at);
+ALTER TABLE transactions DROP COLUMN IF EXISTS portfolio_id;
+
+ALTER TABLE coins DROP CONSTRAINT IF EXISTS coins_portfolio_id_coin_id_key;
+
+-- A coin held in several portfolios of a user collapses into its oldest
+-- holding, which takes the sums of the others before they are removed.
+UPDATE coins SET amount = merged.amount,
+    total_cost = merged.total_cost,
+    purchase_price_average = CASE WHEN merged.amount > 0
+        THEN merged.total_cost / merged.amount
+        ELSE coins.purchase_price_average END,
+    pnl = merged.pnl,
+    realized_pnl = merged.realized_pnl
+FROM (
+    SELECT MIN(id) AS id, SUM(amount) AS amount, SUM(total_cost) AS total_cost, SUM(pnl) AS pnl,
+        SUM(realized_pnl) AS realized_pnl
+    FROM coins
+    GROUP BY user_id, coin_id
+    HAVING COUNT(*) > 1
+) AS merged
+WHERE coins.id = merged.id;
+
+DELETE FROM coins USING coins AS kept
+WHERE kept.user_id = coins.user_id AND kept.coin_id = coins.coin_id AND kept.id < coins.id;
+
+ALTER TABLE coins DROP COLUMN IF EXISTS portfolio_id;
+ALTER TABLE coins ADD CONSTRAINT coins_user_id_coin_id_key UNIQUE (user_id, coin_id);
+
+DROP INDEX IF EXISTS idx_portfolios_user_default;
+DROP TABLE IF EXISTS portfolios;
@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS portfolios(
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    name TEXT NOT NULL,
+    is_default BOOLEAN NOT NULL DEFAULT false,
+    archived BOOLEAN NOT NULL DEFAULT false,
+    version INTEGER NOT NULL DEFAULT 1,
+    CONSTRAINT portfolios_user_id_name_key UNIQUE (user_id, name)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_portfolios_user_default ON portfolios(user_id) WHERE is_default;
+
+-- Every existing user gets a default portfolio holding their current coins.
+INSERT INTO portfolios(user_id, name, is_default)
+SELECT id, 'Default', true FROM users;
+
+ALTER TABLE coins ADD COLUMN IF NOT EXISTS portfolio_id bigint REFERENCES portfolios ON DELETE CASCADE;
+UPDATE coins SET portfolio_id = portfolios.id
+FROM portfolios
+WHERE portfolios.user_id = coins.user_id AND portfolios.is_default;
+ALTER TABLE coins ALTER COLUMN portfolio_id SET NOT NULL;
+
+ALTER TABLE coins DROP CONSTRAINT IF EXISTS coins_user_id_coin_id_key;
+ALTER TABLE coins ADD CONSTRAINT coins_portfolio_id_coin_id_key UNIQUE (portfolio_id, coin_id);
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS portfolio_id bigint REFERENCES portfolios ON DELETE CASCADE;
+UPDATE transactions SET portfolio_id = portfolios.id
+FROM portfolios
+WHERE portfolios.user_id = transactions.user_id AND portfolios.is_default;
+ALTER TABLE transactions ALTER COLUMN portfolio_id SET NOT NULL;
+
+DROP INDEX IF EXISTS idx_transactions_user_coin;
+CREATE INDEX IF NOT EXISTS idx_transactions_portfolio_coin ON transactions(portfolio_id, coin_id, executed_at);
+CREATE INDEX IF NOT EXISTS idx_transactions_user_id ON transactions(user_id);
@@ -0,0 +1,5 @@
+ALTER TABLE users DROP COLUMN IF EXISTS reporting_currency;
+
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS transactions_fx_rate_check;
+ALTER TABLE transactions DROP COLUMN IF EXISTS fx_rate;
+ALTER TABLE transactions DROP COLUMN IF EXISTS currency;
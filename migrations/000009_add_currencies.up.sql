@@ -0,0 +1,5 @@
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'usd';
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fx_rate DOUBLE PRECISION NOT NULL DEFAULT 1;
+ALTER TABLE transactions ADD CONSTRAINT transactions_fx_rate_check CHECK (fx_rate > 0);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS reporting_currency TEXT NOT NULL DEFAULT 'usd';
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS holding_snapshots;
+DROP TABLE IF EXISTS portfolio_snapshots;
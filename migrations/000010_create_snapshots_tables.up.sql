@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS portfolio_snapshots(
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    taken_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    value DOUBLE PRECISION NOT NULL,
+    cost DOUBLE PRECISION NOT NULL,
+    unrealized_pnl DOUBLE PRECISION NOT NULL,
+    realized_pnl DOUBLE PRECISION NOT NULL,
+    CONSTRAINT portfolio_snapshots_user_id_taken_at_key UNIQUE (user_id, taken_at)
+);
+
+CREATE TABLE IF NOT EXISTS holding_snapshots(
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    portfolio_id bigint NOT NULL REFERENCES portfolios ON DELETE CASCADE,
+    coin_id TEXT NOT NULL,
+    taken_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    amount DOUBLE PRECISION NOT NULL,
+    price DOUBLE PRECISION NOT NULL,
+    value DOUBLE PRECISION NOT NULL,
+    cost DOUBLE PRECISION NOT NULL,
+    unrealized_pnl DOUBLE PRECISION NOT NULL,
+    realized_pnl DOUBLE PRECISION NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_holding_snapshots_user_taken_at ON holding_snapshots(user_id, taken_at);
+CREATE INDEX IF NOT EXISTS idx_holding_snapshots_portfolio_coin ON holding_snapshots(portfolio_id, coin_id, taken_at);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS price_history(
+    coin_id TEXT NOT NULL,
+    interval TEXT NOT NULL CHECK (interval IN ('1h', '1d')),
+    bucket TIMESTAMP WITH TIME ZONE NOT NULL,
+    open DOUBLE PRECISION NOT NULL,
+    high DOUBLE PRECISION NOT NULL,
+    low DOUBLE PRECISION NOT NULL,
+    close DOUBLE PRECISION NOT NULL,
+    volume DOUBLE PRECISION NOT NULL DEFAULT 0,
+    PRIMARY KEY (coin_id, interval, bucket)
+);
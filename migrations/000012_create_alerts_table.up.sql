@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS alerts(
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    coin_id TEXT NOT NULL DEFAULT '',
+    kind TEXT NOT NULL CHECK (kind IN ('price_above', 'price_below', 'change_up', 'change_down', 'pnl_above', 'pnl_below')),
+    threshold DOUBLE PRECISION NOT NULL,
+    currency TEXT NOT NULL DEFAULT 'usd',
+    recurring BOOLEAN NOT NULL DEFAULT false,
+    cooldown_minutes INTEGER NOT NULL DEFAULT 60 CHECK (cooldown_minutes > 0),
+    active BOOLEAN NOT NULL DEFAULT true,
+    last_triggered_at TIMESTAMP WITH TIME ZONE,
+    trigger_count INTEGER NOT NULL DEFAULT 0,
+    version INTEGER NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS idx_alerts_user_id ON alerts(user_id);
+CREATE INDEX IF NOT EXISTS idx_alerts_active ON alerts(coin_id) WHERE active;
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_tokens_family;
+
+DELETE FROM tokens WHERE scope = 'refresh';
+
+ALTER TABLE tokens DROP COLUMN IF EXISTS rotated_at;
+ALTER TABLE tokens DROP COLUMN IF EXISTS family;
@@ -0,0 +1,7 @@
+ALTER TABLE tokens ADD COLUMN family text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN rotated_at timestamp(0) with time zone;
+
+-- Sessions opened before refresh tokens are families of their own
+UPDATE tokens SET family = 'session-' || id WHERE scope = 'authentication';
+
+CREATE INDEX IF NOT EXISTS idx_tokens_family ON tokens(family) WHERE family <> '';
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS exports(
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    status text NOT NULL DEFAULT 'pending',
+    completed_at timestamp(0) with time zone,
+    expiry timestamp(0) with time zone,
+    token_hash bytea UNIQUE,
+    archive bytea,
+    size bigint NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_exports_user_id ON exports(user_id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_transactions_user_id_import_hash;
+
+ALTER TABLE transactions DROP COLUMN IF EXISTS import_hash;
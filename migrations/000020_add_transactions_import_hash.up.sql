@@ -0,0 +1,3 @@
+ALTER TABLE transactions ADD COLUMN import_hash text;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_transactions_user_id_import_hash ON transactions(user_id, import_hash);
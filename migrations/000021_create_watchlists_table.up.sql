@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS watchlists(
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    name TEXT NOT NULL,
+    coin_ids TEXT[] NOT NULL DEFAULT '{}',
+    version INTEGER NOT NULL DEFAULT 1,
+    CONSTRAINT watchlists_user_id_name_key UNIQUE (user_id, name)
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS allocation_targets(
+    portfolio_id bigint NOT NULL REFERENCES portfolios ON DELETE CASCADE,
+    coin_id TEXT NOT NULL,
+    weight DOUBLE PRECISION NOT NULL CHECK (weight > 0 AND weight <= 100),
+    PRIMARY KEY (portfolio_id, coin_id)
+);
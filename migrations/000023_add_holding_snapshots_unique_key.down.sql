@@ -0,0 +1,2 @@
+ALTER TABLE holding_snapshots DROP CONSTRAINT IF EXISTS holding_snapshots_portfolio_id_coin_id_taken_at_key;
+CREATE INDEX IF NOT EXISTS idx_holding_snapshots_portfolio_coin ON holding_snapshots(portfolio_id, coin_id, taken_at);
@@ -0,0 +1,13 @@
+-- Ticks written twice at the same time left duplicate holding rows.
+DELETE FROM holding_snapshots
+WHERE id IN (
+    SELECT id FROM (
+        SELECT id, row_number() OVER (PARTITION BY portfolio_id, coin_id, taken_at ORDER BY id) AS n
+        FROM holding_snapshots
+    ) AS ranked
+    WHERE n > 1
+);
+
+DROP INDEX IF EXISTS idx_holding_snapshots_portfolio_coin;
+ALTER TABLE holding_snapshots
+    ADD CONSTRAINT holding_snapshots_portfolio_id_coin_id_taken_at_key UNIQUE (portfolio_id, coin_id, taken_at);
@@ -0,0 +1,2 @@
+-- Side of the threshold at the last evaluation, NULL until first evaluated.
+ALTER TABLE alerts ADD COLUMN IF NOT EXISTS condition_met BOOLEAN;
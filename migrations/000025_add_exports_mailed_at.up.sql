@@ -0,0 +1,5 @@
+-- Set once the download link of a ready export was mailed, exports still
+-- without it are mailed a new link by the export worker.
+ALTER TABLE exports ADD COLUMN IF NOT EXISTS mailed_at timestamp(0) with time zone;
+
+UPDATE exports SET mailed_at = completed_at WHERE status <> 'pending';
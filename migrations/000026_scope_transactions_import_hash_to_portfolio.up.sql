@@ -0,0 +1,5 @@
+-- The same export can be imported into several portfolios.
+DROP INDEX IF EXISTS idx_transactions_user_id_import_hash;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_transactions_user_id_portfolio_id_import_hash
+    ON transactions(user_id, portfolio_id, import_hash);